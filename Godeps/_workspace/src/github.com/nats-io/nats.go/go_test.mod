@@ -0,0 +1,22 @@
+module github.com/nats-io/nats.go
+
+go 1.19
+
+require (
+	github.com/golang/protobuf v1.4.2
+	github.com/klauspost/compress v1.17.0
+	github.com/nats-io/nats-server/v2 v2.10.0
+	github.com/nats-io/nkeys v0.4.5
+	github.com/nats-io/nuid v1.0.1
+	go.uber.org/goleak v1.2.1
+	golang.org/x/text v0.13.0
+	google.golang.org/protobuf v1.23.0
+)
+
+require (
+	github.com/minio/highwayhash v1.0.2 // indirect
+	github.com/nats-io/jwt/v2 v2.5.2 // indirect
+	golang.org/x/crypto v0.13.0 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+	golang.org/x/time v0.3.0 // indirect
+)
@@ -0,0 +1,226 @@
+// Package breaker guards calls to a dependency such as Redis with a deadline
+// per call, retries with backoff for calls that are safe to repeat, and a
+// circuit breaker that fails calls fast while the dependency keeps failing.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned when an attempt misses its deadline. The attempt
+// may have been applied anyway, so only calls that are safe to repeat are
+// retried after a timeout.
+var ErrTimeout = errors.New("call timed out")
+
+// State is the state of a circuit breaker.
+type State string
+
+const (
+	// Closed lets every call through.
+	Closed State = "closed"
+	// Open fails every call without making it, until the cooldown has
+	// passed.
+	Open State = "open"
+	// HalfOpen lets a single trial call through after the cooldown, closing
+	// the breaker if it succeeds and opening it again if it fails.
+	HalfOpen State = "half-open"
+)
+
+// OpenError is returned for calls rejected while the breaker is open.
+type OpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open, retry after %s", e.RetryAfter)
+}
+
+// Policy configures a Breaker.
+type Policy struct {
+	// Timeout is the deadline for each attempt, or zero for none.
+	Timeout time.Duration
+	// Retries is how many more times a call that is safe to repeat is
+	// attempted after failing.
+	Retries int
+	// Backoff is the wait before the first retry, doubling for each retry
+	// after it.
+	Backoff time.Duration
+	// Threshold is the number of consecutive failed attempts that opens the
+	// breaker.
+	Threshold int
+	// Cooldown is how long the breaker stays open before a trial call.
+	Cooldown time.Duration
+}
+
+var DefaultPolicy = Policy{
+	Timeout:   2 * time.Second,
+	Retries:   2,
+	Backoff:   50 * time.Millisecond,
+	Threshold: 5,
+	Cooldown:  10 * time.Second,
+}
+
+// Stats are the state of a breaker and counts of what it has done, for
+// metrics.
+type Stats struct {
+	State    State  `json:"state"`
+	Calls    uint64 `json:"calls"`
+	Failures uint64 `json:"failures"`
+	Timeouts uint64 `json:"timeouts"`
+	Retries  uint64 `json:"retries"`
+	Rejected uint64 `json:"rejected"`
+	Opened   uint64 `json:"opened"`
+}
+
+type Breaker struct {
+	policy Policy
+
+	mutex    sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	stats    Stats
+}
+
+func New(policy Policy) *Breaker {
+	return &Breaker{policy: policy, state: Closed}
+}
+
+// Do makes call with a context that is done once the attempt's deadline has
+// passed, retrying it with backoff if it fails and idempotent is true. It
+// returns an *OpenError without making the call while the breaker is open,
+// and ctx's error without counting a failure or retrying once ctx is done.
+func (b *Breaker) Do(ctx context.Context, idempotent bool, call func(context.Context) (interface{}, error)) (interface{}, error) {
+	attempts := 1
+	if idempotent {
+		attempts += b.policy.Retries
+	}
+	b.count(func(s *Stats) { s.Calls++ })
+	backoff := b.policy.Backoff
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, backoff); err != nil {
+				return nil, err
+			}
+			backoff *= 2
+			b.count(func(s *Stats) { s.Retries++ })
+		}
+		if err := b.allow(); err != nil {
+			return nil, err
+		}
+		var result interface{}
+		result, err = b.attempt(ctx, call)
+		if ctx.Err() != nil {
+			b.release()
+			return nil, ctx.Err()
+		}
+		b.record(err)
+		if err == nil {
+			return result, nil
+		}
+	}
+	return nil, err
+}
+
+// State returns the state of the breaker, which is reported as open until a
+// trial call is let through after the cooldown.
+func (b *Breaker) State() State {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+func (b *Breaker) Stats() Stats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stats := b.stats
+	stats.State = b.state
+	return stats
+}
+
+// attempt makes call with a context that is done once the deadline has
+// passed.
+func (b *Breaker) attempt(ctx context.Context, call func(context.Context) (interface{}, error)) (interface{}, error) {
+	if b.policy.Timeout <= 0 {
+		return call(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, b.policy.Timeout)
+	defer cancel()
+	result, err := call(attemptCtx)
+	if err != nil && attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		b.count(func(s *Stats) { s.Timeouts++ })
+		return nil, ErrTimeout
+	}
+	return result, err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// allow returns an *OpenError if the breaker is open, or if it is half open
+// and already making its trial call.
+func (b *Breaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case Open:
+		if elapsed := time.Since(b.openedAt); elapsed < b.policy.Cooldown {
+			b.stats.Rejected++
+			return &OpenError{RetryAfter: b.policy.Cooldown - elapsed}
+		}
+		b.state = HalfOpen
+	case HalfOpen:
+		b.stats.Rejected++
+		return &OpenError{RetryAfter: b.policy.Cooldown}
+	}
+	return nil
+}
+
+// release lets another trial call through if an abandoned call was the trial,
+// since abandoning it says nothing about the dependency.
+func (b *Breaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == HalfOpen {
+		b.state = Open
+		b.openedAt = time.Now().Add(-b.policy.Cooldown)
+	}
+}
+
+func (b *Breaker) record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.state = Closed
+		return
+	}
+	b.failures++
+	b.stats.Failures++
+	if b.state == HalfOpen || b.failures >= b.policy.Threshold {
+		if b.state != Open {
+			b.stats.Opened++
+		}
+		b.state = Open
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *Breaker) count(update func(*Stats)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	update(&b.stats)
+}
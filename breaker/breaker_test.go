@@ -0,0 +1,144 @@
+package breaker_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/craigfurman/bovine/breaker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Breaker", func() {
+
+	var (
+		b      *breaker.Breaker
+		ctx    = context.Background()
+		calls  int
+		failed = errors.New("redis went away")
+	)
+
+	BeforeEach(func() {
+		calls = 0
+		b = breaker.New(breaker.Policy{
+			Timeout:   50 * time.Millisecond,
+			Retries:   2,
+			Backoff:   time.Millisecond,
+			Threshold: 3,
+			Cooldown:  100 * time.Millisecond,
+		})
+	})
+
+	succeed := func(context.Context) (interface{}, error) {
+		calls++
+		return "ok", nil
+	}
+
+	fail := func(context.Context) (interface{}, error) {
+		calls++
+		return nil, failed
+	}
+
+	It("returns the result of a call that succeeds", func() {
+		result, err := b.Do(ctx, false, succeed)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal("ok"))
+		Expect(b.State()).To(Equal(breaker.Closed))
+	})
+
+	It("retries an idempotent call until it succeeds", func() {
+		result, err := b.Do(ctx, true, func(context.Context) (interface{}, error) {
+			if calls++; calls < 3 {
+				return nil, failed
+			}
+			return "ok", nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal("ok"))
+		Expect(b.Stats().Retries).To(Equal(uint64(2)))
+	})
+
+	It("gives up on an idempotent call after the retries", func() {
+		_, err := b.Do(ctx, true, fail)
+		Expect(err).To(MatchError(failed))
+		Expect(calls).To(Equal(3))
+	})
+
+	It("does not retry other calls", func() {
+		_, err := b.Do(ctx, false, fail)
+		Expect(err).To(MatchError(failed))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("times out a call that misses its deadline", func() {
+		_, err := b.Do(ctx, false, func(attemptCtx context.Context) (interface{}, error) {
+			<-attemptCtx.Done()
+			return nil, attemptCtx.Err()
+		})
+		Expect(err).To(Equal(breaker.ErrTimeout))
+		Expect(b.Stats().Timeouts).To(Equal(uint64(1)))
+	})
+
+	Context("when the caller's context is done", func() {
+
+		It("returns its error without retrying or counting a failure", func() {
+			cancelled, cancel := context.WithCancel(ctx)
+			_, err := b.Do(cancelled, true, func(context.Context) (interface{}, error) {
+				calls++
+				cancel()
+				return nil, context.Canceled
+			})
+			Expect(err).To(Equal(context.Canceled))
+			Expect(calls).To(Equal(1))
+			Expect(b.Stats().Failures).To(BeZero())
+		})
+	})
+
+	Context("after consecutive failures reach the threshold", func() {
+
+		BeforeEach(func() {
+			b.Do(ctx, true, fail)
+			calls = 0
+		})
+
+		It("rejects calls without making them", func() {
+			Expect(b.State()).To(Equal(breaker.Open))
+			_, err := b.Do(ctx, false, succeed)
+			Expect(err).To(BeAssignableToTypeOf(&breaker.OpenError{}))
+			Expect(err.(*breaker.OpenError).RetryAfter).To(BeNumerically(">", 0))
+			Expect(err.(*breaker.OpenError).RetryAfter).To(BeNumerically("<=", 100*time.Millisecond))
+			Expect(calls).To(BeZero())
+
+			stats := b.Stats()
+			Expect(stats.State).To(Equal(breaker.Open))
+			Expect(stats.Opened).To(Equal(uint64(1)))
+			Expect(stats.Rejected).To(Equal(uint64(1)))
+		})
+
+		It("closes again once a trial call after the cooldown succeeds", func() {
+			time.Sleep(100 * time.Millisecond)
+			_, err := b.Do(ctx, false, succeed)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b.State()).To(Equal(breaker.Closed))
+		})
+
+		It("opens again if the trial call fails", func() {
+			time.Sleep(100 * time.Millisecond)
+			_, err := b.Do(ctx, false, fail)
+			Expect(err).To(MatchError(failed))
+			Expect(b.State()).To(Equal(breaker.Open))
+			_, err = b.Do(ctx, false, succeed)
+			Expect(err).To(BeAssignableToTypeOf(&breaker.OpenError{}))
+		})
+	})
+
+	It("stays closed while failures are interrupted by successes", func() {
+		b.Do(ctx, false, fail)
+		b.Do(ctx, false, fail)
+		b.Do(ctx, false, succeed)
+		b.Do(ctx, false, fail)
+		Expect(b.State()).To(Equal(breaker.Closed))
+	})
+})
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/discovery"
+	"github.com/craigfurman/bovine/gatherer"
+	"github.com/craigfurman/bovine/indexer"
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/leader"
+	"github.com/craigfurman/bovine/spool"
+	"github.com/craigfurman/bovine/suppress"
+	"github.com/craigfurman/bovine/web"
+
+	"github.com/codegangsta/negroni"
+	"github.com/nats-io/nats.go"
+)
+
+// shutdownTimeout is how long a stopping process waits for API requests in
+// flight to finish.
+const shutdownTimeout = 5 * time.Second
+
+type repositoryFlags struct {
+	redisURL     string
+	keywordsFile string
+	breaker      breaker.Policy
+}
+
+func (f *repositoryFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.redisURL, "redis", env("REDIS_URL", "localhost:6379"), "redis address (REDIS_URL)")
+	flags.StringVar(&f.keywordsFile, "keywords-file", os.Getenv("KEYWORDS_FILE"), "keyword definition file (KEYWORDS_FILE)")
+	f.breaker = breaker.DefaultPolicy
+	flags.DurationVar(&f.breaker.Timeout, "redis-timeout", envDuration("REDIS_TIMEOUT", breaker.DefaultPolicy.Timeout), "deadline for each redis call (REDIS_TIMEOUT)")
+	flags.IntVar(&f.breaker.Retries, "redis-retries", envInt("REDIS_RETRIES", breaker.DefaultPolicy.Retries), "times to retry failed redis reads (REDIS_RETRIES)")
+	flags.IntVar(&f.breaker.Threshold, "breaker-threshold", envInt("BREAKER_THRESHOLD", breaker.DefaultPolicy.Threshold), "consecutive failed redis calls that open the circuit breaker (BREAKER_THRESHOLD)")
+	flags.DurationVar(&f.breaker.Cooldown, "breaker-cooldown", envDuration("BREAKER_COOLDOWN", breaker.DefaultPolicy.Cooldown), "how long the circuit breaker stays open before trying redis again (BREAKER_COOLDOWN)")
+}
+
+func (f *repositoryFlags) repository() *indexer.WordCountRepository {
+	return indexer.New(f.redisURL, clock{})
+}
+
+// guarded wraps repo in the circuit breaker for long running processes,
+// publishing its state at /debug/vars.
+func (f *repositoryFlags) guarded(repo *indexer.WordCountRepository) *indexer.Guarded {
+	guarded := indexer.NewGuarded(repo, f.breaker)
+	expvar.Publish("redis", expvar.Func(func() interface{} {
+		return guarded.BreakerStats()
+	}))
+	return guarded
+}
+
+// keywords loads the keyword definitions, along with any promoted from
+// discovered phrases.
+func (f *repositoryFlags) keywords(repo *indexer.WordCountRepository) (*keywords.Set, error) {
+	definitions, err := keywords.Load(f.keywordsFile)
+	if err != nil {
+		return nil, err
+	}
+	promoted, err := repo.Promoted(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return definitions.With(promoted), nil
+}
+
+type serveFlags struct {
+	port         string
+	ingestAPIKey string
+	cacheTTL     time.Duration
+}
+
+func (f *serveFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.port, "port", env("PORT", "3000"), "port to serve the API on (PORT)")
+	flags.StringVar(&f.ingestAPIKey, "ingest-api-key", os.Getenv("INGEST_API_KEY"), "API key for pushing posts to POST /ingest and promoting discovered phrases, both disabled without one (INGEST_API_KEY)")
+	flags.DurationVar(&f.cacheTTL, "cache-ttl", envDuration("CACHE_TTL", 5*time.Second), "how long to cache /wordcount responses for, 0 to disable caching (CACHE_TTL)")
+}
+
+type gatherFlags struct {
+	source            string
+	twitterAPI        string
+	bearerToken       string
+	consumerKey       string
+	consumerSecret    string
+	accessToken       string
+	accessTokenSecret string
+	sampleIDsOnly     bool
+	maxLateness       time.Duration
+	discovery         bool
+	discoveryFile     string
+	leaderTimeout     time.Duration
+	mastodonURL       string
+	mastodonToken     string
+	mastodonTimeline  string
+	jetstreamURL      string
+	natsURL           string
+	natsStream        string
+	natsConsumer      string
+	natsSubject       string
+	spoolFile         string
+	spoolFsync        string
+	denyListFile      string
+	deny              []string
+	duplicateWindow   time.Duration
+	authorLimit       int
+	authorWindow      time.Duration
+}
+
+func (f *gatherFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.source, "source", env("SOURCE", "twitter"), "network to gather posts from: twitter, mastodon, bluesky or nats (SOURCE)")
+	flags.StringVar(&f.twitterAPI, "twitter-api", env("TWITTER_API", "v1.1"), "Twitter streaming API version, v1.1 or v2 (TWITTER_API)")
+	flags.StringVar(&f.bearerToken, "twitter-bearer-token", os.Getenv("TWITTER_BEARER_TOKEN"), "app bearer token for the v2 API (TWITTER_BEARER_TOKEN)")
+	flags.StringVar(&f.consumerKey, "twitter-consumer-key", os.Getenv("TWITTER_CONSUMER_KEY"), "(TWITTER_CONSUMER_KEY)")
+	flags.StringVar(&f.consumerSecret, "twitter-consumer-secret", os.Getenv("TWITTER_CONSUMER_SECRET"), "(TWITTER_CONSUMER_SECRET)")
+	flags.StringVar(&f.accessToken, "twitter-access-token", os.Getenv("TWITTER_ACCESS_TOKEN"), "(TWITTER_ACCESS_TOKEN)")
+	flags.StringVar(&f.accessTokenSecret, "twitter-access-token-secret", os.Getenv("TWITTER_ACCESS_TOKEN_SECRET"), "(TWITTER_ACCESS_TOKEN_SECRET)")
+	flags.BoolVar(&f.sampleIDsOnly, "sample-ids-only", os.Getenv("SAMPLE_IDS_ONLY") == "true", "store only tweet IDs in keyword samples (SAMPLE_IDS_ONLY)")
+	flags.DurationVar(&f.maxLateness, "max-lateness", envDuration("MAX_LATENESS", 0), "reject tweets arriving later than this after being tweeted, 0 to accept all (MAX_LATENESS)")
+	flags.BoolVar(&f.discovery, "discovery", os.Getenv("DISCOVERY") == "true", "look for emerging phrases in the sample stream (DISCOVERY)")
+	flags.StringVar(&f.discoveryFile, "discovery-file", os.Getenv("DISCOVERY_FILE"), "look for emerging phrases in this file instead of the sample stream (DISCOVERY_FILE)")
+	flags.DurationVar(&f.leaderTimeout, "leader-timeout", envDuration("LEADER_TIMEOUT", 15*time.Second), "how long a standby gatherer waits for the leader to renew its lease before taking over (LEADER_TIMEOUT)")
+	flags.StringVar(&f.mastodonURL, "mastodon-url", os.Getenv("MASTODON_URL"), "base URL of the Mastodon instance, e.g. https://mastodon.social (MASTODON_URL)")
+	flags.StringVar(&f.mastodonToken, "mastodon-access-token", os.Getenv("MASTODON_ACCESS_TOKEN"), "access token, if the instance requires one to stream (MASTODON_ACCESS_TOKEN)")
+	flags.StringVar(&f.mastodonTimeline, "mastodon-timeline", env("MASTODON_TIMELINE", "public"), "timeline to stream: public, public:local or hashtag:TAG (MASTODON_TIMELINE)")
+	flags.StringVar(&f.jetstreamURL, "jetstream-url", env("JETSTREAM_URL", gatherer.JetstreamURL), "Bluesky Jetstream subscribe endpoint (JETSTREAM_URL)")
+	flags.StringVar(&f.natsURL, "nats-url", env("NATS_URL", nats.DefaultURL), "NATS server to consume posts from (NATS_URL)")
+	flags.StringVar(&f.natsStream, "nats-stream", os.Getenv("NATS_STREAM"), "JetStream stream the posts are published to (NATS_STREAM)")
+	flags.StringVar(&f.natsConsumer, "nats-consumer", env("NATS_CONSUMER", "bovine"), "name of the durable consumer tracking which posts were counted (NATS_CONSUMER)")
+	flags.StringVar(&f.natsSubject, "nats-subject", os.Getenv("NATS_SUBJECT"), "consume only posts published to this subject, which may contain wildcards (NATS_SUBJECT)")
+	flags.StringVar(&f.spoolFile, "spool-file", os.Getenv("SPOOL_FILE"), "file to spool counts to while redis is unavailable, disabled if empty (SPOOL_FILE)")
+	flags.StringVar(&f.spoolFsync, "spool-fsync", env("SPOOL_FSYNC", string(spool.FsyncInterval)), "when to fsync the spool: always, interval or never (SPOOL_FSYNC)")
+	flags.StringVar(&f.denyListFile, "deny-list-file", os.Getenv("DENY_LIST_FILE"), "file of SOURCE:AUTHOR_ID patterns, one per line, whose posts are not counted (DENY_LIST_FILE)")
+	flags.DurationVar(&f.duplicateWindow, "duplicate-window", envDuration("DUPLICATE_WINDOW", 0), "do not count posts nearly the same as one seen this recently, 0 to count all (DUPLICATE_WINDOW)")
+	flags.IntVar(&f.authorLimit, "author-limit", envInt("AUTHOR_LIMIT", 0), "most hits of each keyword counted from one author per author window, 0 for no limit (AUTHOR_LIMIT)")
+	flags.DurationVar(&f.authorWindow, "author-window", envDuration("AUTHOR_WINDOW", time.Hour), "window for --author-limit (AUTHOR_WINDOW)")
+}
+
+// streamer streams posts matching the tracked keywords.
+type streamer interface {
+	Stream(ctx context.Context, keywords *keywords.Set)
+}
+
+// streamer creates the client for the configured source, indexing posts with
+// index and keeping cursors and seen posts in repo. It loads the deny list
+// first, so that it applies to every client created from f.
+func (f *gatherFlags) streamer(repo *indexer.Guarded, index gatherer.Indexer) (streamer, error) {
+	if f.denyListFile != "" {
+		deny, err := suppress.LoadDenyList(f.denyListFile)
+		if err != nil {
+			return nil, err
+		}
+		f.deny = deny
+	}
+	switch {
+	case f.source == "mastodon":
+		return gatherer.NewMastodon(index, f.mastodonURL, f.mastodonToken, f.mastodonTimeline, f.options()), nil
+	case f.source == "bluesky":
+		return gatherer.NewBluesky(index, repo, f.jetstreamURL, f.options()), nil
+	case f.source == "nats":
+		return gatherer.NewNATS(index, repo, f.natsURL, f.natsStream, f.natsConsumer, f.natsSubject, f.options()), nil
+	case f.source != "twitter":
+		return nil, fmt.Errorf("unknown source %s", f.source)
+	case f.twitterAPI == "v1.1":
+		return f.gatherer(index), nil
+	case f.twitterAPI == "v2":
+		return gatherer.NewV2(index, f.bearerToken, "https://api.twitter.com", f.options()), nil
+	}
+	return nil, fmt.Errorf("unknown Twitter API version %s", f.twitterAPI)
+}
+
+// gatherer returns a v1.1 client, which is also used for discovery from the
+// sample stream.
+func (f *gatherFlags) gatherer(index gatherer.Indexer) *gatherer.TwitterClient {
+	return gatherer.New(index, f.consumerKey, f.consumerSecret, f.accessToken, f.accessTokenSecret, "https://stream.twitter.com", f.options())
+}
+
+// spool opens the spool file, if one is configured, wrapping repo so that
+// counts are spooled while redis is unavailable. It returns nil otherwise.
+func (f *gatherFlags) spool(repo *indexer.Guarded) (*gatherer.SpoolingIndexer, *spool.Spool, error) {
+	if f.spoolFile == "" {
+		return nil, nil, nil
+	}
+	policy, err := spool.ParsePolicy(f.spoolFsync)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := spool.Open(f.spoolFile, policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gatherer.NewSpoolingIndexer(repo, s), s, nil
+}
+
+func (f *gatherFlags) options() gatherer.Options {
+	return gatherer.Options{
+		Source:        f.source,
+		SampleIDsOnly: f.sampleIDsOnly,
+		MaxLateness:   f.maxLateness,
+		Suppression: suppress.Config{
+			Deny:            f.deny,
+			DuplicateWindow: f.duplicateWindow,
+			AuthorLimit:     f.authorLimit,
+			AuthorWindow:    f.authorWindow,
+		},
+	}
+}
+
+// discover runs discovery mode if enabled, reading either the Twitter sample
+// stream or a file of tweets.
+func (f *gatherFlags) discover(ctx context.Context, g *gatherer.TwitterClient) {
+	if !f.discovery {
+		return
+	}
+	detector := discovery.NewDetector(time.Hour)
+	if f.discoveryFile != "" {
+		tweets, err := gatherer.OpenArchive(f.discoveryFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer tweets.Close()
+		g.DiscoverFrom(ctx, tweets, detector)
+		return
+	}
+	g.Discover(ctx, detector)
+}
+
+// all gathers posts and serves the API in one process, stopping the API once
+// the gatherer stops.
+func all(args []string) error {
+	var (
+		repoFlags   repositoryFlags
+		serveFlags  serveFlags
+		gatherFlags gatherFlags
+	)
+	flags := newFlagSet("all")
+	repoFlags.register(flags)
+	serveFlags.register(flags)
+	gatherFlags.register(flags)
+	flags.Parse(args)
+
+	repo := repoFlags.repository()
+	defer repo.Close()
+	definitions, err := repoFlags.keywords(repo)
+	if err != nil {
+		return err
+	}
+	guarded := repoFlags.guarded(repo)
+	spooled, s, err := gatherFlags.spool(guarded)
+	if err != nil {
+		return err
+	}
+	shutdown := listen(serveFlags.port, api(guarded, definitions, &serveFlags))
+	defer shutdown()
+	return runGatherer(guarded, spooled, s, definitions, &repoFlags, &gatherFlags)
+}
+
+func serve(args []string) error {
+	var (
+		repoFlags  repositoryFlags
+		serveFlags serveFlags
+	)
+	flags := newFlagSet("serve")
+	repoFlags.register(flags)
+	serveFlags.register(flags)
+	flags.Parse(args)
+
+	repo := repoFlags.repository()
+	defer repo.Close()
+	definitions, err := repoFlags.keywords(repo)
+	if err != nil {
+		return err
+	}
+	server := negroni.Classic()
+	server.UseHandler(api(repoFlags.guarded(repo), definitions, &serveFlags))
+	server.Run(fmt.Sprintf(":%s", serveFlags.port))
+	return nil
+}
+
+// api serves the keywords tracked at startup; the API looks up keywords
+// promoted since itself on every request. Posts pushed to /ingest are matched
+// against the keywords tracked at startup.
+func api(repo *indexer.Guarded, definitions *keywords.Set, serveFlags *serveFlags) http.Handler {
+	handler := web.New(repo, definitions.Names(), clock{}, serveFlags.cacheTTL, serveFlags.ingestAPIKey)
+	if serveFlags.ingestAPIKey != "" {
+		web.AddIngest(handler, gatherer.NewIngester(repo, repo, definitions, gatherer.Options{}), serveFlags.ingestAPIKey)
+	}
+	return handler
+}
+
+// listen serves handler on port in the background, returning a function that
+// stops the server, waiting up to shutdownTimeout for requests in flight.
+func listen(port string, handler http.Handler) (shutdown func()) {
+	n := negroni.Classic()
+	n.UseHandler(handler)
+	server := &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: n}
+	log.Printf("listening on %s\n", server.Addr)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// gather runs the gatherer only, serving health checks that report it ready
+// while the leading gatherer's stream from its source is connected.
+func gather(args []string) error {
+	var (
+		repoFlags   repositoryFlags
+		serveFlags  serveFlags
+		gatherFlags gatherFlags
+	)
+	flags := newFlagSet("gather")
+	repoFlags.register(flags)
+	serveFlags.register(flags)
+	gatherFlags.register(flags)
+	flags.Parse(args)
+
+	repo := repoFlags.repository()
+	defer repo.Close()
+	definitions, err := repoFlags.keywords(repo)
+	if err != nil {
+		return err
+	}
+	guarded := repoFlags.guarded(repo)
+	spooled, s, err := gatherFlags.spool(guarded)
+	if err != nil {
+		return err
+	}
+	var depth web.Spool
+	if spooled != nil {
+		depth = spooled
+	}
+	shutdown := listen(serveFlags.port, web.NewHealth(guarded, gatherFlags.source, depth))
+	defer shutdown()
+	return runGatherer(guarded, spooled, s, definitions, &repoFlags, &gatherFlags)
+}
+
+// runGatherer waits to be elected leader of the gatherers for its source, so
+// that only one process streams from each network, then gathers posts until
+// the stream ends. If leadership is lost while streaming, the process exits
+// rather than count tweets twice. On SIGINT or SIGTERM it stops reading posts,
+// waits for the writes in flight to finish, then releases the lease so a
+// standby can take over at once.
+// If spooled is not nil, counts are spooled to s while redis is unavailable
+// and replayed in the background. While leading, it also expires the rolling
+// counts of the keywords it tracks.
+func runGatherer(repo *indexer.Guarded, spooled *gatherer.SpoolingIndexer, s *spool.Spool, definitions *keywords.Set, repoFlags *repositoryFlags, gatherFlags *gatherFlags) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	var index gatherer.Indexer = repo
+	closeSpool := func() {}
+	if spooled != nil {
+		index = spooled
+		closeSpool = func() {
+			if err := s.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+		go spooled.ReplayPeriodically(ctx)
+	}
+	defer closeSpool()
+	defer cancel()
+	posts, err := gatherFlags.streamer(repo, index)
+	if err != nil {
+		return err
+	}
+	lock := leader.New(repoFlags.redisURL, "gatherer:leader:"+gatherFlags.source, gatherFlags.leaderTimeout)
+	defer lock.Close()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	log.Printf("waiting to lead the %s gatherers\n", gatherFlags.source)
+	if !lock.Acquire(ctx) {
+		return nil
+	}
+	log.Printf("leading the %s gatherers with fencing token %d\n", gatherFlags.source, lock.Token())
+	repo.Fence(lock.TokenKey(), lock.Token())
+	go func() {
+		<-lock.Lost()
+		closeSpool()
+		log.Fatalf("lost leadership of the %s gatherers\n", gatherFlags.source)
+	}()
+
+	go gatherer.NewRollingExpirer(repo, definitions).ExpirePeriodically(ctx)
+	if gatherFlags.source == "twitter" {
+		go gatherFlags.discover(ctx, gatherFlags.gatherer(index))
+	}
+	posts.Stream(ctx, definitions)
+	return lock.Release()
+}
+
+func count(args []string) error {
+	var repoFlags repositoryFlags
+	flags := newFlagSet("count")
+	repoFlags.register(flags)
+	since := flags.Duration("since", 24*time.Hour, "count tweets from this long ago")
+	positional := parseArgs(flags, args)
+	if len(positional) != 1 {
+		return errors.New("expected exactly one KEYWORD")
+	}
+
+	repo := repoFlags.repository()
+	defer repo.Close()
+	n, err := repo.Count(context.Background(), positional[0], time.Now().Add(-*since))
+	if err != nil {
+		return err
+	}
+	fmt.Println(n)
+	return nil
+}
+
+func cleanup(args []string) error {
+	var repoFlags repositoryFlags
+	flags := newFlagSet("cleanup")
+	repoFlags.register(flags)
+	before := flags.Duration("before", 7*24*time.Hour, "delete counts from longer ago than this")
+	flags.Parse(args)
+
+	repo := repoFlags.repository()
+	defer repo.Close()
+	definitions, err := repoFlags.keywords(repo)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-*before)
+	for _, keyword := range definitions.Names() {
+		if err := repo.Cleanup(context.Background(), keyword, cutoff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfill indexes the keyword hits in archives of tweets, each of which is
+// newline delimited JSON, optionally gzipped.
+func backfill(args []string) error {
+	var repoFlags repositoryFlags
+	flags := newFlagSet("backfill")
+	repoFlags.register(flags)
+	archives := parseArgs(flags, args)
+	if len(archives) == 0 {
+		return errors.New("expected at least one ARCHIVE")
+	}
+
+	repo := repoFlags.repository()
+	defer repo.Close()
+	definitions, err := repoFlags.keywords(repo)
+	if err != nil {
+		return err
+	}
+	for _, path := range archives {
+		archive, err := gatherer.OpenArchive(path)
+		if err != nil {
+			return err
+		}
+		hits, err := gatherer.Backfill(context.Background(), archive, "file:"+filepath.Base(path), definitions, repo)
+		archive.Close()
+		if err != nil {
+			return err
+		}
+		log.Printf("indexed %d keyword hits from %s\n", hits, path)
+	}
+	return nil
+}
+
+// export writes the number of times each keyword was tweeted in each bucket
+// as CSV rows of keyword, bucket start time and count.
+func export(args []string) error {
+	var repoFlags repositoryFlags
+	flags := newFlagSet("export")
+	repoFlags.register(flags)
+	since := flags.Duration("since", 24*time.Hour, "export counts from this long ago")
+	bucket := flags.Duration("bucket", time.Hour, "width of each time bucket")
+	flags.Parse(args)
+	if *bucket <= 0 {
+		return errors.New("bucket must be positive")
+	}
+
+	repo := repoFlags.repository()
+	defer repo.Close()
+	definitions, err := repoFlags.keywords(repo)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	start := now.Add(-*since).Truncate(*bucket)
+	out := csv.NewWriter(os.Stdout)
+	out.Write([]string{"keyword", "bucket", "count"})
+	for _, keyword := range definitions.Names() {
+		for t := start; t.Before(now); t = t.Add(*bucket) {
+			n, err := repo.CountBetween(context.Background(), keyword, t, t.Add(*bucket))
+			if err != nil {
+				return err
+			}
+			out.Write([]string{keyword, t.UTC().Format(time.RFC3339), strconv.FormatUint(uint64(n), 10)})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
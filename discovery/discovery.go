@@ -0,0 +1,162 @@
+package discovery
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/tokenize"
+	"github.com/craigfurman/bovine/topk"
+)
+
+const (
+	MinPhraseWords = 2
+	MaxPhraseWords = 5
+
+	sketchCapacity = 10000
+	maxCandidates  = 20
+
+	// minCount and minGrowth decide whether a phrase is rising sharply: it
+	// must occur at least minCount times in a window, and minGrowth times as
+	// often as in the window before.
+	minCount  = 5
+	minGrowth = 2.0
+)
+
+// Candidate is a phrase whose frequency rose sharply between two windows.
+type Candidate struct {
+	Phrase        string  `json:"phrase"`
+	Count         uint    `json:"count"`
+	PreviousCount uint    `json:"previousCount"`
+	Growth        float64 `json:"growth"`
+}
+
+// Detector counts the n-grams of tweets in fixed windows of tweet time, and
+// compares each window with the one before it to find emerging phrases.
+type Detector struct {
+	window      time.Duration
+	windowStart time.Time
+	current     *topk.SpaceSaving
+	previous    *topk.SpaceSaving
+	candidates  []Candidate
+	mutex       sync.RWMutex
+}
+
+func NewDetector(window time.Duration) *Detector {
+	return &Detector{
+		window:   window,
+		current:  topk.NewSpaceSaving(sketchCapacity),
+		previous: topk.NewSpaceSaving(sketchCapacity),
+	}
+}
+
+// Add counts the phrases in a tweet created at the specified time. It returns
+// true if the tweet started a new window, in which case the candidates from
+// the window that just ended are available from Candidates.
+func (d *Detector) Add(text string, at time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	rotated := false
+	windowStart := at.Truncate(d.window)
+	if d.windowStart.IsZero() {
+		d.windowStart = windowStart
+	}
+	if windowStart.After(d.windowStart) {
+		d.rotate()
+		if windowStart.Sub(d.windowStart) > d.window {
+			d.previous = topk.NewSpaceSaving(sketchCapacity)
+		}
+		d.windowStart = windowStart
+		rotated = true
+	}
+	for _, phrase := range Phrases(text) {
+		d.current.Add(phrase)
+	}
+	return rotated
+}
+
+// Rotate ends the current window early, e.g. at the end of a file.
+func (d *Detector) Rotate() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.rotate()
+}
+
+// Candidates returns the phrases that rose most sharply in the last complete
+// window, fastest growing first.
+func (d *Detector) Candidates() []Candidate {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.candidates
+}
+
+func (d *Detector) rotate() {
+	candidates := []Candidate{}
+	for _, item := range d.current.Top(sketchCapacity) {
+		if item.Count < minCount {
+			break
+		}
+		previous := d.previous.Estimate(item.Term)
+		growth := float64(item.Count) / float64(atLeastOne(previous))
+		if growth >= minGrowth {
+			candidates = append(candidates, Candidate{
+				Phrase:        item.Term,
+				Count:         item.Count,
+				PreviousCount: previous,
+				Growth:        growth,
+			})
+		}
+	}
+	sort.Sort(byGrowth(candidates))
+	if len(candidates) > maxCandidates {
+		candidates = candidates[:maxCandidates]
+	}
+	d.candidates = candidates
+	d.previous = d.current
+	d.current = topk.NewSpaceSaving(sketchCapacity)
+}
+
+// Phrases returns every run of MinPhraseWords to MaxPhraseWords consecutive
+// words in text that is not made up entirely of stop words.
+func Phrases(text string) []string {
+	words := tokenize.Words(text)
+	var phrases []string
+	for n := MinPhraseWords; n <= MaxPhraseWords; n++ {
+		for i := 0; i+n <= len(words); i++ {
+			if allStopWords(words[i : i+n]) {
+				continue
+			}
+			phrases = append(phrases, strings.Join(words[i:i+n], " "))
+		}
+	}
+	return phrases
+}
+
+func allStopWords(words []string) bool {
+	for _, word := range words {
+		if !tokenize.IsStopWord(word) {
+			return false
+		}
+	}
+	return true
+}
+
+func atLeastOne(n uint) uint {
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+type byGrowth []Candidate
+
+func (c byGrowth) Len() int      { return len(c) }
+func (c byGrowth) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+func (c byGrowth) Less(i, j int) bool {
+	if c[i].Growth != c[j].Growth {
+		return c[i].Growth > c[j].Growth
+	}
+	return c[i].Phrase < c[j].Phrase
+}
@@ -0,0 +1,82 @@
+package discovery_test
+
+import (
+	"time"
+
+	"github.com/craigfurman/bovine/discovery"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Discovery", func() {
+
+	Describe("Phrases", func() {
+
+		It("returns runs of 2 to 5 words", func() {
+			Expect(discovery.Phrases("low hanging fruit salad")).To(Equal([]string{
+				"low hanging", "hanging fruit", "fruit salad",
+				"low hanging fruit", "hanging fruit salad",
+				"low hanging fruit salad",
+			}))
+		})
+
+		It("skips phrases made up only of stop words", func() {
+			Expect(discovery.Phrases("at the end")).To(Equal([]string{"the end", "at the end"}))
+		})
+	})
+
+	Describe("Detector", func() {
+
+		var (
+			detector *discovery.Detector
+			start    time.Time
+		)
+
+		BeforeEach(func() {
+			detector = discovery.NewDetector(time.Hour)
+			start = time.Date(2015, 3, 3, 21, 0, 0, 0, time.UTC)
+		})
+
+		addTimes := func(text string, times int, at time.Time) {
+			for i := 0; i < times; i++ {
+				detector.Add(text, at)
+			}
+		}
+
+		It("reports phrases that rose sharply since the previous window", func() {
+			addTimes("synergy going forward", 5, start)
+			addTimes("low hanging fruit", 2, start)
+
+			addTimes("synergy going forward", 5, start.Add(time.Hour))
+			addTimes("low hanging fruit", 8, start.Add(time.Hour))
+
+			Expect(detector.Add("anything else", start.Add(time.Hour*2))).To(BeTrue())
+			Expect(detector.Candidates()).To(ConsistOf(
+				discovery.Candidate{Phrase: "low hanging", Count: 8, PreviousCount: 2, Growth: 4},
+				discovery.Candidate{Phrase: "hanging fruit", Count: 8, PreviousCount: 2, Growth: 4},
+				discovery.Candidate{Phrase: "low hanging fruit", Count: 8, PreviousCount: 2, Growth: 4},
+			))
+		})
+
+		It("ignores phrases that occur too rarely", func() {
+			addTimes("low hanging fruit", 4, start)
+			detector.Rotate()
+			Expect(detector.Candidates()).To(BeEmpty())
+		})
+
+		It("does not start a new window within the current one", func() {
+			Expect(detector.Add("low hanging fruit", start)).To(BeFalse())
+			Expect(detector.Add("low hanging fruit", start.Add(time.Minute*59))).To(BeFalse())
+		})
+
+		It("compares with an empty window after a gap", func() {
+			addTimes("low hanging fruit", 5, start)
+			addTimes("low hanging fruit", 5, start.Add(time.Hour*3))
+			detector.Rotate()
+			Expect(detector.Candidates()).To(ContainElement(
+				discovery.Candidate{Phrase: "low hanging fruit", Count: 5, PreviousCount: 0, Growth: 5},
+			))
+		})
+	})
+})
@@ -0,0 +1,81 @@
+package gatherer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/craigfurman/bovine/keywords"
+)
+
+type BackfillIndexer interface {
+	IndexWordsAt(ctx context.Context, source string, words []string, t time.Time) error
+}
+
+// Backfill indexes the keyword hits in an archive of newline delimited
+// tweets, counting each at the time it was tweeted. Tweets without text or a
+// creation time are skipped. Hits are labelled with source, such as
+// "file:tweets.json". It returns the number of hits indexed.
+func Backfill(ctx context.Context, archive io.Reader, source string, keywords *keywords.Set, index BackfillIndexer) (uint, error) {
+	var hits uint
+	streamer := bufio.NewScanner(archive)
+	for streamer.Scan() {
+		var parsedTweet struct {
+			Text      string `json:"text"`
+			CreatedAt string `json:"created_at"`
+		}
+		if err := json.Unmarshal(streamer.Bytes(), &parsedTweet); err != nil || parsedTweet.Text == "" {
+			continue
+		}
+		createdAt, err := parseCreatedAt(parsedTweet.CreatedAt)
+		if err != nil {
+			continue
+		}
+		found := keywords.Match(parsedTweet.Text)
+		if len(found) == 0 {
+			continue
+		}
+		if err := index.IndexWordsAt(ctx, source, found, createdAt); err != nil {
+			return hits, err
+		}
+		hits += uint(len(found))
+	}
+	return hits, streamer.Err()
+}
+
+// OpenArchive opens a file of newline delimited tweets, decompressing it if
+// it is gzipped.
+func OpenArchive(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(f)
+	magic, err := buffered.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return archive{Reader: buffered, file: f}, nil
+	}
+	decompressed, err := gzip.NewReader(buffered)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return archive{Reader: decompressed, file: f}, nil
+}
+
+type archive struct {
+	io.Reader
+	file *os.File
+}
+
+func (a archive) Close() error {
+	return a.file.Close()
+}
+
+func parseCreatedAt(createdAt string) (time.Time, error) {
+	return time.Parse(time.RubyDate, createdAt)
+}
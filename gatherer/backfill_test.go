@@ -0,0 +1,118 @@
+package gatherer_test
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/craigfurman/bovine/gatherer"
+	"github.com/craigfurman/bovine/keywords"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeBackfillIndexer struct {
+	indexed  map[string][]time.Time
+	sources  map[string]bool
+	indexErr error
+}
+
+func (i *fakeBackfillIndexer) IndexWordsAt(_ context.Context, source string, words []string, t time.Time) error {
+	i.sources[source] = true
+	for _, word := range words {
+		i.indexed[word] = append(i.indexed[word], t)
+	}
+	return i.indexErr
+}
+
+var _ = Describe("backfilling from an archive", func() {
+
+	var (
+		index         *fakeBackfillIndexer
+		pythonAndRuby *keywords.Set
+	)
+
+	BeforeEach(func() {
+		index = &fakeBackfillIndexer{indexed: make(map[string][]time.Time), sources: make(map[string]bool)}
+		var err error
+		pythonAndRuby, err = keywords.New(map[string]keywords.Definition{
+			"python": {Phrases: []string{"python"}},
+			"ruby":   {Phrases: []string{"ruby"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("indexes keyword hits at the time each tweet was created", func() {
+		archive, err := gatherer.OpenArchive(filepath.Join("assets", "sample"))
+		Expect(err).NotTo(HaveOccurred())
+		defer archive.Close()
+
+		hits, err := gatherer.Backfill(ctx, archive, "file:sample", pythonAndRuby, index)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hits).To(Equal(uint(17)))
+		Expect(index.indexed["ruby"]).To(HaveLen(9))
+		Expect(index.indexed["python"]).To(HaveLen(8))
+		Expect(index.indexed["python"][0]).To(BeTemporally("==", time.Date(2015, 3, 3, 21, 8, 19, 0, time.UTC)))
+		Expect(index.sources).To(Equal(map[string]bool{"file:sample": true}))
+	})
+
+	It("skips tweets without a creation time", func() {
+		hits, err := gatherer.Backfill(ctx, strings.NewReader(`{"text": "python"}`), "file:sample", pythonAndRuby, index)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hits).To(BeZero())
+	})
+
+	Context("when the archive is gzipped", func() {
+
+		var path string
+
+		BeforeEach(func() {
+			sample, err := os.Open(filepath.Join("assets", "sample"))
+			Expect(err).NotTo(HaveOccurred())
+			defer sample.Close()
+			compressed, err := ioutil.TempFile("", "sample.gz")
+			Expect(err).NotTo(HaveOccurred())
+			defer compressed.Close()
+			path = compressed.Name()
+			writer := gzip.NewWriter(compressed)
+			_, err = io.Copy(writer, sample)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Close()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.Remove(path)
+		})
+
+		It("decompresses it", func() {
+			archive, err := gatherer.OpenArchive(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer archive.Close()
+
+			hits, err := gatherer.Backfill(ctx, archive, "file:sample", pythonAndRuby, index)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hits).To(Equal(uint(17)))
+		})
+	})
+
+	Context("when indexing fails", func() {
+
+		It("stops and returns the error", func() {
+			index.indexErr = errors.New("o no!")
+			archive, err := gatherer.OpenArchive(filepath.Join("assets", "sample"))
+			Expect(err).NotTo(HaveOccurred())
+			defer archive.Close()
+
+			hits, err := gatherer.Backfill(ctx, archive, "file:sample", pythonAndRuby, index)
+			Expect(err).To(MatchError("o no!"))
+			Expect(hits).To(BeZero())
+		})
+	})
+})
@@ -0,0 +1,259 @@
+package gatherer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/tweet"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	JetstreamURL = "wss://jetstream2.us-east.bsky.network/subscribe"
+
+	postCollection = "app.bsky.feed.post"
+
+	cursorInterval = 5 * time.Second
+	reconnectDelay = 250 * time.Millisecond
+
+	// jetstreamReadTimeout is how long Jetstream, which streams events
+	// continuously, may go without sending one before the connection is
+	// considered dead.
+	jetstreamReadTimeout = time.Minute
+)
+
+// CursorStore remembers how far a source's stream has been read, so that it
+// can be resumed after a restart.
+type CursorStore interface {
+	Cursor(ctx context.Context, source string) (int64, error)
+	SaveCursor(ctx context.Context, source string, cursor int64) error
+}
+
+// BlueskyClient reads posts from Bluesky's Jetstream, a JSON WebSocket feed
+// of the network's firehose. Each event is identified by a cursor, the time in
+// microseconds Jetstream saw it, which is saved so that the stream resumes
+// where it left off when reconnecting or restarting. The saved cursor only
+// passes a post once its counts have been written, so that posts still being
+// counted when the gatherer dies are read again.
+type BlueskyClient struct {
+	*processor
+	cursors     CursorStore
+	url         string
+	cursorMutex sync.Mutex
+	cursor      int64
+	inFlight    []int64
+}
+
+func NewBluesky(index Indexer, cursors CursorStore, jetstreamURL string, options Options) *BlueskyClient {
+	return &BlueskyClient{
+		processor: newProcessor(index, options, "bluesky"),
+		cursors:   cursors,
+		url:       jetstreamURL,
+	}
+}
+
+// Stream reads posts from the saved cursor onwards, reconnecting whenever the
+// connection drops after reading some events. It returns once Jetstream
+// cannot be reached or closes a connection without sending any events, or ctx
+// is done.
+func (client *BlueskyClient) Stream(ctx context.Context, keywords *keywords.Set) {
+	cursor, err := client.cursors.Cursor(ctx, client.options.Source)
+	if err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	client.setCursor(cursor)
+	stop := make(chan struct{})
+	defer close(stop)
+	go client.saveCursorPeriodically(ctx, stop)
+	for client.streamOnce(ctx, keywords) && ctx.Err() == nil {
+		time.Sleep(reconnectDelay)
+	}
+	client.saveCursor(context.WithoutCancel(ctx))
+}
+
+// streamOnce reads a single connection, returning whether any events were
+// read from it. The connection is closed as soon as ctx is done.
+func (client *BlueskyClient) streamOnce(ctx context.Context, keywords *keywords.Set) bool {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn, err := client.dial(connCtx)
+	if err != nil {
+		if ctx.Err() == nil {
+			client.errLogger.Println(err)
+		}
+		return false
+	}
+	defer conn.Close()
+	events := 0
+	wg := new(sync.WaitGroup)
+	disconnect := client.connect(ctx)
+	for ctx.Err() == nil {
+		conn.SetReadDeadline(time.Now().Add(jetstreamReadTimeout))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil {
+				client.errLogger.Println(err)
+			}
+			break
+		}
+		events++
+		if t, cursor, ok := client.parseEvent(message); ok {
+			client.processEvent(ctx, t, cursor, keywords, wg)
+		}
+	}
+	disconnect()
+	wg.Wait()
+	client.persistRelatedTerms(context.WithoutCancel(ctx))
+	client.saveCursor(context.WithoutCancel(ctx))
+	return events > 0
+}
+
+// processEvent indexes a post's keyword hits in the background, holding the
+// saved cursor back from it until they are written.
+func (client *BlueskyClient) processEvent(ctx context.Context, t tweet.Tweet, cursor int64, keywords *keywords.Set, wg *sync.WaitGroup) {
+	client.cursorMutex.Lock()
+	client.inFlight = append(client.inFlight, cursor)
+	client.cursorMutex.Unlock()
+	written := new(sync.WaitGroup)
+	client.process(ctx, t, keywords, written, nil)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		written.Wait()
+		client.written(cursor)
+	}()
+}
+
+func (client *BlueskyClient) written(cursor int64) {
+	client.cursorMutex.Lock()
+	defer client.cursorMutex.Unlock()
+	for i, c := range client.inFlight {
+		if c == cursor {
+			client.inFlight = append(client.inFlight[:i], client.inFlight[i+1:]...)
+			return
+		}
+	}
+}
+
+// dial connects to Jetstream, closing the connection as soon as ctx is done,
+// even during the handshake.
+func (client *BlueskyClient) dial(ctx context.Context) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = func(dialCtx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := new(net.Dialer).DialContext(dialCtx, network, addr)
+		if err == nil {
+			context.AfterFunc(ctx, func() { conn.Close() })
+		}
+		return conn, err
+	}
+	conn, _, err := dialer.DialContext(ctx, client.subscribeURL(), nil)
+	return conn, err
+}
+
+func (client *BlueskyClient) subscribeURL() string {
+	query := url.Values{"wantedCollections": {postCollection}}
+	if cursor := client.getCursor(); cursor > 0 {
+		query.Set("cursor", fmt.Sprintf("%d", cursor))
+	}
+	return client.url + "?" + query.Encode()
+}
+
+// parseEvent parses the post created by a Jetstream commit event, and its
+// cursor. Events at or before the cursor were already read before
+// reconnecting, and are skipped.
+func (client *BlueskyClient) parseEvent(message []byte) (tweet.Tweet, int64, bool) {
+	var event struct {
+		DID    string `json:"did"`
+		TimeUS int64  `json:"time_us"`
+		Kind   string `json:"kind"`
+		Commit struct {
+			Operation  string `json:"operation"`
+			Collection string `json:"collection"`
+			RKey       string `json:"rkey"`
+			Record     struct {
+				Text      string   `json:"text"`
+				Langs     []string `json:"langs"`
+				CreatedAt string   `json:"createdAt"`
+			} `json:"record"`
+		} `json:"commit"`
+	}
+	if err := json.Unmarshal(message, &event); err != nil {
+		return tweet.Tweet{}, 0, false
+	}
+	if event.TimeUS <= client.getCursor() {
+		return tweet.Tweet{}, 0, false
+	}
+	client.setCursor(event.TimeUS)
+	commit := event.Commit
+	if event.Kind != "commit" || commit.Operation != "create" || commit.Collection != postCollection || commit.Record.Text == "" {
+		return tweet.Tweet{}, 0, false
+	}
+	t := tweet.Tweet{
+		ID:       fmt.Sprintf("at://%s/%s/%s", event.DID, postCollection, commit.RKey),
+		AuthorID: event.DID,
+		Text:     commit.Record.Text,
+	}
+	if len(commit.Record.Langs) > 0 {
+		t.Lang = commit.Record.Langs[0]
+	}
+	createdAt, err := time.Parse(time.RFC3339, commit.Record.CreatedAt)
+	if err != nil {
+		createdAt = time.Unix(0, event.TimeUS*int64(time.Microsecond))
+	}
+	t.CreatedAt = createdAt
+	return t, event.TimeUS, true
+}
+
+func (client *BlueskyClient) saveCursorPeriodically(ctx context.Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(cursorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			client.saveCursor(ctx)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// saveCursor saves the cursor of the last event read, or if posts are still
+// being counted, of the event before the first of them.
+func (client *BlueskyClient) saveCursor(ctx context.Context) {
+	cursor := client.savedCursor()
+	if cursor == 0 {
+		return
+	}
+	if err := client.cursors.SaveCursor(ctx, client.options.Source, cursor); err != nil {
+		client.errLogger.Println(err)
+	}
+}
+
+func (client *BlueskyClient) getCursor() int64 {
+	client.cursorMutex.Lock()
+	defer client.cursorMutex.Unlock()
+	return client.cursor
+}
+
+func (client *BlueskyClient) savedCursor() int64 {
+	client.cursorMutex.Lock()
+	defer client.cursorMutex.Unlock()
+	if len(client.inFlight) > 0 {
+		return client.inFlight[0] - 1
+	}
+	return client.cursor
+}
+
+func (client *BlueskyClient) setCursor(cursor int64) {
+	client.cursorMutex.Lock()
+	defer client.cursorMutex.Unlock()
+	client.cursor = cursor
+}
@@ -0,0 +1,318 @@
+package gatherer_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/gatherer"
+	"github.com/craigfurman/bovine/keywords"
+
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeCursorStore struct {
+	sync.Mutex
+	cursors map[string]int64
+}
+
+func (s *fakeCursorStore) Cursor(_ context.Context, source string) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.cursors[source], nil
+}
+
+func (s *fakeCursorStore) SaveCursor(_ context.Context, source string, cursor int64) error {
+	s.Lock()
+	defer s.Unlock()
+	s.cursors[source] = cursor
+	return nil
+}
+
+// fakeJetstream sends each connection the events queued for it, recording
+// the URL each was requested with, or holds connections open without sending
+// anything until released.
+type fakeJetstream struct {
+	sync.Mutex
+	connections   [][]string
+	requestedURLs []string
+	hang          chan struct{}
+}
+
+func (j *fakeJetstream) send(connections ...[]string) {
+	j.Lock()
+	defer j.Unlock()
+	j.connections = connections
+}
+
+func (j *fakeJetstream) hold() (release func()) {
+	j.Lock()
+	defer j.Unlock()
+	hang := make(chan struct{})
+	j.hang = hang
+	return func() { close(hang) }
+}
+
+// connect records a connection's URL, returning the events to send it, or
+// a channel to wait on first if connections are being held.
+func (j *fakeJetstream) connect(url string) ([]string, chan struct{}) {
+	j.Lock()
+	defer j.Unlock()
+	j.requestedURLs = append(j.requestedURLs, url)
+	if j.hang != nil || len(j.connections) == 0 {
+		return nil, j.hang
+	}
+	events := j.connections[0]
+	j.connections = j.connections[1:]
+	return events, nil
+}
+
+func (j *fakeJetstream) RequestedURLs() []string {
+	j.Lock()
+	defer j.Unlock()
+	return append([]string(nil), j.requestedURLs...)
+}
+
+// blockingIndexer holds back counts of word until released.
+type blockingIndexer struct {
+	*fakeIndexer
+	word    string
+	release chan struct{}
+}
+
+func (i *blockingIndexer) IndexWordsAt(ctx context.Context, source string, words []string, t time.Time) error {
+	for _, word := range words {
+		if word == i.word {
+			<-i.release
+		}
+	}
+	return i.fakeIndexer.IndexWordsAt(ctx, source, words, t)
+}
+
+var _ = Describe("streaming from Bluesky", func() {
+
+	var (
+		g *gatherer.BlueskyClient
+
+		mockJetstream *httptest.Server
+		jetstream     *fakeJetstream
+		index         *fakeIndexer
+		cursors       *fakeCursorStore
+		events        []string
+
+		pythonAndRuby *keywords.Set
+	)
+
+	BeforeEach(func() {
+		index = newFakeIndexer()
+		cursors = &fakeCursorStore{cursors: make(map[string]int64)}
+		jetstream = &fakeJetstream{}
+
+		cwd, err := os.Getwd()
+		Expect(err).NotTo(HaveOccurred())
+		sample, err := os.Open(filepath.Join(cwd, "assets", "sample-jetstream"))
+		Expect(err).NotTo(HaveOccurred())
+		defer sample.Close()
+		events = nil
+		scanner := bufio.NewScanner(sample)
+		for scanner.Scan() {
+			events = append(events, scanner.Text())
+		}
+
+		pythonAndRuby, err = keywords.New(map[string]keywords.Definition{
+			"python": {Phrases: []string{"python"}},
+			"ruby":   {Phrases: []string{"ruby"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		js := jetstream
+		mockJetstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.URL.Query().Get("wantedCollections")).To(Equal("app.bsky.feed.post"))
+			events, hang := js.connect(r.URL.String())
+			conn, err := new(websocket.Upgrader).Upgrade(w, r, nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			if hang != nil {
+				<-hang
+				return
+			}
+			for _, event := range events {
+				Expect(conn.WriteMessage(websocket.TextMessage, []byte(event))).To(Succeed())
+			}
+		}))
+	})
+
+	JustBeforeEach(func() {
+		url := "ws" + strings.TrimPrefix(mockJetstream.URL, "http") + "/subscribe"
+		g = gatherer.NewBluesky(index, cursors, url, gatherer.Options{})
+	})
+
+	AfterEach(func() {
+		mockJetstream.Close()
+	})
+
+	Context("when the connection drops", func() {
+
+		BeforeEach(func() {
+			// Jetstream replays the event at the cursor when reconnecting.
+			jetstream.send(events[:3], events[2:])
+		})
+
+		It("counts keywords in new posts, reconnecting from the cursor without counting posts twice", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.argCount).To(Equal(map[string]int{"python": 1, "ruby": 1}))
+			requestedURLs := jetstream.RequestedURLs()
+			Expect(requestedURLs).To(HaveLen(3))
+			Expect(requestedURLs[0]).NotTo(ContainSubstring("cursor"))
+			Expect(requestedURLs[1]).To(ContainSubstring("cursor=1725911162329500"))
+			Expect(requestedURLs[2]).To(ContainSubstring("cursor=1725911162329700"))
+			Expect(cursors.cursors).To(HaveKeyWithValue("bluesky", int64(1725911162329700)))
+		})
+
+		It("records the text, language and creation time of each post", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.samples["ruby"]).To(HaveLen(1))
+			post := index.samples["ruby"][0]
+			Expect(post.ID).To(Equal("at://did:plc:bob/app.bsky.feed.post/3l3qo2vutsw2c"))
+			Expect(post.Text).To(Equal("Ruby ainda é meu primeiro amor"))
+			Expect(post.Lang).To(Equal("pt"))
+			Expect(post.AuthorID).To(Equal("did:plc:bob"))
+			Expect(post.CreatedAt).To(BeTemporally("==", time.Date(2024, 9, 9, 19, 46, 2, 200000000, time.UTC)))
+		})
+
+		It("reports the status of the stream as coming from bluesky", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.streams).NotTo(BeEmpty())
+			Expect(index.streams[0].Source).To(Equal("bluesky"))
+		})
+	})
+
+	Context("while a post is being counted", func() {
+
+		var blocking *blockingIndexer
+
+		BeforeEach(func() {
+			jetstream.send(events)
+		})
+
+		JustBeforeEach(func() {
+			blocking = &blockingIndexer{fakeIndexer: index, word: "ruby", release: make(chan struct{})}
+			url := "ws" + strings.TrimPrefix(mockJetstream.URL, "http") + "/subscribe"
+			g = gatherer.NewBluesky(blocking, cursors, url, gatherer.Options{})
+		})
+
+		It("does not save a cursor past it until its counts are written", func() {
+			finished := make(chan struct{})
+			go func() {
+				g.Stream(ctx, pythonAndRuby)
+				close(finished)
+			}()
+			savedCursor := func() int64 {
+				cursors.Lock()
+				defer cursors.Unlock()
+				return cursors.cursors["bluesky"]
+			}
+			Eventually(savedCursor, 7*time.Second).Should(Equal(int64(1725911162329499)))
+			Consistently(finished).ShouldNot(BeClosed())
+
+			close(blocking.release)
+			Eventually(finished).Should(BeClosed())
+			Expect(savedCursor()).To(Equal(int64(1725911162329700)))
+		})
+	})
+
+	Context("when Jetstream sends nothing", func() {
+
+		var release func()
+
+		BeforeEach(func() {
+			release = jetstream.hold()
+		})
+
+		AfterEach(func() {
+			release()
+		})
+
+		It("stops reading as soon as ctx is done", func() {
+			streamCtx, cancel := context.WithCancel(ctx)
+			finished := make(chan struct{})
+			go func() {
+				g.Stream(streamCtx, pythonAndRuby)
+				close(finished)
+			}()
+			Consistently(finished, 200*time.Millisecond).ShouldNot(BeClosed())
+			cancel()
+			Eventually(finished).Should(BeClosed())
+		})
+	})
+
+	Context("when Jetstream does not answer the handshake", func() {
+
+		var listener net.Listener
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			go func() {
+				var conns []net.Conn
+				defer func() {
+					for _, conn := range conns {
+						conn.Close()
+					}
+				}()
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conns = append(conns, conn)
+				}
+			}()
+		})
+
+		JustBeforeEach(func() {
+			g = gatherer.NewBluesky(index, cursors, "ws://"+listener.Addr().String()+"/subscribe", gatherer.Options{})
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("stops connecting as soon as ctx is done", func() {
+			streamCtx, cancel := context.WithCancel(ctx)
+			finished := make(chan struct{})
+			go func() {
+				g.Stream(streamCtx, pythonAndRuby)
+				close(finished)
+			}()
+			Consistently(finished, 200*time.Millisecond).ShouldNot(BeClosed())
+			cancel()
+			Eventually(finished).Should(BeClosed())
+		})
+	})
+
+	Context("when restarting from a saved cursor", func() {
+
+		BeforeEach(func() {
+			cursors.cursors["bluesky"] = 1725911162329308
+			jetstream.send(events)
+		})
+
+		It("resumes after the cursor", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(jetstream.RequestedURLs()[0]).To(ContainSubstring("cursor=1725911162329308"))
+			Expect(index.argCount).To(Equal(map[string]int{"ruby": 1}))
+		})
+	})
+})
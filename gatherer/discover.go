@@ -0,0 +1,56 @@
+package gatherer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/craigfurman/bovine/discovery"
+)
+
+// Discover reads a sample of all public tweets, looking for phrases that are
+// rising sharply in frequency, until the stream ends or ctx is done, closing
+// the stream as soon as ctx is done.
+func (client *TwitterClient) Discover(ctx context.Context, detector *discovery.Detector) {
+	response, err := client.consumer().Get(fmt.Sprintf("%s/1.1/statuses/sample.json", client.twitterStreamBaseURL), nil, client.token())
+	if err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	defer response.Body.Close()
+	stop := context.AfterFunc(ctx, func() { response.Body.Close() })
+	defer stop()
+	client.DiscoverFrom(ctx, response.Body, detector)
+}
+
+// DiscoverFrom reads newline delimited tweets, such as a stream or an archive
+// file, indexing the candidate phrases each time a window of tweets ends.
+func (client *TwitterClient) DiscoverFrom(ctx context.Context, tweets io.Reader, detector *discovery.Detector) {
+	streamer := bufio.NewScanner(tweets)
+	for ctx.Err() == nil && streamer.Scan() {
+		var parsedTweet struct {
+			Text      string `json:"text"`
+			CreatedAt string `json:"created_at"`
+		}
+		if err := json.Unmarshal(streamer.Bytes(), &parsedTweet); err != nil || parsedTweet.Text == "" {
+			continue
+		}
+		createdAt, err := parseCreatedAt(parsedTweet.CreatedAt)
+		if err != nil {
+			createdAt = client.options.Clock.Now()
+		}
+		if detector.Add(parsedTweet.Text, createdAt) {
+			client.indexCandidates(ctx, detector)
+		}
+	}
+	detector.Rotate()
+	client.indexCandidates(ctx, detector)
+}
+
+func (client *TwitterClient) indexCandidates(ctx context.Context, detector *discovery.Detector) {
+	if err := client.index.IndexCandidates(ctx, detector.Candidates()); err != nil {
+		client.errLogger.Println(err)
+	}
+}
@@ -0,0 +1,99 @@
+package gatherer_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/craigfurman/bovine/discovery"
+	"github.com/craigfurman/bovine/gatherer"
+
+	"github.com/gorilla/mux"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("discovering phrases", func() {
+
+	var (
+		g *gatherer.TwitterClient
+
+		mockTwitter *httptest.Server
+		index       *fakeIndexer
+		detector    *discovery.Detector
+		stall       chan struct{}
+	)
+
+	BeforeEach(func() {
+		index = newFakeIndexer()
+		detector = discovery.NewDetector(time.Hour)
+		stall = nil
+
+		handler := mux.NewRouter()
+		handler.HandleFunc("/1.1/statuses/sample.json", func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Header["Authorization"][0]).To(ContainSubstring("consumerKey"))
+			if stall != nil {
+				w.(http.Flusher).Flush()
+				<-stall
+				return
+			}
+			sample, err := ioutil.ReadFile(filepath.Join("assets", "sample-discovery"))
+			Expect(err).NotTo(HaveOccurred())
+			w.Write(sample)
+		}).
+			Methods("GET")
+		mockTwitter = httptest.NewServer(handler)
+		g = gatherer.New(index, "consumerKey", "consumerSecret", "accessToken", "accessTokenSecret", mockTwitter.URL, gatherer.Options{})
+	})
+
+	AfterEach(func() {
+		mockTwitter.Close()
+	})
+
+	circleBack := discovery.Candidate{Phrase: "circle back", Count: 6, PreviousCount: 1, Growth: 6}
+
+	It("indexes rising phrases from the twitter sample stream at the end of each window", func() {
+		g.Discover(ctx, detector)
+		Expect(index.candidates).To(HaveLen(2))
+		Expect(index.candidates[0]).To(BeEmpty())
+		Expect(index.candidates[1]).To(ConsistOf(circleBack))
+	})
+
+	Context("when the sample stream sends nothing", func() {
+
+		BeforeEach(func() {
+			stall = make(chan struct{})
+		})
+
+		AfterEach(func() {
+			close(stall)
+		})
+
+		It("stops reading as soon as ctx is done", func() {
+			discoverCtx, cancel := context.WithCancel(ctx)
+			finished := make(chan struct{})
+			go func() {
+				g.Discover(discoverCtx, detector)
+				close(finished)
+			}()
+			Consistently(finished, 200*time.Millisecond).ShouldNot(BeClosed())
+			cancel()
+			Eventually(finished).Should(BeClosed())
+		})
+	})
+
+	It("indexes rising phrases from a file of tweets", func() {
+		archive, err := os.Open(filepath.Join("assets", "sample-discovery"))
+		Expect(err).NotTo(HaveOccurred())
+		defer archive.Close()
+
+		g.DiscoverFrom(ctx, archive, detector)
+		Expect(index.candidates).To(HaveLen(2))
+		Expect(index.candidates[1]).To(ConsistOf(circleBack))
+	})
+})
@@ -1,92 +1,153 @@
 package gatherer
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
-	"os"
-	"strings"
-	"sync"
+	"strconv"
+	"time"
+
+	"github.com/craigfurman/bovine/discovery"
+	"github.com/craigfurman/bovine/health"
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/suppress"
+	"github.com/craigfurman/bovine/topk"
+	"github.com/craigfurman/bovine/tweet"
 
 	"github.com/mrjones/oauth"
 )
 
 type Indexer interface {
-	IndexWord(s string) error
+	IndexWordAt(ctx context.Context, source, word string, t time.Time) error
+	IndexWordsAt(ctx context.Context, source string, words []string, t time.Time) error
+	IndexCooccurrences(ctx context.Context, source string, words []string, t time.Time) error
+	IndexSentiment(ctx context.Context, word string, score int, t time.Time) error
+	IndexSample(ctx context.Context, word string, t tweet.Tweet) error
+	IndexAuthor(ctx context.Context, source, word, authorID string, t time.Time) error
+	IndexSuppressed(ctx context.Context, word, reason string, t time.Time) error
+	IndexRelated(ctx context.Context, word string, terms []topk.Item) error
+	IndexCandidates(ctx context.Context, candidates []discovery.Candidate) error
+	ReportStream(ctx context.Context, status health.Stream) error
+}
+
+// Deduplicator remembers which tweets from a source have been counted, so
+// that tweets delivered more than once are counted once.
+type Deduplicator interface {
+	Seen(ctx context.Context, source, id string) (bool, error)
+	MarkSeen(ctx context.Context, source, id string) error
+}
+
+type Clock interface {
+	Now() time.Time
 }
 
+type Options struct {
+	// Source names the network tweets are read from. Counts are labelled
+	// with it and stream status is reported under it. It defaults to the
+	// network the client streams from.
+	Source string
+
+	// SampleIDsOnly stops tweet text from being stored in keyword samples.
+	SampleIDsOnly bool
+
+	// MaxLateness is how long after it was tweeted a tweet may arrive and
+	// still be counted. Zero means tweets are never too late.
+	MaxLateness time.Duration
+
+	// Clock tells the time tweets arrive at, against which their lateness is
+	// judged. It defaults to the system clock.
+	Clock Clock
+
+	// Suppression configures which keyword hits are not counted because they
+	// look like spam, such as those from denied accounts or repeated posts.
+	// Suppressed hits are tallied by reason instead.
+	Suppression suppress.Config
+}
+
+// TwitterClient streams tweets matching the tracked keywords from the Twitter
+// API v1.1 filter stream, authenticating with OAuth 1.0a.
 type TwitterClient struct {
-	index                Indexer
+	*processor
 	consumerKey          string
 	consumerSecret       string
 	accessToken          string
 	accessTokenSecret    string
 	twitterStreamBaseURL string
-	logger               *log.Logger
-	errLogger            *log.Logger
 }
 
-func New(index Indexer, consumerKey, consumerSecret, accessToken, accessTokenSecret, twitterStreamBaseURL string) *TwitterClient {
+func New(index Indexer, consumerKey, consumerSecret, accessToken, accessTokenSecret, twitterStreamBaseURL string, options Options) *TwitterClient {
 	return &TwitterClient{
-		index:                index,
+		processor:            newProcessor(index, options, "twitter"),
 		consumerKey:          consumerKey,
 		consumerSecret:       consumerSecret,
 		accessToken:          accessToken,
 		accessTokenSecret:    accessTokenSecret,
 		twitterStreamBaseURL: twitterStreamBaseURL,
-		errLogger:            log.New(os.Stderr, "gatherer error: ", log.LstdFlags),
-		logger:               log.New(os.Stdout, "gatherer: ", log.LstdFlags),
 	}
 }
 
-func (client *TwitterClient) Stream(commaSeparatedKeywords string) {
-	keywords := strings.Split(commaSeparatedKeywords, ",")
-	consumer := oauth.NewConsumer(
-		client.consumerKey,
-		client.consumerSecret,
-		oauth.ServiceProvider{})
+// Stream indexes tweets until the stream ends or ctx is done, closing the
+// stream as soon as ctx is done.
+func (client *TwitterClient) Stream(ctx context.Context, keywords *keywords.Set) {
 	requestParams := map[string]string{
-		"track": commaSeparatedKeywords,
+		"track": keywords.Track(),
 	}
-	response, err := consumer.Post(fmt.Sprintf("%s/1.1/statuses/filter.json", client.twitterStreamBaseURL), requestParams, &oauth.AccessToken{
-		Token:  client.accessToken,
-		Secret: client.accessTokenSecret,
-	})
+	response, err := client.consumer().Post(fmt.Sprintf("%s/1.1/statuses/filter.json", client.twitterStreamBaseURL), requestParams, client.token())
 	if err != nil {
 		client.errLogger.Println(err)
+		return
 	}
 	defer response.Body.Close()
-	streamer := bufio.NewScanner(response.Body)
-	wg := new(sync.WaitGroup)
-	for streamer.Scan() {
-		client.processTweet(streamer.Text(), keywords, wg)
+	stop := context.AfterFunc(ctx, func() { response.Body.Close() })
+	defer stop()
+	client.stream(ctx, response.Body, keywords, parseTweet)
+}
+
+func (client *TwitterClient) consumer() *oauth.Consumer {
+	return oauth.NewConsumer(
+		client.consumerKey,
+		client.consumerSecret,
+		oauth.ServiceProvider{})
+}
+
+func (client *TwitterClient) token() *oauth.AccessToken {
+	return &oauth.AccessToken{
+		Token:  client.accessToken,
+		Secret: client.accessTokenSecret,
 	}
-	wg.Wait()
 }
 
-func (client *TwitterClient) processTweet(tweetJson string, keywords []string, wg *sync.WaitGroup) {
+// parseTweet parses a tweet from the v1.1 streaming API, ignoring messages
+// that are not tweets.
+func parseTweet(tweetJson []byte, clock Clock) (tweet.Tweet, bool) {
 	parsedTweet := make(map[string]interface{})
-	json.Unmarshal([]byte(tweetJson), &parsedTweet)
-	if tweetTextField, ok := parsedTweet["text"]; ok {
-		tweet := tweetTextField.(string)
-		client.logger.Println(tweet)
-		client.checkAllKeywords(tweet, keywords, wg)
+	json.Unmarshal(tweetJson, &parsedTweet)
+	text, ok := parsedTweet["text"].(string)
+	if !ok {
+		return tweet.Tweet{}, false
 	}
+	id, _ := parsedTweet["id_str"].(string)
+	lang, _ := parsedTweet["lang"].(string)
+	var authorID string
+	if user, ok := parsedTweet["user"].(map[string]interface{}); ok {
+		authorID, _ = user["id_str"].(string)
+	}
+	return tweet.Tweet{ID: id, AuthorID: authorID, Text: text, Lang: lang, CreatedAt: tweetTime(parsedTweet, clock)}, true
 }
 
-func (client *TwitterClient) checkAllKeywords(tweet string, keywords []string, wg *sync.WaitGroup) {
-	for _, keyword := range keywords {
-		if strings.Contains(strings.ToLower(tweet), keyword) {
-			wg.Add(1)
-			go client.indexTweet(keyword, wg)
+// tweetTime returns when a tweet was created, preferring the millisecond
+// timestamp_ms to created_at, and falling back to the time on clock if neither
+// is present.
+func tweetTime(parsedTweet map[string]interface{}, clock Clock) time.Time {
+	if timestampMs, ok := parsedTweet["timestamp_ms"].(string); ok {
+		if ms, err := strconv.ParseInt(timestampMs, 10, 64); err == nil {
+			return time.Unix(0, ms*int64(time.Millisecond))
 		}
 	}
-}
-
-func (client *TwitterClient) indexTweet(wordToIndex string, done *sync.WaitGroup) {
-	defer done.Done()
-	if err := client.index.IndexWord(wordToIndex); err != nil {
-		client.errLogger.Println(err)
+	if createdAt, ok := parsedTweet["created_at"].(string); ok {
+		if t, err := parseCreatedAt(createdAt); err == nil {
+			return t
+		}
 	}
+	return clock.Now()
 }
@@ -1,13 +1,24 @@
 package gatherer_test
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/craigfurman/bovine/discovery"
 	"github.com/craigfurman/bovine/gatherer"
+	"github.com/craigfurman/bovine/health"
+	indexerFakes "github.com/craigfurman/bovine/indexer/fakes"
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/sentiment"
+	"github.com/craigfurman/bovine/suppress"
+	"github.com/craigfurman/bovine/topk"
+	"github.com/craigfurman/bovine/tweet"
 
 	"github.com/gorilla/mux"
 	. "github.com/onsi/ginkgo"
@@ -15,15 +26,118 @@ import (
 )
 
 type fakeIndexer struct {
-	argCount     map[string]int
-	indexWordErr error
+	sync.Mutex
+	argCount      map[string]int
+	indexedAt     []time.Time
+	sources       map[string]int
+	cooccurrences [][]string
+	sentiment     map[string]*sentiment.Tally
+	samples       map[string][]tweet.Tweet
+	authors       map[string][]string
+	suppressed    map[string]map[string]int
+	related       map[string][]topk.Item
+	candidates    [][]discovery.Candidate
+	streams       []health.Stream
+	indexWordErr  error
 }
 
-func (i *fakeIndexer) IndexWord(s string) error {
-	i.argCount[s] = i.argCount[s] + 1
+func newFakeIndexer() *fakeIndexer {
+	return &fakeIndexer{
+		argCount:  make(map[string]int),
+		sentiment: make(map[string]*sentiment.Tally),
+		samples:   make(map[string][]tweet.Tweet),
+		related:   make(map[string][]topk.Item),
+	}
+}
+
+func (i *fakeIndexer) IndexWordAt(ctx context.Context, source, s string, t time.Time) error {
+	return i.IndexWordsAt(ctx, source, []string{s}, t)
+}
+
+func (i *fakeIndexer) IndexWordsAt(_ context.Context, source string, words []string, t time.Time) error {
+	i.Lock()
+	defer i.Unlock()
+	if i.sources == nil {
+		i.sources = make(map[string]int)
+	}
+	for _, s := range words {
+		i.sources[source]++
+		i.argCount[s] = i.argCount[s] + 1
+		i.indexedAt = append(i.indexedAt, t)
+	}
 	return i.indexWordErr
 }
 
+func (i *fakeIndexer) IndexSentiment(_ context.Context, word string, score int, t time.Time) error {
+	i.Lock()
+	defer i.Unlock()
+	if i.sentiment[word] == nil {
+		i.sentiment[word] = new(sentiment.Tally)
+	}
+	i.sentiment[word].Add(score)
+	return i.indexWordErr
+}
+
+func (i *fakeIndexer) IndexSample(_ context.Context, word string, t tweet.Tweet) error {
+	i.Lock()
+	defer i.Unlock()
+	i.samples[word] = append(i.samples[word], t)
+	return i.indexWordErr
+}
+
+func (i *fakeIndexer) IndexAuthor(_ context.Context, source, word, authorID string, t time.Time) error {
+	i.Lock()
+	defer i.Unlock()
+	if i.authors == nil {
+		i.authors = make(map[string][]string)
+	}
+	i.authors[word] = append(i.authors[word], source+":"+authorID)
+	return i.indexWordErr
+}
+
+func (i *fakeIndexer) IndexSuppressed(_ context.Context, word, reason string, t time.Time) error {
+	i.Lock()
+	defer i.Unlock()
+	if i.suppressed == nil {
+		i.suppressed = make(map[string]map[string]int)
+	}
+	if i.suppressed[word] == nil {
+		i.suppressed[word] = make(map[string]int)
+	}
+	i.suppressed[word][reason]++
+	return i.indexWordErr
+}
+
+func (i *fakeIndexer) IndexRelated(_ context.Context, word string, terms []topk.Item) error {
+	i.Lock()
+	defer i.Unlock()
+	i.related[word] = terms
+	return i.indexWordErr
+}
+
+func (i *fakeIndexer) IndexCandidates(_ context.Context, candidates []discovery.Candidate) error {
+	i.Lock()
+	defer i.Unlock()
+	i.candidates = append(i.candidates, candidates)
+	return i.indexWordErr
+}
+
+func (i *fakeIndexer) ReportStream(_ context.Context, status health.Stream) error {
+	i.Lock()
+	defer i.Unlock()
+	i.streams = append(i.streams, status)
+	return i.indexWordErr
+}
+
+func (i *fakeIndexer) IndexCooccurrences(_ context.Context, source string, words []string, t time.Time) error {
+	i.Lock()
+	defer i.Unlock()
+	i.cooccurrences = append(i.cooccurrences, words)
+	return i.indexWordErr
+}
+
+var ctx = context.Background()
+
 var _ = Describe("counting tweets", func() {
 
 	var (
@@ -37,22 +151,41 @@ var _ = Describe("counting tweets", func() {
 		mockTwitter *httptest.Server
 		index       *fakeIndexer
 		response    string
+		stall       chan struct{}
+		track       string
+		options     gatherer.Options
+
+		pythonAndRuby *keywords.Set
 	)
 
 	BeforeEach(func() {
-		index = &fakeIndexer{
-			argCount: make(map[string]int),
-		}
+		index = newFakeIndexer()
 		response = "sample"
+		stall = nil
+		options = gatherer.Options{}
+
+		var err error
+		pythonAndRuby, err = keywords.New(map[string]keywords.Definition{
+			"python": {Phrases: []string{"python"}},
+			"ruby":   {Phrases: []string{"ruby"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
 	})
 
 	JustBeforeEach(func() {
+		stalled := stall
 		handler := mux.NewRouter()
 		handler.HandleFunc("/1.1/statuses/filter.json", func(w http.ResponseWriter, r *http.Request) {
 			defer GinkgoRecover()
 			authHeader := r.Header["Authorization"][0]
 			Expect(authHeader).To(ContainSubstring(consumerKey))
 			Expect(authHeader).To(ContainSubstring(accessToken))
+			track = r.FormValue("track")
+			if stalled != nil {
+				w.(http.Flusher).Flush()
+				<-stalled
+				return
+			}
 			cwd, err := os.Getwd()
 			Expect(err).NotTo(HaveOccurred())
 			sample, err := ioutil.ReadFile(filepath.Join(cwd, "assets", response))
@@ -61,7 +194,7 @@ var _ = Describe("counting tweets", func() {
 		}).
 			Methods("POST")
 		mockTwitter = httptest.NewServer(handler)
-		g = gatherer.New(index, consumerKey, consumerSecret, accessToken, accessTokenSecret, mockTwitter.URL)
+		g = gatherer.New(index, consumerKey, consumerSecret, accessToken, accessTokenSecret, mockTwitter.URL, options)
 	})
 
 	AfterEach(func() {
@@ -69,12 +202,223 @@ var _ = Describe("counting tweets", func() {
 	})
 
 	It("prints data from the twitter streaming API", func() {
-		g.Stream("python,ruby")
+		g.Stream(ctx, pythonAndRuby)
 		Expect(index.argCount).To(HaveLen(2))
 		Expect(index.argCount["ruby"]).To(Equal(9))
 		Expect(index.argCount["python"]).To(Equal(8))
 	})
 
+	It("stops counting once its context is done", func() {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		g.Stream(cancelled, pythonAndRuby)
+		Expect(index.argCount).To(BeEmpty())
+		Expect(g.Status().Connected).To(BeFalse())
+	})
+
+	Context("when the stream sends nothing", func() {
+
+		BeforeEach(func() {
+			stall = make(chan struct{})
+		})
+
+		AfterEach(func() {
+			close(stall)
+		})
+
+		It("stops reading as soon as ctx is done", func() {
+			streamCtx, cancel := context.WithCancel(ctx)
+			finished := make(chan struct{})
+			go func() {
+				g.Stream(streamCtx, pythonAndRuby)
+				close(finished)
+			}()
+			Consistently(finished, 200*time.Millisecond).ShouldNot(BeClosed())
+			cancel()
+			Eventually(finished).Should(BeClosed())
+		})
+	})
+
+	It("labels each count with the twitter source", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.sources).To(Equal(map[string]int{"twitter": 17}))
+	})
+
+	It("scores the sentiment of each tweet containing a keyword", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.sentiment["ruby"].Total()).To(Equal(uint(9)))
+		Expect(index.sentiment["python"].Total()).To(Equal(uint(8)))
+	})
+
+	It("samples tweets containing each keyword", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.samples["ruby"]).To(HaveLen(9))
+		Expect(index.samples["python"]).To(HaveLen(8))
+		texts := make(map[string]string)
+		for _, sample := range index.samples["python"] {
+			texts[sample.ID] = sample.Text
+		}
+		Expect(texts).To(HaveKeyWithValue("572866115690369025", "Finding the source code for a Python module http://t.co/EC2iK40pXS"))
+	})
+
+	It("records the author of each tweet containing a keyword", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.authors["python"]).To(HaveLen(8))
+		Expect(index.authors["python"]).To(ContainElement("twitter:3065923473"))
+	})
+
+	Context("when tweets share other terms", func() {
+
+		BeforeEach(func() {
+			response = "sample-related"
+		})
+
+		It("records the terms most often found alongside each keyword", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.related).To(HaveLen(2))
+			Expect(index.related["ruby"][0]).To(Equal(topk.Item{Term: "rails", Count: 3}))
+			Expect(index.related["ruby"]).To(ContainElement(topk.Item{Term: "#rails", Count: 1}))
+			Expect(index.related["python"]).To(ConsistOf(
+				topk.Item{Term: "web", Count: 1},
+				topk.Item{Term: "apps", Count: 1},
+				topk.Item{Term: "flask", Count: 1},
+			))
+		})
+
+		It("does not relate a keyword to itself", func() {
+			g.Stream(ctx, pythonAndRuby)
+			for _, item := range index.related["ruby"] {
+				Expect(item.Term).NotTo(Equal("ruby"))
+			}
+		})
+	})
+
+	Context("when only tweet IDs should be sampled", func() {
+
+		BeforeEach(func() {
+			options.SampleIDsOnly = true
+		})
+
+		It("does not store tweet text", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.samples["python"]).To(HaveLen(8))
+			for _, sample := range index.samples["python"] {
+				Expect(sample.ID).NotTo(BeEmpty())
+				Expect(sample.Text).To(BeEmpty())
+			}
+		})
+	})
+
+	It("reports the stream as connected while streaming, and disconnected afterwards", func() {
+		before := time.Now()
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.streams).To(HaveLen(2))
+		Expect(index.streams[0].Source).To(Equal("twitter"))
+		Expect(index.streams[0].Connected).To(BeTrue())
+		Expect(index.streams[1].Connected).To(BeFalse())
+		Expect(index.streams[1].LastTweet).To(BeTemporally(">=", before))
+		Expect(g.Status()).To(Equal(index.streams[1]))
+	})
+
+	It("tracks the literal phrases of each keyword", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(track).To(Equal("python,ruby"))
+	})
+
+	It("records the keywords found together in each tweet", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.cooccurrences).To(HaveLen(16))
+		Expect(index.cooccurrences).To(ContainElement(Equal([]string{"python", "ruby"})))
+	})
+
+	It("counts each tweet at the time it was tweeted", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.indexedAt).To(ContainElement(BeTemporally("==", time.Unix(0, 1425416899975*int64(time.Millisecond)))))
+		for _, t := range index.indexedAt {
+			Expect(t.Year()).To(Equal(2015))
+		}
+	})
+
+	Context("when tweets have a millisecond timestamp", func() {
+
+		BeforeEach(func() {
+			response = "sample-timestamp"
+		})
+
+		It("prefers it to the creation time", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.indexedAt).To(ConsistOf(BeTemporally("==", time.Unix(1425416899, 123000000))))
+		})
+	})
+
+	Context("when tweets arrive later than the maximum lateness", func() {
+
+		BeforeEach(func() {
+			clock := new(indexerFakes.FakeClock)
+			clock.NowReturns(time.Unix(1425416931, 0).Add(2 * time.Hour))
+			options.MaxLateness = time.Hour
+			options.Clock = clock
+		})
+
+		It("rejects them", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.argCount).To(BeEmpty())
+			Expect(index.samples).To(BeEmpty())
+		})
+	})
+
+	Context("when tweets arrive within the maximum lateness", func() {
+
+		BeforeEach(func() {
+			clock := new(indexerFakes.FakeClock)
+			clock.NowReturns(time.Unix(1425416931, 0).Add(30 * time.Minute))
+			options.MaxLateness = time.Hour
+			options.Clock = clock
+		})
+
+		It("counts them", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.argCount["ruby"]).To(Equal(9))
+		})
+	})
+
+	Context("when spam is suppressed", func() {
+
+		BeforeEach(func() {
+			options.Suppression = suppress.Config{Deny: []string{"twitter:3065923473", "twitter:577492811"}}
+		})
+
+		It("does not count hits from denied accounts, tallying them instead", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.argCount).To(Equal(map[string]int{"python": 6, "ruby": 8}))
+			Expect(index.suppressed).To(Equal(map[string]map[string]int{
+				"python": {"denied": 2},
+				"ruby":   {"denied": 1},
+			}))
+			for _, sample := range index.samples["python"] {
+				Expect(sample.ID).NotTo(Equal("572866115690369025"))
+			}
+		})
+	})
+
+	Context("when keywords have several spellings", func() {
+
+		It("counts matches under the canonical keyword name", func() {
+			snakes, err := keywords.New(map[string]keywords.Definition{
+				"snakes": {
+					Phrases:  []string{"python"},
+					Patterns: []string{`(?i)\bruby\b`},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			g.Stream(ctx, snakes)
+			Expect(track).To(Equal("python"))
+			Expect(index.argCount).To(HaveLen(1))
+			Expect(index.argCount["snakes"]).To(Equal(16))
+		})
+	})
+
 	Context("when a tweet contains no text", func() {
 
 		BeforeEach(func() {
@@ -82,8 +426,12 @@ var _ = Describe("counting tweets", func() {
 		})
 
 		It("does not panic", func() {
+			anything, err := keywords.New(map[string]keywords.Definition{
+				"anything": {Phrases: []string{"anything"}},
+			})
+			Expect(err).NotTo(HaveOccurred())
 			Expect(func() {
-				g.Stream("anything")
+				g.Stream(ctx, anything)
 			}).NotTo(Panic())
 		})
 	})
@@ -0,0 +1,40 @@
+package gatherer
+
+import (
+	"context"
+
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/tweet"
+)
+
+// Ingester counts the keyword hits in posts pushed to bovine by other tools
+// rather than streamed from a network. Each post is counted under the source
+// it names, or the ingester's source if it names none, and posts pushed more
+// than once are recognised by source and ID and counted once. Pushed posts
+// are not used to find related terms, which are left to the gatherer's
+// stream.
+type Ingester struct {
+	*processor
+	seen     Deduplicator
+	keywords *keywords.Set
+}
+
+func NewIngester(index Indexer, seen Deduplicator, keywords *keywords.Set, options Options) *Ingester {
+	p := newProcessor(index, options, "ingest")
+	p.related = nil
+	return &Ingester{processor: p, seen: seen, keywords: keywords}
+}
+
+// Ingest indexes the keyword hits in posts, returning how many it found. It
+// returns once they are all stored, or with the first error storing one.
+func (i *Ingester) Ingest(ctx context.Context, posts []tweet.Tweet) (uint, error) {
+	var hits uint
+	for _, post := range posts {
+		found, err := i.processOnce(ctx, i.seen, post, i.keywords)
+		if err != nil {
+			return hits, err
+		}
+		hits += uint(found)
+	}
+	return hits, nil
+}
@@ -0,0 +1,85 @@
+package gatherer_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/craigfurman/bovine/gatherer"
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/tweet"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ingesting pushed posts", func() {
+
+	var (
+		ingester *gatherer.Ingester
+		index    *fakeIndexer
+		seen     *fakeDeduplicator
+	)
+
+	BeforeEach(func() {
+		index = newFakeIndexer()
+		pythonAndRuby, err := keywords.New(map[string]keywords.Definition{
+			"python": {Phrases: []string{"python"}},
+			"ruby":   {Phrases: []string{"ruby"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		seen = &fakeDeduplicator{seen: make(map[string]bool)}
+		ingester = gatherer.NewIngester(index, seen, pythonAndRuby, gatherer.Options{})
+	})
+
+	It("counts keyword hits under each post's source", func() {
+		createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		hits, err := ingester.Ingest(ctx, []tweet.Tweet{
+			{ID: "1", Text: "python and ruby", Source: "crm", CreatedAt: createdAt},
+			{ID: "2", Text: "nothing to see", Source: "crm", CreatedAt: createdAt},
+			{ID: "3", Text: "python", CreatedAt: createdAt},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hits).To(Equal(uint(3)))
+		Expect(index.argCount).To(Equal(map[string]int{"python": 2, "ruby": 1}))
+		Expect(index.sources).To(Equal(map[string]int{"crm": 2, "ingest": 1}))
+		Expect(index.indexedAt).To(ConsistOf(createdAt, createdAt, createdAt))
+		Expect(index.cooccurrences).To(ContainElement(ConsistOf("python", "ruby")))
+		Expect(index.samples["ruby"]).To(HaveLen(1))
+		Expect(index.samples["ruby"][0].Source).To(Equal("crm"))
+	})
+
+	It("counts a post pushed more than once from the same source only once", func() {
+		posts := []tweet.Tweet{
+			{ID: "1", Text: "python", Source: "crm", CreatedAt: time.Now()},
+			{ID: "1", Text: "python", Source: "crm", CreatedAt: time.Now()},
+			{ID: "1", Text: "python", Source: "helpdesk", CreatedAt: time.Now()},
+			{Text: "python", Source: "crm", CreatedAt: time.Now()},
+		}
+		hits, err := ingester.Ingest(ctx, posts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hits).To(Equal(uint(3)))
+		_, err = ingester.Ingest(ctx, posts[:1])
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(index.argCount).To(Equal(map[string]int{"python": 3}))
+		Expect(seen.seen).To(Equal(map[string]bool{"crm:1": true, "helpdesk:1": true}))
+	})
+
+	It("does not record related terms", func() {
+		_, err := ingester.Ingest(ctx, []tweet.Tweet{{Text: "python generators", CreatedAt: time.Now()}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(index.related).To(BeEmpty())
+	})
+
+	Context("when counting fails", func() {
+
+		BeforeEach(func() {
+			index.indexWordErr = errors.New("redis went away")
+		})
+
+		It("returns the error", func() {
+			_, err := ingester.Ingest(ctx, []tweet.Tweet{{Text: "python", CreatedAt: time.Now()}})
+			Expect(err).To(MatchError("redis went away"))
+		})
+	})
+})
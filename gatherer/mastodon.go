@@ -0,0 +1,144 @@
+package gatherer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/tweet"
+)
+
+var (
+	lineBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>`)
+	htmlTags   = regexp.MustCompile(`<[^>]*>`)
+)
+
+// MastodonClient streams public statuses from a Mastodon instance's streaming
+// API, using server-sent events. Statuses are matched against the tracked
+// keywords like tweets, so that counts can be compared across networks.
+type MastodonClient struct {
+	*processor
+	baseURL     string
+	accessToken string
+	timeline    string
+	httpClient  *http.Client
+}
+
+// NewMastodon streams the specified timeline of the instance at baseURL:
+// "public", "public:local" or "hashtag:TAG". The access token may be empty
+// if the instance allows unauthenticated streaming.
+func NewMastodon(index Indexer, baseURL, accessToken, timeline string, options Options) *MastodonClient {
+	return &MastodonClient{
+		processor:   newProcessor(index, options, "mastodon"),
+		baseURL:     baseURL,
+		accessToken: accessToken,
+		timeline:    timeline,
+		httpClient:  http.DefaultClient,
+	}
+}
+
+// Stream indexes posts from the timeline until the stream ends or ctx is
+// done.
+func (client *MastodonClient) Stream(ctx context.Context, keywords *keywords.Set) {
+	path, err := timelinePath(client.timeline)
+	if err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", client.baseURL+path, nil)
+	if err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if client.accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+client.accessToken)
+	}
+	response, err := client.httpClient.Do(req)
+	if err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		client.errLogger.Printf("GET %s: %s: %s\n", path, response.Status, message)
+		return
+	}
+	client.stream(ctx, response.Body, keywords, newEventParser())
+}
+
+// timelinePath returns the streaming API path of a timeline.
+func timelinePath(timeline string) (string, error) {
+	switch {
+	case timeline == "public":
+		return "/api/v1/streaming/public", nil
+	case timeline == "public:local":
+		return "/api/v1/streaming/public/local", nil
+	case strings.HasPrefix(timeline, "hashtag:"):
+		tag := strings.TrimPrefix(strings.TrimPrefix(timeline, "hashtag:"), "#")
+		return "/api/v1/streaming/hashtag?tag=" + url.QueryEscape(tag), nil
+	}
+	return "", fmt.Errorf("unknown Mastodon timeline %s", timeline)
+}
+
+// newEventParser returns a parser for the lines of a server-sent event stream,
+// which reports a status for the data line of each "update" event. Other
+// events, such as deletions, and comments used as heartbeats are ignored.
+func newEventParser() func([]byte, Clock) (tweet.Tweet, bool) {
+	var event string
+	return func(line []byte, clock Clock) (tweet.Tweet, bool) {
+		switch {
+		case len(line) == 0:
+			event = ""
+		case bytes.HasPrefix(line, []byte("event:")):
+			event = string(bytes.TrimSpace(line[len("event:"):]))
+		case bytes.HasPrefix(line, []byte("data:")) && event == "update":
+			return parseStatus(bytes.TrimSpace(line[len("data:"):]), clock)
+		}
+		return tweet.Tweet{}, false
+	}
+}
+
+// parseStatus parses a Mastodon status as a tweet, converting its HTML content
+// to plain text. Boosts have no content of their own and are skipped.
+func parseStatus(data []byte, clock Clock) (tweet.Tweet, bool) {
+	var status struct {
+		ID      string `json:"id"`
+		Account struct {
+			ID string `json:"id"`
+		} `json:"account"`
+		Content   string `json:"content"`
+		Language  string `json:"language"`
+		CreatedAt string `json:"created_at"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return tweet.Tweet{}, false
+	}
+	text := stripHTML(status.Content)
+	if text == "" {
+		return tweet.Tweet{}, false
+	}
+	createdAt, err := time.Parse(time.RFC3339, status.CreatedAt)
+	if err != nil {
+		createdAt = clock.Now()
+	}
+	return tweet.Tweet{ID: status.ID, AuthorID: status.Account.ID, Text: text, Lang: status.Language, CreatedAt: createdAt}, true
+}
+
+// stripHTML converts status content to plain text, separating paragraphs and
+// lines with newlines.
+func stripHTML(content string) string {
+	text := lineBreaks.ReplaceAllString(content, "\n")
+	text = htmlTags.ReplaceAllString(text, "")
+	return strings.TrimSpace(html.UnescapeString(text))
+}
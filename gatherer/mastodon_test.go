@@ -0,0 +1,123 @@
+package gatherer_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/craigfurman/bovine/gatherer"
+	"github.com/craigfurman/bovine/keywords"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("streaming from Mastodon", func() {
+
+	var (
+		g *gatherer.MastodonClient
+
+		mockMastodon *httptest.Server
+		index        *fakeIndexer
+		timeline     string
+		accessToken  string
+		requests     []*http.Request
+
+		pythonAndRuby *keywords.Set
+	)
+
+	BeforeEach(func() {
+		index = newFakeIndexer()
+		timeline = "public"
+		accessToken = ""
+		requests = nil
+
+		var err error
+		pythonAndRuby, err = keywords.New(map[string]keywords.Definition{
+			"python": {Phrases: []string{"python"}},
+			"ruby":   {Phrases: []string{"ruby"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		mockMastodon = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			requests = append(requests, r)
+			cwd, err := os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			sample, err := ioutil.ReadFile(filepath.Join(cwd, "assets", "sample-mastodon"))
+			Expect(err).NotTo(HaveOccurred())
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write(sample)
+		}))
+	})
+
+	JustBeforeEach(func() {
+		g = gatherer.NewMastodon(index, mockMastodon.URL, accessToken, timeline, gatherer.Options{})
+	})
+
+	AfterEach(func() {
+		mockMastodon.Close()
+	})
+
+	It("counts keywords in status updates, ignoring boosts, edits and deletions", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].URL.Path).To(Equal("/api/v1/streaming/public"))
+		Expect(requests[0].Header.Get("Authorization")).To(BeEmpty())
+		Expect(index.argCount).To(Equal(map[string]int{"python": 2, "ruby": 1}))
+		Expect(index.sources).To(Equal(map[string]int{"mastodon": 3}))
+		Expect(index.indexedAt).To(ContainElement(BeTemporally("==", time.Date(2022, 11, 5, 14, 2, 11, 0, time.UTC))))
+	})
+
+	It("strips HTML from status content", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.samples["ruby"]).To(HaveLen(1))
+		Expect(index.samples["ruby"][0].ID).To(Equal("109000000000000002"))
+		Expect(index.samples["ruby"][0].Text).To(Equal("Ruby & Python\nside by side"))
+		Expect(index.samples["ruby"][0].Lang).To(Equal("en"))
+	})
+
+	It("records the account that posted each status", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.authors["python"]).To(ConsistOf("mastodon:1", "mastodon:2"))
+	})
+
+	It("reports the status of the stream as coming from mastodon", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.streams).NotTo(BeEmpty())
+		Expect(index.streams[0].Source).To(Equal("mastodon"))
+		Expect(index.streams[0].Connected).To(BeTrue())
+	})
+
+	Context("when following a hashtag with an access token", func() {
+
+		BeforeEach(func() {
+			timeline = "hashtag:#Python"
+			accessToken = "token"
+		})
+
+		It("streams the hashtag timeline", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].URL.Path).To(Equal("/api/v1/streaming/hashtag"))
+			Expect(requests[0].URL.Query().Get("tag")).To(Equal("Python"))
+			Expect(requests[0].Header.Get("Authorization")).To(Equal("Bearer token"))
+		})
+	})
+
+	Context("when the timeline is unknown", func() {
+
+		BeforeEach(func() {
+			timeline = "home"
+		})
+
+		It("does not connect", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(requests).To(BeEmpty())
+			Expect(index.argCount).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,134 @@
+package gatherer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/tweet"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	natsBatch   = 100
+	natsExpires = 5 * time.Second
+)
+
+// NATSClient consumes tweets that an existing pipeline publishes as JSON to a
+// NATS JetStream stream. It reads through a durable consumer, so gatherers
+// sharing a consumer name share the stream, and acknowledges each message
+// only once its counts are stored. Messages whose counts fail to store are
+// redelivered, and tweets already counted are recognised by ID and skipped.
+type NATSClient struct {
+	*processor
+	seen     Deduplicator
+	url      string
+	stream   string
+	consumer string
+	subject  string
+}
+
+func NewNATS(index Indexer, seen Deduplicator, natsURL, stream, consumer, subject string, options Options) *NATSClient {
+	return &NATSClient{
+		processor: newProcessor(index, options, "nats"),
+		seen:      seen,
+		url:       natsURL,
+		stream:    stream,
+		consumer:  consumer,
+		subject:   subject,
+	}
+}
+
+// Stream consumes the stream until the connection to NATS fails or ctx is
+// done.
+func (client *NATSClient) Stream(ctx context.Context, keywords *keywords.Set) {
+	conn, err := nats.Connect(client.url, nats.NoReconnect())
+	if err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	sub, err := js.PullSubscribe(client.subject, client.consumer, nats.BindStream(client.stream))
+	if err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	disconnect := client.connect(ctx)
+	defer client.persistRelatedTerms(context.WithoutCancel(ctx))
+	defer disconnect()
+	for ctx.Err() == nil {
+		msgs, err := client.fetch(ctx, sub)
+		for _, msg := range msgs {
+			client.handle(ctx, msg, keywords)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				client.errLogger.Println(err)
+			}
+			return
+		}
+	}
+}
+
+// fetch waits up to natsExpires for a batch of messages, returning none if
+// none arrive in time.
+func (client *NATSClient) fetch(ctx context.Context, sub *nats.Subscription) ([]*nats.Msg, error) {
+	fetchCtx, cancel := context.WithTimeout(ctx, natsExpires)
+	defer cancel()
+	msgs, err := sub.Fetch(natsBatch, nats.Context(fetchCtx))
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, nil
+	}
+	return msgs, err
+}
+
+// handle counts the keywords in a message, acknowledging it once they are
+// stored or if it need not be counted, and asking for it to be redelivered
+// otherwise.
+func (client *NATSClient) handle(ctx context.Context, msg *nats.Msg, keywords *keywords.Set) {
+	t, ok := parseNATSMessage(msg.Data, client.options.Clock)
+	if !ok {
+		client.errLogger.Printf("skipping malformed message on %s\n", msg.Subject)
+		client.respond(msg.Ack)
+		return
+	}
+	if _, err := client.processOnce(ctx, client.seen, t, keywords); err != nil {
+		client.respond(msg.Nak)
+		return
+	}
+	client.respond(msg.Ack)
+}
+
+func (client *NATSClient) respond(response func(...nats.AckOpt) error) {
+	if err := response(); err != nil {
+		client.errLogger.Println(err)
+	}
+}
+
+// parseNATSMessage parses a tweet published as a JSON object with text and
+// optionally an id, author_id, lang and RFC 3339 created_at, which defaults
+// to the time on clock.
+func parseNATSMessage(message []byte, clock Clock) (tweet.Tweet, bool) {
+	var parsed struct {
+		ID        string    `json:"id"`
+		AuthorID  string    `json:"author_id"`
+		Text      string    `json:"text"`
+		Lang      string    `json:"lang"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	if err := json.Unmarshal(message, &parsed); err != nil || parsed.Text == "" {
+		return tweet.Tweet{}, false
+	}
+	if parsed.CreatedAt.IsZero() {
+		parsed.CreatedAt = clock.Now()
+	}
+	return tweet.Tweet{ID: parsed.ID, AuthorID: parsed.AuthorID, Text: parsed.Text, Lang: parsed.Lang, CreatedAt: parsed.CreatedAt}, true
+}
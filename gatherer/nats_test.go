@@ -0,0 +1,310 @@
+package gatherer_test
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/gatherer"
+	indexerFakes "github.com/craigfurman/bovine/indexer/fakes"
+	"github.com/craigfurman/bovine/keywords"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeDeduplicator struct {
+	sync.Mutex
+	seen map[string]bool
+}
+
+func (d *fakeDeduplicator) Seen(_ context.Context, source, id string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.seen[source+":"+id], nil
+}
+
+func (d *fakeDeduplicator) MarkSeen(_ context.Context, source, id string) error {
+	d.Lock()
+	defer d.Unlock()
+	d.seen[source+":"+id] = true
+	return nil
+}
+
+// flakyIndexer fails to count the first few tweets, with err or, if it is
+// nil, as though the circuit breaker were open.
+type flakyIndexer struct {
+	*fakeIndexer
+	failures int
+	err      error
+}
+
+func (i *flakyIndexer) IndexWordAt(ctx context.Context, source, word string, t time.Time) error {
+	if err := i.fail(); err != nil {
+		return err
+	}
+	return i.fakeIndexer.IndexWordAt(ctx, source, word, t)
+}
+
+func (i *flakyIndexer) IndexWordsAt(ctx context.Context, source string, words []string, t time.Time) error {
+	if err := i.fail(); err != nil {
+		return err
+	}
+	return i.fakeIndexer.IndexWordsAt(ctx, source, words, t)
+}
+
+func (i *flakyIndexer) fail() error {
+	i.Lock()
+	defer i.Unlock()
+	if i.failures == 0 {
+		return nil
+	}
+	i.failures--
+	if i.err != nil {
+		return i.err
+	}
+	return &breaker.OpenError{RetryAfter: time.Second}
+}
+
+// acks records the acknowledgements a consumer sends, keeping for each
+// message the delivery that was acknowledged.
+type acks struct {
+	sync.Mutex
+	deliveries map[uint64]int
+}
+
+func (a *acks) record(msg *nats.Msg) {
+	if string(msg.Data) == "-NAK" {
+		return
+	}
+	meta, err := (&nats.Msg{Sub: msg.Sub, Reply: msg.Subject}).Metadata()
+	if err != nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.deliveries[meta.Sequence.Stream] = int(meta.NumDelivered)
+}
+
+// Deliveries returns how many times each acknowledged message was delivered,
+// in stream order.
+func (a *acks) Deliveries() []int {
+	a.Lock()
+	defer a.Unlock()
+	var sequences []uint64
+	for sequence := range a.deliveries {
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	deliveries := make([]int, 0, len(sequences))
+	for _, sequence := range sequences {
+		deliveries = append(deliveries, a.deliveries[sequence])
+	}
+	return deliveries
+}
+
+var _ = Describe("consuming from NATS", func() {
+
+	var (
+		natsServer *server.Server
+		storeDir   string
+		conn       *nats.Conn
+		js         nats.JetStreamContext
+		acked      *acks
+		index      *flakyIndexer
+		seen       *fakeDeduplicator
+		stream     string
+		streamCtx  context.Context
+		stop       context.CancelFunc
+		finished   chan struct{}
+		options    gatherer.Options
+
+		pythonAndRuby *keywords.Set
+	)
+
+	BeforeEach(func() {
+		var err error
+		storeDir, err = os.MkdirTemp("", "bovine-nats")
+		Expect(err).NotTo(HaveOccurred())
+		natsServer, err = server.NewServer(&server.Options{
+			Host:      "127.0.0.1",
+			Port:      server.RANDOM_PORT,
+			JetStream: true,
+			StoreDir:  storeDir,
+			NoLog:     true,
+			NoSigs:    true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		natsServer.Start()
+		Expect(natsServer.ReadyForConnections(5 * time.Second)).To(BeTrue())
+
+		conn, err = nats.Connect(natsServer.ClientURL())
+		Expect(err).NotTo(HaveOccurred())
+		js, err = conn.JetStream()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = js.AddStream(&nats.StreamConfig{Name: "POSTS", Subjects: []string{"posts.>"}, Storage: nats.MemoryStorage})
+		Expect(err).NotTo(HaveOccurred())
+		acked = &acks{deliveries: make(map[uint64]int)}
+		_, err = conn.Subscribe("$JS.ACK.POSTS.bovine.>", acked.record)
+		Expect(err).NotTo(HaveOccurred())
+
+		index = &flakyIndexer{fakeIndexer: newFakeIndexer()}
+		seen = &fakeDeduplicator{seen: make(map[string]bool)}
+		stream = "POSTS"
+		streamCtx, stop = context.WithCancel(ctx)
+		finished = make(chan struct{})
+		options = gatherer.Options{}
+
+		pythonAndRuby, err = keywords.New(map[string]keywords.Definition{
+			"python": {Phrases: []string{"python"}},
+			"ruby":   {Phrases: []string{"ruby"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		stop()
+		conn.Close()
+		natsServer.Shutdown()
+		natsServer.WaitForShutdown()
+		Expect(os.RemoveAll(storeDir)).To(Succeed())
+	})
+
+	publish := func(message string) {
+		_, err := js.Publish("posts.en", []byte(message))
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	pending := func() int {
+		info, err := js.ConsumerInfo("POSTS", "bovine")
+		Expect(err).NotTo(HaveOccurred())
+		return int(info.NumPending) + info.NumAckPending
+	}
+
+	consume := func() {
+		Expect(conn.FlushTimeout(time.Second)).To(Succeed())
+		g := gatherer.NewNATS(index, seen, natsServer.ClientURL(), stream, "bovine", "posts.en", options)
+		go func() {
+			g.Stream(streamCtx, pythonAndRuby)
+			close(finished)
+		}()
+	}
+
+	consumeAll := func() {
+		consume()
+		Eventually(func() int {
+			index.Lock()
+			defer index.Unlock()
+			return len(index.streams)
+		}).ShouldNot(BeZero())
+		Eventually(pending, 2*time.Second).Should(BeZero())
+		stop()
+		Eventually(finished).Should(BeClosed())
+	}
+
+	It("counts keywords in published tweets, acknowledging each", func() {
+		publish(`{"id": "1", "author_id": "alice", "text": "python and ruby", "created_at": "2024-05-01T12:00:00Z"}`)
+		publish(`{"id": "2", "text": "more python"}`)
+		consumeAll()
+		Expect(index.authors["python"]).To(Equal([]string{"nats:alice"}))
+
+		Expect(index.argCount).To(Equal(map[string]int{"python": 2, "ruby": 1}))
+		Expect(index.sources).To(Equal(map[string]int{"nats": 3}))
+		Expect(index.indexedAt).To(ContainElement(BeTemporally("==", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))))
+		Expect(seen.seen).To(Equal(map[string]bool{"nats:1": true, "nats:2": true}))
+	})
+
+	It("counts tweets that do not say when they were created at the time on the clock", func() {
+		clock := new(indexerFakes.FakeClock)
+		now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		clock.NowReturns(now)
+		options.Clock = clock
+		publish(`{"id": "1", "text": "python"}`)
+		consumeAll()
+
+		Expect(index.indexedAt).To(HaveLen(1))
+		Expect(index.indexedAt[0]).To(BeTemporally("==", now))
+	})
+
+	It("counts a tweet delivered more than once only once", func() {
+		publish(`{"id": "1", "text": "python"}`)
+		publish(`{"id": "1", "text": "python"}`)
+		consumeAll()
+
+		Expect(index.argCount).To(Equal(map[string]int{"python": 1}))
+	})
+
+	It("has a tweet redelivered until its counts are stored", func() {
+		index.failures = 1
+		publish(`{"id": "1", "text": "python"}`)
+		publish(`{"id": "2", "text": "ruby"}`)
+		consumeAll()
+
+		Expect(index.argCount).To(Equal(map[string]int{"python": 1, "ruby": 1}))
+		Eventually(acked.Deliveries).Should(Equal([]int{2, 1}))
+	})
+
+	It("counts each keyword of a redelivered tweet once", func() {
+		index.failures = 1
+		index.err = breaker.ErrTimeout
+		publish(`{"id": "1", "text": "python and ruby"}`)
+		consumeAll()
+
+		Expect(index.argCount).To(Equal(map[string]int{"python": 1, "ruby": 1}))
+		Eventually(acked.Deliveries).Should(Equal([]int{2}))
+	})
+
+	It("stores nothing else for a tweet until its counts are stored", func() {
+		index.failures = 1
+		publish(`{"id": "1", "author_id": "alice", "text": "python and ruby"}`)
+		consumeAll()
+
+		Expect(index.authors["python"]).To(Equal([]string{"nats:alice"}))
+		Expect(index.samples["python"]).To(HaveLen(1))
+		Expect(index.sentiment["python"].Neutral).To(BeEquivalentTo(1))
+		Expect(index.cooccurrences).To(HaveLen(1))
+	})
+
+	It("does not remember tweets that mention no keyword", func() {
+		publish(`{"id": "1", "text": "nothing to see"}`)
+		publish(`{"id": "2", "text": "python"}`)
+		consumeAll()
+
+		Expect(seen.seen).To(Equal(map[string]bool{"nats:2": true}))
+	})
+
+	It("acknowledges malformed messages without counting them", func() {
+		publish(`not json`)
+		publish(`{"id": "2"}`)
+		consumeAll()
+
+		Expect(index.argCount).To(BeEmpty())
+	})
+
+	It("reports the status of the stream as coming from nats", func() {
+		consumeAll()
+
+		Expect(index.streams).NotTo(BeEmpty())
+		Expect(index.streams[0].Source).To(Equal("nats"))
+		Expect(index.streams[0].Connected).To(BeTrue())
+		Expect(index.streams[len(index.streams)-1].Connected).To(BeFalse())
+	})
+
+	Context("when the stream does not exist", func() {
+
+		BeforeEach(func() {
+			stream = "MISSING"
+		})
+
+		It("does not consume", func() {
+			consume()
+			Eventually(finished).Should(BeClosed())
+			Expect(index.streams).To(BeEmpty())
+		})
+	})
+})
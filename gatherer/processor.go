@@ -0,0 +1,267 @@
+package gatherer
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/health"
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/sentiment"
+	"github.com/craigfurman/bovine/suppress"
+	"github.com/craigfurman/bovine/tweet"
+)
+
+// processor indexes the tweets read by each source of tweets.
+type processor struct {
+	index      Indexer
+	scorer     *sentiment.Scorer
+	related    *relatedTerms
+	suppressor *suppress.Suppressor
+	status     *streamStatus
+	options    Options
+	logger     *log.Logger
+	errLogger  *log.Logger
+}
+
+func newProcessor(index Indexer, options Options, defaultSource string) *processor {
+	if options.Source == "" {
+		options.Source = defaultSource
+	}
+	if options.Clock == nil {
+		options.Clock = systemClock{}
+	}
+	p := &processor{
+		index:     index,
+		scorer:    sentiment.New(),
+		related:   newRelatedTerms(),
+		status:    &streamStatus{stream: health.Stream{Source: options.Source}},
+		options:   options,
+		errLogger: log.New(os.Stderr, "gatherer error: ", log.LstdFlags),
+		logger:    log.New(os.Stdout, "gatherer: ", log.LstdFlags),
+	}
+	if options.Suppression.Enabled() {
+		p.suppressor = suppress.New(options.Suppression)
+	}
+	return p
+}
+
+// stream indexes the keyword hits in a connected stream of newline delimited
+// messages until it ends or ctx is done.
+func (p *processor) stream(ctx context.Context, body io.Reader, keywords *keywords.Set, parse func([]byte, Clock) (tweet.Tweet, bool)) {
+	streamer := bufio.NewScanner(body)
+	p.consume(ctx, keywords, func() ([]byte, bool) {
+		if !streamer.Scan() {
+			return nil, false
+		}
+		return streamer.Bytes(), true
+	}, parse)
+}
+
+// consume indexes the keyword hits in the messages returned by next until it
+// reports the stream has ended, or ctx is done. Messages that parse reports
+// are not tweets are skipped. parse is given the processor's clock, for
+// tweets that do not say when they were created.
+func (p *processor) consume(ctx context.Context, keywords *keywords.Set, next func() ([]byte, bool), parse func([]byte, Clock) (tweet.Tweet, bool)) {
+	wg := new(sync.WaitGroup)
+	disconnect := p.connect(ctx)
+	for message, ok := next(); ok && ctx.Err() == nil; message, ok = next() {
+		if t, ok := parse(message, p.options.Clock); ok {
+			p.process(ctx, t, keywords, wg, nil)
+		}
+	}
+	disconnect()
+	wg.Wait()
+	p.persistRelatedTerms(context.WithoutCancel(ctx))
+}
+
+// connect marks the stream as connected, reporting its status and persisting
+// related terms in the background until disconnect is called. The stream is
+// reported disconnected even if ctx is done.
+func (p *processor) connect(ctx context.Context) (disconnect func()) {
+	p.status.connected(true)
+	p.reportStream(ctx)
+	stop := make(chan struct{})
+	go p.persistRelatedTermsPeriodically(ctx, stop)
+	go p.reportStreamPeriodically(ctx, stop)
+	return func() {
+		close(stop)
+		p.status.connected(false)
+		p.reportStream(context.WithoutCancel(ctx))
+	}
+}
+
+// processNow indexes a tweet's keyword hits before returning the number
+// found, reporting any error counting them so that a source delivering at
+// least once can have the tweet redelivered rather than acknowledging it.
+func (p *processor) processNow(ctx context.Context, t tweet.Tweet, keywords *keywords.Set) (int, error) {
+	wg := new(sync.WaitGroup)
+	failure := new(indexFailure)
+	hits := p.process(ctx, t, keywords, wg, failure)
+	wg.Wait()
+	return hits, failure.err
+}
+
+// processOnce indexes a tweet's keyword hits like processNow unless seen
+// reports that a tweet with its source and ID has already been counted, and
+// remembers it once it has. Tweets without IDs are always counted, and only
+// tweets mentioning a keyword are looked up or remembered.
+func (p *processor) processOnce(ctx context.Context, seen Deduplicator, t tweet.Tweet, keywords *keywords.Set) (int, error) {
+	if t.ID == "" || len(keywords.Match(t.Text)) == 0 {
+		return p.processNow(ctx, t, keywords)
+	}
+	source := t.Source
+	if source == "" {
+		source = p.options.Source
+	}
+	counted, err := seen.Seen(ctx, source, t.ID)
+	if err != nil {
+		p.errLogger.Println(err)
+		return 0, err
+	}
+	if counted {
+		return 0, nil
+	}
+	hits, err := p.processNow(ctx, t, keywords)
+	if err != nil || hits == 0 {
+		return hits, err
+	}
+	if err := seen.MarkSeen(ctx, source, t.ID); err != nil {
+		p.errLogger.Println(err)
+	}
+	return hits, nil
+}
+
+// process indexes a tweet's keyword hits in the background, returning the
+// number found. Tweets are counted under their own source if they name one,
+// and the processor's otherwise.
+func (p *processor) process(ctx context.Context, t tweet.Tweet, keywords *keywords.Set, wg *sync.WaitGroup, failure *indexFailure) int {
+	p.logger.Println(t.Text)
+	p.status.tweeted(p.options.Clock.Now())
+	if p.tooLate(t) {
+		p.errLogger.Printf("rejecting tweet %s created at %s: later than %s\n", t.ID, t.CreatedAt, p.options.MaxLateness)
+		return 0
+	}
+	if t.Source == "" {
+		t.Source = p.options.Source
+	}
+	return p.checkAllKeywords(ctx, t, keywords, wg, failure)
+}
+
+func (p *processor) tooLate(t tweet.Tweet) bool {
+	return p.options.MaxLateness > 0 && p.options.Clock.Now().Sub(t.CreatedAt) > p.options.MaxLateness
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// checkAllKeywords indexes a tweet's keyword hits in the background. The
+// writes are not interrupted when ctx is done, so that a tweet being counted
+// at shutdown is counted in full; each call to Redis has its own deadline.
+func (p *processor) checkAllKeywords(ctx context.Context, t tweet.Tweet, keywords *keywords.Set, wg *sync.WaitGroup, failure *indexFailure) int {
+	ctx = context.WithoutCancel(ctx)
+	found := keywords.Match(t.Text)
+	if p.suppressor != nil && len(found) > 0 {
+		found = p.suppress(ctx, t, found, wg)
+	}
+	if len(found) == 0 {
+		return 0
+	}
+	sample := t
+	if p.options.SampleIDsOnly {
+		sample.Text = ""
+	}
+	wg.Add(1)
+	go p.indexTweet(ctx, t, found, sample, wg, failure)
+	return len(found)
+}
+
+// indexTweet counts a tweet's keyword hits in a single write, so that a tweet
+// redelivered after failing to count is never counted in part twice. Its
+// sentiment, sample, author, co-occurrences and related terms are indexed
+// only once the counts are stored, so that none of them is stored for a tweet
+// that will be redelivered.
+func (p *processor) indexTweet(ctx context.Context, t tweet.Tweet, found []string, sample tweet.Tweet, done *sync.WaitGroup, failure *indexFailure) {
+	defer done.Done()
+	if err := p.index.IndexWordsAt(ctx, t.Source, found, t.CreatedAt); err != nil {
+		p.errLogger.Println(err)
+		failure.record(err)
+		return
+	}
+	score := p.scorer.Score(t.Text)
+	tweetTerms := terms(t.Text)
+	for _, keyword := range found {
+		if p.related != nil {
+			p.related.add(keyword, tweetTerms)
+		}
+		done.Add(1)
+		go p.indexKeyword(ctx, keyword, t.CreatedAt, score, sample, done)
+	}
+	done.Add(1)
+	go p.indexCooccurrences(ctx, t.Source, found, t.CreatedAt, done)
+}
+
+func (p *processor) indexKeyword(ctx context.Context, wordToIndex string, at time.Time, score int, sample tweet.Tweet, done *sync.WaitGroup) {
+	defer done.Done()
+	if err := p.index.IndexSentiment(ctx, wordToIndex, score, at); err != nil {
+		p.errLogger.Println(err)
+	}
+	if err := p.index.IndexSample(ctx, wordToIndex, sample); err != nil {
+		p.errLogger.Println(err)
+	}
+	if sample.AuthorID != "" {
+		if err := p.index.IndexAuthor(ctx, sample.Source, wordToIndex, sample.AuthorID, at); err != nil {
+			p.errLogger.Println(err)
+		}
+	}
+}
+
+// suppress returns the keywords found in a tweet that should be counted,
+// tallying the hits that are suppressed as spam.
+func (p *processor) suppress(ctx context.Context, t tweet.Tweet, found []string, wg *sync.WaitGroup) []string {
+	counted, suppressed, reason := p.suppressor.Filter(t, found, p.options.Clock.Now())
+	for _, keyword := range suppressed {
+		wg.Add(1)
+		go p.indexSuppressed(ctx, keyword, reason, t.CreatedAt, wg)
+	}
+	return counted
+}
+
+func (p *processor) indexSuppressed(ctx context.Context, keyword string, reason suppress.Reason, at time.Time, done *sync.WaitGroup) {
+	defer done.Done()
+	if err := p.index.IndexSuppressed(ctx, keyword, string(reason), at); err != nil {
+		p.errLogger.Println(err)
+	}
+}
+
+func (p *processor) indexCooccurrences(ctx context.Context, source string, words []string, at time.Time, done *sync.WaitGroup) {
+	defer done.Done()
+	if err := p.index.IndexCooccurrences(ctx, source, words, at); err != nil {
+		p.errLogger.Println(err)
+	}
+}
+
+// indexFailure records the first error counting a tweet's keywords. A nil
+// indexFailure ignores errors.
+type indexFailure struct {
+	sync.Mutex
+	err error
+}
+
+func (f *indexFailure) record(err error) {
+	if f == nil {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
@@ -0,0 +1,114 @@
+package gatherer
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/topk"
+)
+
+const (
+	relatedTermsCapacity = 100
+	relatedTermsTop      = 20
+
+	relatedTermsInterval = time.Minute
+	relatedTermsWindow   = time.Hour
+)
+
+// relatedTerms tracks the terms most frequently found in tweets containing
+// each keyword, using a space-bounded sketch per keyword for the current
+// window and another for the window before it, so that the terms reported
+// always cover at least a full window.
+type relatedTerms struct {
+	sync.Mutex
+	current  map[string]*topk.SpaceSaving
+	previous map[string]*topk.SpaceSaving
+}
+
+func newRelatedTerms() *relatedTerms {
+	return &relatedTerms{
+		current:  make(map[string]*topk.SpaceSaving),
+		previous: make(map[string]*topk.SpaceSaving),
+	}
+}
+
+func (r *relatedTerms) add(keyword string, tweetTerms []string) {
+	r.Lock()
+	defer r.Unlock()
+	sketch, ok := r.current[keyword]
+	if !ok {
+		sketch = topk.NewSpaceSaving(relatedTermsCapacity)
+		r.current[keyword] = sketch
+	}
+	own := strings.Fields(strings.ToLower(keyword))
+	for _, term := range tweetTerms {
+		if !contains(own, term) {
+			sketch.Add(term)
+		}
+	}
+}
+
+// top returns the related terms of each keyword over the current and previous
+// windows.
+func (r *relatedTerms) top() map[string][]topk.Item {
+	r.Lock()
+	defer r.Unlock()
+	windows := make(map[string][][]topk.Item)
+	for _, sketches := range []map[string]*topk.SpaceSaving{r.current, r.previous} {
+		for keyword, sketch := range sketches {
+			windows[keyword] = append(windows[keyword], sketch.Top(relatedTermsCapacity))
+		}
+	}
+	top := make(map[string][]topk.Item)
+	for keyword, items := range windows {
+		top[keyword] = topk.Merge(relatedTermsTop, items...)
+	}
+	return top
+}
+
+// rotate starts a new window, forgetting the terms of the window before the
+// one that just ended.
+func (r *relatedTerms) rotate() {
+	r.Lock()
+	defer r.Unlock()
+	r.previous = r.current
+	r.current = make(map[string]*topk.SpaceSaving)
+}
+
+func (p *processor) persistRelatedTermsPeriodically(ctx context.Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(relatedTermsInterval)
+	defer ticker.Stop()
+	ticks := 0
+	for {
+		select {
+		case <-ticker.C:
+			p.persistRelatedTerms(ctx)
+			ticks++
+			if time.Duration(ticks)*relatedTermsInterval >= relatedTermsWindow {
+				p.related.rotate()
+				ticks = 0
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *processor) persistRelatedTerms(ctx context.Context) {
+	for keyword, terms := range p.related.top() {
+		if err := p.index.IndexRelated(ctx, keyword, terms); err != nil {
+			p.errLogger.Println(err)
+		}
+	}
+}
+
+func contains(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package gatherer
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/craigfurman/bovine/keywords"
+)
+
+// rollingExpiryInterval is how long an occurrence can stay in a rolling count
+// after it has aged out of the period.
+const rollingExpiryInterval = 5 * time.Second
+
+type RollingCounter interface {
+	ExpireRolling(ctx context.Context, word string) (int, error)
+}
+
+// RollingExpirer removes occurrences of keywords from their rolling counts
+// for each period as they age out of it.
+type RollingExpirer struct {
+	counter   RollingCounter
+	keywords  *keywords.Set
+	errLogger *log.Logger
+}
+
+func NewRollingExpirer(counter RollingCounter, keywords *keywords.Set) *RollingExpirer {
+	return &RollingExpirer{
+		counter:   counter,
+		keywords:  keywords,
+		errLogger: log.New(os.Stderr, "gatherer error: ", log.LstdFlags),
+	}
+}
+
+// Expire expires every keyword, stopping at the first that fails.
+func (e *RollingExpirer) Expire(ctx context.Context) error {
+	for _, keyword := range e.keywords.Names() {
+		if _, err := e.counter.ExpireRolling(ctx, keyword); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpirePeriodically expires every keyword every few seconds until ctx is
+// done.
+func (e *RollingExpirer) ExpirePeriodically(ctx context.Context) {
+	ticker := time.NewTicker(rollingExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Expire(ctx); err != nil && ctx.Err() == nil {
+				e.errLogger.Printf("expiring rolling counts: %s\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package gatherer_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/craigfurman/bovine/gatherer"
+	"github.com/craigfurman/bovine/keywords"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeRollingCounter struct {
+	expired []string
+	err     error
+}
+
+func (c *fakeRollingCounter) ExpireRolling(_ context.Context, word string) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.expired = append(c.expired, word)
+	return 1, nil
+}
+
+var _ = Describe("expiring rolling counts", func() {
+
+	var (
+		counter *fakeRollingCounter
+		expirer *gatherer.RollingExpirer
+	)
+
+	BeforeEach(func() {
+		counter = &fakeRollingCounter{}
+		pythonAndRuby, err := keywords.New(map[string]keywords.Definition{
+			"python": {Phrases: []string{"python"}},
+			"ruby":   {Phrases: []string{"ruby"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		expirer = gatherer.NewRollingExpirer(counter, pythonAndRuby)
+	})
+
+	It("expires every keyword", func() {
+		Expect(expirer.Expire(ctx)).To(Succeed())
+		Expect(counter.expired).To(ConsistOf("python", "ruby"))
+	})
+
+	It("returns the error if expiring fails", func() {
+		counter.err = errors.New("o no!")
+		Expect(expirer.Expire(ctx)).To(MatchError("o no!"))
+	})
+})
@@ -0,0 +1,143 @@
+package gatherer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/spool"
+)
+
+const replayInterval = time.Second
+
+// SpoolingIndexer keeps keyword counts that the index fails to store in a
+// local spool, and replays them in order, at the times they were counted,
+// once the index recovers. While counts are waiting to be replayed, new
+// counts are spooled behind them. Other writes are passed straight through.
+type SpoolingIndexer struct {
+	Indexer
+	mutex     sync.Mutex
+	spool     *spool.Spool
+	logger    *log.Logger
+	errLogger *log.Logger
+}
+
+func NewSpoolingIndexer(index Indexer, spool *spool.Spool) *SpoolingIndexer {
+	return &SpoolingIndexer{
+		Indexer:   index,
+		spool:     spool,
+		errLogger: log.New(os.Stderr, "gatherer error: ", log.LstdFlags),
+		logger:    log.New(os.Stdout, "gatherer: ", log.LstdFlags),
+	}
+}
+
+// IndexWordAt spools the count if the index fails to store it without having
+// tried, so that replaying it cannot count it twice. Other errors, such as a
+// timeout after the write was sent, are returned. While counts are spooled,
+// new counts are spooled behind them, so that none overtakes a count spooled
+// before it.
+func (i *SpoolingIndexer) IndexWordAt(ctx context.Context, source, word string, t time.Time) error {
+	return i.IndexWordsAt(ctx, source, []string{word}, t)
+}
+
+// IndexWordsAt counts each of words as IndexWordAt does, storing or spooling
+// them together. The spool is only locked to check whether it is empty or to
+// append to it, so counts stored straight through do not wait on each other.
+func (i *SpoolingIndexer) IndexWordsAt(ctx context.Context, source string, words []string, t time.Time) error {
+	if spooled, err := i.spoolIfWaiting(source, words, t); spooled || err != nil {
+		return err
+	}
+	err := i.Indexer.IndexWordsAt(ctx, source, words, t)
+	if err == nil || !unapplied(err) {
+		return err
+	}
+	i.errLogger.Printf("spooling counts of %s: %s\n", strings.Join(words, ", "), err)
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.append(source, words, t)
+}
+
+// spoolIfWaiting spools words behind the counts waiting to be replayed, if
+// there are any, reporting whether it did.
+func (i *SpoolingIndexer) spoolIfWaiting(source string, words []string, t time.Time) (bool, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.spool.Depth() == 0 {
+		return false, nil
+	}
+	return true, i.append(source, words, t)
+}
+
+func (i *SpoolingIndexer) append(source string, words []string, t time.Time) error {
+	for _, word := range words {
+		if err := i.spool.Append(spool.Record{Source: source, Word: word, At: t}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unapplied reports whether err means a write was never sent to the index:
+// the circuit breaker rejected it, or no connection could be made.
+func unapplied(err error) bool {
+	var open *breaker.OpenError
+	if errors.As(err, &open) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Depth returns the number of counts waiting to be replayed.
+func (i *SpoolingIndexer) Depth() int {
+	return i.spool.Depth()
+}
+
+// Replay stores the spooled counts, stopping at the first the index fails to
+// store without having tried, or when ctx is done. As when storing counts
+// straight through, a count that fails after it may have been stored, such as
+// on a timeout, is logged and not replayed again, so that it cannot be
+// counted twice.
+func (i *SpoolingIndexer) Replay(ctx context.Context) error {
+	if i.spool.Depth() == 0 {
+		return nil
+	}
+	replayed, err := i.spool.Replay(func(r spool.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := i.Indexer.IndexWordAt(ctx, r.Source, r.Word, r.At)
+		if err != nil && !unapplied(err) {
+			i.errLogger.Printf("dropping spooled count of %s, which may have been stored: %s\n", r.Word, err)
+			return nil
+		}
+		return err
+	})
+	if replayed > 0 {
+		i.logger.Printf("replayed %d spooled counts, %d left\n", replayed, i.spool.Depth())
+	}
+	return err
+}
+
+// ReplayPeriodically replays the spooled counts every second until ctx is
+// done.
+func (i *SpoolingIndexer) ReplayPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := i.Replay(ctx); err != nil && ctx.Err() == nil {
+				i.errLogger.Printf("replaying spool: %s\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
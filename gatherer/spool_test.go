@@ -0,0 +1,133 @@
+package gatherer_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/gatherer"
+	"github.com/craigfurman/bovine/spool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("spooling counts while the index is down", func() {
+
+	var (
+		dir     string
+		s       *spool.Spool
+		index   *flakyIndexer
+		spooled *gatherer.SpoolingIndexer
+		at      time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spool")
+		Expect(err).NotTo(HaveOccurred())
+		s, err = spool.Open(filepath.Join(dir, "counts.spool"), spool.FsyncNever)
+		Expect(err).NotTo(HaveOccurred())
+		index = &flakyIndexer{fakeIndexer: newFakeIndexer()}
+		spooled = gatherer.NewSpoolingIndexer(index, s)
+		at = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	AfterEach(func() {
+		s.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("stores counts straight away while the index is up", func() {
+		Expect(spooled.IndexWordAt(ctx, "twitter", "python", at)).To(Succeed())
+		Expect(index.argCount).To(Equal(map[string]int{"python": 1}))
+		Expect(spooled.Depth()).To(BeZero())
+	})
+
+	It("spools counts the index fails to store, and those after them, until replayed", func() {
+		index.failures = 1
+		Expect(spooled.IndexWordAt(ctx, "twitter", "python", at)).To(Succeed())
+		Expect(spooled.IndexWordAt(ctx, "mastodon", "ruby", at.Add(time.Second))).To(Succeed())
+		Expect(index.argCount).To(BeEmpty())
+		Expect(spooled.Depth()).To(Equal(2))
+
+		Expect(spooled.Replay(ctx)).To(Succeed())
+		Expect(index.argCount).To(Equal(map[string]int{"python": 1, "ruby": 1}))
+		Expect(index.sources).To(Equal(map[string]int{"twitter": 1, "mastodon": 1}))
+		Expect(index.indexedAt).To(HaveLen(2))
+		Expect(index.indexedAt[0]).To(BeTemporally("==", at))
+		Expect(index.indexedAt[1]).To(BeTemporally("==", at.Add(time.Second)))
+		Expect(spooled.Depth()).To(BeZero())
+
+		Expect(spooled.IndexWordAt(ctx, "twitter", "go", at)).To(Succeed())
+		Expect(index.argCount["go"]).To(Equal(1))
+	})
+
+	It("returns errors from counts that may have been stored, rather than spooling them", func() {
+		index.failures = 1
+		index.err = breaker.ErrTimeout
+		Expect(spooled.IndexWordAt(ctx, "twitter", "python", at)).To(MatchError(breaker.ErrTimeout))
+		Expect(spooled.Depth()).To(BeZero())
+	})
+
+	It("spools counts that could not connect to the index", func() {
+		index.failures = 1
+		index.err = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		Expect(spooled.IndexWordAt(ctx, "twitter", "python", at)).To(Succeed())
+		Expect(spooled.Depth()).To(Equal(1))
+	})
+
+	It("keeps counts spooled while the index is still down", func() {
+		index.failures = 2
+		Expect(spooled.IndexWordAt(ctx, "twitter", "python", at)).To(Succeed())
+		Expect(spooled.Replay(ctx)).NotTo(Succeed())
+		Expect(spooled.Depth()).To(Equal(1))
+
+		Expect(spooled.Replay(ctx)).To(Succeed())
+		Expect(index.argCount).To(Equal(map[string]int{"python": 1}))
+	})
+
+	It("does not replay counts that may have been stored, and replays those after them", func() {
+		index.failures = 1
+		Expect(spooled.IndexWordAt(ctx, "twitter", "python", at)).To(Succeed())
+		Expect(spooled.IndexWordAt(ctx, "twitter", "ruby", at)).To(Succeed())
+
+		index.failures = 1
+		index.err = breaker.ErrTimeout
+		Expect(spooled.Replay(ctx)).To(Succeed())
+		Expect(index.argCount).To(Equal(map[string]int{"ruby": 1}))
+		Expect(spooled.Depth()).To(BeZero())
+	})
+
+	It("does not hold up other counts while one is being stored", func() {
+		slow := &slowIndexer{fakeIndexer: index.fakeIndexer, release: make(chan struct{})}
+		spooled = gatherer.NewSpoolingIndexer(slow, s)
+		stored := make(chan error)
+		go func() {
+			stored <- spooled.IndexWordAt(ctx, "slow", "python", at)
+		}()
+
+		Expect(spooled.IndexWordAt(ctx, "twitter", "ruby", at)).To(Succeed())
+		Consistently(stored).ShouldNot(Receive())
+		close(slow.release)
+		Eventually(stored).Should(Receive(BeNil()))
+	})
+})
+
+// slowIndexer stores counts from the source "slow" only once released.
+type slowIndexer struct {
+	*fakeIndexer
+	release chan struct{}
+}
+
+func (i *slowIndexer) IndexWordsAt(ctx context.Context, source string, words []string, t time.Time) error {
+	if source == "slow" {
+		<-i.release
+	}
+	return i.fakeIndexer.IndexWordsAt(ctx, source, words, t)
+}
@@ -0,0 +1,60 @@
+package gatherer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/health"
+)
+
+// streamStatusInterval is how often the stream status is reported, often
+// enough that it does not expire between reports.
+const streamStatusInterval = health.StreamStatusTTL / 3
+
+type streamStatus struct {
+	sync.Mutex
+	stream health.Stream
+}
+
+func (s *streamStatus) connected(connected bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.stream.Connected = connected
+}
+
+func (s *streamStatus) tweeted(at time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.stream.LastTweet = at
+}
+
+func (s *streamStatus) get() health.Stream {
+	s.Lock()
+	defer s.Unlock()
+	return s.stream
+}
+
+// Status returns the state of the stream read by this source.
+func (p *processor) Status() health.Stream {
+	return p.status.get()
+}
+
+func (p *processor) reportStreamPeriodically(ctx context.Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(streamStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.reportStream(ctx)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *processor) reportStream(ctx context.Context) {
+	if err := p.index.ReportStream(ctx, p.status.get()); err != nil {
+		p.errLogger.Println(err)
+	}
+}
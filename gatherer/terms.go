@@ -0,0 +1,22 @@
+package gatherer
+
+import (
+	"strings"
+
+	"github.com/craigfurman/bovine/tokenize"
+)
+
+const minTermLength = 3
+
+// terms splits tweet text into words and hashtags, skipping short words and
+// common English stop words.
+func terms(text string) []string {
+	var found []string
+	for _, word := range tokenize.Words(text) {
+		if len([]rune(strings.TrimPrefix(word, "#"))) < minTermLength || tokenize.IsStopWord(word) {
+			continue
+		}
+		found = append(found, word)
+	}
+	return found
+}
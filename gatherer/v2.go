@@ -0,0 +1,228 @@
+package gatherer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/craigfurman/bovine/keywords"
+	"github.com/craigfurman/bovine/tweet"
+)
+
+// V2Client streams tweets matching the tracked keywords from the Twitter API
+// v2 filtered stream, authenticating with an app's bearer token. Unlike v1.1,
+// the v2 stream is filtered by rules stored against the app, one per keyword.
+type V2Client struct {
+	*processor
+	bearerToken string
+	baseURL     string
+	httpClient  *http.Client
+}
+
+// Rule is a v2 filtered stream rule, tagged with the keyword it tracks.
+type Rule struct {
+	ID    string `json:"id,omitempty"`
+	Value string `json:"value"`
+	Tag   string `json:"tag"`
+}
+
+func NewV2(index Indexer, bearerToken, baseURL string, options Options) *V2Client {
+	return &V2Client{
+		processor:   newProcessor(index, options, "twitter"),
+		bearerToken: bearerToken,
+		baseURL:     baseURL,
+		httpClient:  http.DefaultClient,
+	}
+}
+
+// Stream updates the stream rules to match the tracked keywords, then indexes
+// tweets until the stream ends or ctx is done.
+func (client *V2Client) Stream(ctx context.Context, keywords *keywords.Set) {
+	if err := client.SyncRules(ctx, keywords); err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	response, err := client.request(ctx, "GET", "/2/tweets/search/stream?tweet.fields=created_at,lang,author_id", nil)
+	if err != nil {
+		client.errLogger.Println(err)
+		return
+	}
+	defer response.Body.Close()
+	client.stream(ctx, response.Body, keywords, parseV2Tweet)
+}
+
+// SyncRules deletes the stream rules that no longer match a tracked keyword,
+// and adds rules for keywords that are not yet tracked.
+func (client *V2Client) SyncRules(ctx context.Context, keywords *keywords.Set) error {
+	existing, err := client.Rules(ctx)
+	if err != nil {
+		return err
+	}
+	wanted := rules(keywords)
+	var stale []string
+	for _, rule := range existing {
+		if !containsRule(wanted, rule) {
+			stale = append(stale, rule.ID)
+		}
+	}
+	var missing []Rule
+	for _, rule := range wanted {
+		if !containsRule(existing, rule) {
+			missing = append(missing, rule)
+		}
+	}
+	if len(stale) > 0 {
+		if err := client.updateRules(ctx, map[string]interface{}{"delete": map[string][]string{"ids": stale}}); err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		if err := client.updateRules(ctx, map[string]interface{}{"add": missing}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rules returns the stream rules currently stored against the app.
+func (client *V2Client) Rules(ctx context.Context) ([]Rule, error) {
+	response, err := client.request(ctx, "GET", "/2/tweets/search/stream/rules", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var body struct {
+		Data []Rule `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&body)
+	return body.Data, err
+}
+
+// updateRules adds or deletes stream rules, returning an error if any of the
+// rules are rejected, such as for being invalid or too long.
+func (client *V2Client) updateRules(ctx context.Context, update interface{}) error {
+	encoded, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	response, err := client.request(ctx, "POST", "/2/tweets/search/stream/rules", encoded)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var body struct {
+		Errors []struct {
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+			Value  string `json:"value"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return err
+	}
+	if len(body.Errors) == 0 {
+		return nil
+	}
+	rejections := make([]string, len(body.Errors))
+	for i, rejection := range body.Errors {
+		rejections[i] = fmt.Sprintf("%s %q", rejection.Title, rejection.Value)
+		if rejection.Detail != "" {
+			rejections[i] += ": " + rejection.Detail
+		}
+	}
+	return fmt.Errorf("stream rules rejected: %s", strings.Join(rejections, "; "))
+}
+
+// request sends an authenticated request, returning an error unless the
+// response is successful.
+func (client *V2Client) request(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, client.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+client.bearerToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	response, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, response.Status, message)
+	}
+	return response, nil
+}
+
+// rules returns a rule per keyword, matching any of its phrases or hashtags.
+// Patterns cannot be expressed as rules, so as with the v1.1 track parameter
+// they only match tweets streamed because of some other literal.
+func rules(keywords *keywords.Set) []Rule {
+	var rules []Rule
+	for name, literals := range keywords.Literals() {
+		if len(literals) == 0 {
+			continue
+		}
+		terms := make([]string, len(literals))
+		for i, literal := range literals {
+			terms[i] = ruleTerm(literal)
+		}
+		rules = append(rules, Rule{Value: strings.Join(terms, " OR "), Tag: name})
+	}
+	sort.Sort(byTag(rules))
+	return rules
+}
+
+// ruleTerm quotes phrases of several words, which would otherwise match
+// tweets containing each of the words anywhere.
+func ruleTerm(literal string) string {
+	if strings.ContainsAny(literal, " \t") {
+		return fmt.Sprintf("%q", literal)
+	}
+	return literal
+}
+
+func containsRule(rules []Rule, rule Rule) bool {
+	for _, r := range rules {
+		if r.Value == rule.Value && r.Tag == rule.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseV2Tweet parses a tweet from the v2 filtered stream, ignoring keep-alive
+// newlines and error messages.
+func parseV2Tweet(line []byte, clock Clock) (tweet.Tweet, bool) {
+	var message struct {
+		Data struct {
+			ID        string `json:"id"`
+			AuthorID  string `json:"author_id"`
+			Text      string `json:"text"`
+			Lang      string `json:"lang"`
+			CreatedAt string `json:"created_at"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(line, &message); err != nil || message.Data.Text == "" {
+		return tweet.Tweet{}, false
+	}
+	createdAt, err := time.Parse(time.RFC3339, message.Data.CreatedAt)
+	if err != nil {
+		createdAt = clock.Now()
+	}
+	return tweet.Tweet{ID: message.Data.ID, AuthorID: message.Data.AuthorID, Text: message.Data.Text, Lang: message.Data.Lang, CreatedAt: createdAt}, true
+}
+
+type byTag []Rule
+
+func (r byTag) Len() int           { return len(r) }
+func (r byTag) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byTag) Less(i, j int) bool { return r[i].Tag < r[j].Tag }
@@ -0,0 +1,173 @@
+package gatherer_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/craigfurman/bovine/gatherer"
+	"github.com/craigfurman/bovine/keywords"
+
+	"github.com/gorilla/mux"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("streaming from the v2 filtered stream", func() {
+
+	const bearerToken = "bearerToken"
+
+	var (
+		g *gatherer.V2Client
+
+		mockTwitter   *httptest.Server
+		index         *fakeIndexer
+		existingRules []gatherer.Rule
+		ruleUpdates   []map[string]json.RawMessage
+		ruleErrors    []map[string]string
+		streamStatus  int
+
+		pythonAndRuby *keywords.Set
+	)
+
+	BeforeEach(func() {
+		index = newFakeIndexer()
+		existingRules = []gatherer.Rule{
+			{ID: "1", Value: "python", Tag: "python"},
+			{ID: "9", Value: "perl", Tag: "perl"},
+		}
+		ruleUpdates = nil
+		ruleErrors = nil
+		streamStatus = http.StatusOK
+
+		var err error
+		pythonAndRuby, err = keywords.New(map[string]keywords.Definition{
+			"python": {Phrases: []string{"python"}},
+			"ruby":   {Phrases: []string{"ruby"}, Hashtags: []string{"ruby on rails"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		handler := mux.NewRouter()
+		authorized := func(r *http.Request) {
+			Expect(r.Header.Get("Authorization")).To(Equal("Bearer " + bearerToken))
+		}
+		handler.HandleFunc("/2/tweets/search/stream/rules", func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			authorized(r)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": existingRules})
+		}).
+			Methods("GET")
+		handler.HandleFunc("/2/tweets/search/stream/rules", func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			authorized(r)
+			update := make(map[string]json.RawMessage)
+			Expect(json.NewDecoder(r.Body).Decode(&update)).To(Succeed())
+			ruleUpdates = append(ruleUpdates, update)
+			response := map[string]interface{}{"meta": map[string]string{"sent": "2022-03-03T21:08:19.000Z"}}
+			if _, adding := update["add"]; adding && len(ruleErrors) > 0 {
+				response["errors"] = ruleErrors
+			}
+			json.NewEncoder(w).Encode(response)
+		}).
+			Methods("POST")
+		handler.HandleFunc("/2/tweets/search/stream", func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			authorized(r)
+			Expect(r.FormValue("tweet.fields")).To(ContainSubstring("created_at"))
+			Expect(r.FormValue("tweet.fields")).To(ContainSubstring("author_id"))
+			cwd, err := os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			sample, err := ioutil.ReadFile(filepath.Join(cwd, "assets", "sample-v2"))
+			Expect(err).NotTo(HaveOccurred())
+			w.WriteHeader(streamStatus)
+			w.Write(sample)
+		}).
+			Methods("GET")
+		mockTwitter = httptest.NewServer(handler)
+		g = gatherer.NewV2(index, bearerToken, mockTwitter.URL, gatherer.Options{})
+	})
+
+	AfterEach(func() {
+		mockTwitter.Close()
+	})
+
+	It("replaces stale rules with one per tracked keyword", func() {
+		Expect(g.SyncRules(ctx, pythonAndRuby)).To(Succeed())
+		Expect(ruleUpdates).To(HaveLen(2))
+		Expect(ruleUpdates[0]).To(HaveKeyWithValue("delete", MatchJSON(`{"ids": ["9"]}`)))
+		Expect(ruleUpdates[1]).To(HaveKeyWithValue("add", MatchJSON(`[{"value": "ruby OR \"#ruby on rails\"", "tag": "ruby"}]`)))
+	})
+
+	Context("when rules are rejected", func() {
+
+		BeforeEach(func() {
+			ruleErrors = []map[string]string{{
+				"value":  "ruby OR \"#ruby on rails\"",
+				"title":  "UnprocessableEntity",
+				"detail": "Rule has invalid syntax",
+			}}
+		})
+
+		It("returns an error describing them", func() {
+			err := g.SyncRules(ctx, pythonAndRuby)
+			Expect(err).To(MatchError(ContainSubstring("UnprocessableEntity")))
+			Expect(err).To(MatchError(ContainSubstring("Rule has invalid syntax")))
+		})
+	})
+
+	Context("when the rules already match the tracked keywords", func() {
+
+		BeforeEach(func() {
+			existingRules = []gatherer.Rule{
+				{ID: "1", Value: "python", Tag: "python"},
+				{ID: "2", Value: "ruby OR \"#ruby on rails\"", Tag: "ruby"},
+			}
+		})
+
+		It("leaves them alone", func() {
+			Expect(g.SyncRules(ctx, pythonAndRuby)).To(Succeed())
+			Expect(ruleUpdates).To(BeEmpty())
+		})
+	})
+
+	It("counts keywords in tweets from the stream, skipping keep-alives and errors", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.argCount).To(Equal(map[string]int{"python": 2, "ruby": 2}))
+		Expect(index.cooccurrences).To(ContainElement(ConsistOf("python", "ruby")))
+	})
+
+	It("counts each tweet at the time it was tweeted", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.indexedAt).To(ContainElement(BeTemporally("==", time.Date(2022, 3, 3, 21, 8, 19, 0, time.UTC))))
+		ids := []string{}
+		for _, sample := range index.samples["ruby"] {
+			ids = append(ids, sample.ID)
+		}
+		Expect(ids).To(ConsistOf("1500000000000000002", "1500000000000000003"))
+	})
+
+	It("records the author of each tweet", func() {
+		g.Stream(ctx, pythonAndRuby)
+		Expect(index.authors["python"]).To(ContainElement("twitter:11"))
+		Expect(index.authors["python"]).To(ContainElement("twitter:12"))
+	})
+
+	Context("when the stream cannot be connected", func() {
+
+		BeforeEach(func() {
+			streamStatus = http.StatusTooManyRequests
+		})
+
+		It("does not index anything", func() {
+			g.Stream(ctx, pythonAndRuby)
+			Expect(index.argCount).To(BeEmpty())
+			Expect(index.streams).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,15 @@
+package health
+
+import "time"
+
+// StreamStatusTTL is how long a reported stream status is believed for. A
+// gatherer that stops reporting is assumed to be disconnected.
+const StreamStatusTTL = 30 * time.Second
+
+// Stream is the state of the stream of posts from a source such as Twitter,
+// as last reported by the gatherer leading that source.
+type Stream struct {
+	Source    string    `json:"source"`
+	Connected bool      `json:"connected"`
+	LastTweet time.Time `json:"lastTweet"`
+}
@@ -0,0 +1,281 @@
+package indexer
+
+import (
+	"context"
+	"time"
+
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/discovery"
+	"github.com/craigfurman/bovine/health"
+	"github.com/craigfurman/bovine/period"
+	"github.com/craigfurman/bovine/sentiment"
+	"github.com/craigfurman/bovine/topk"
+	"github.com/craigfurman/bovine/tweet"
+)
+
+// Guarded makes the calls to Redis of the repository it decorates through a
+// circuit breaker, with a deadline for each call and retries for those that
+// are safe to repeat. Counts and tallies are incremented at most once, so
+// they are never retried; replacing a value or reading one is.
+type Guarded struct {
+	*WordCountRepository
+	breaker *breaker.Breaker
+}
+
+func NewGuarded(repo *WordCountRepository, policy breaker.Policy) *Guarded {
+	return &Guarded{WordCountRepository: repo, breaker: breaker.New(policy)}
+}
+
+// BreakerStats returns the state of the circuit breaker and counts of the
+// calls it has timed out, retried and rejected.
+func (g *Guarded) BreakerStats() breaker.Stats {
+	return g.breaker.Stats()
+}
+
+func (g *Guarded) IndexWord(ctx context.Context, s string) error {
+	return g.write(ctx, func(ctx context.Context) error { return g.WordCountRepository.IndexWord(ctx, s) })
+}
+
+func (g *Guarded) IndexWordAt(ctx context.Context, source, word string, t time.Time) error {
+	return g.write(ctx, func(ctx context.Context) error { return g.WordCountRepository.IndexWordAt(ctx, source, word, t) })
+}
+
+func (g *Guarded) IndexWordsAt(ctx context.Context, source string, words []string, t time.Time) error {
+	return g.write(ctx, func(ctx context.Context) error { return g.WordCountRepository.IndexWordsAt(ctx, source, words, t) })
+}
+
+func (g *Guarded) IndexCooccurrences(ctx context.Context, source string, words []string, t time.Time) error {
+	return g.write(ctx, func(ctx context.Context) error {
+		return g.WordCountRepository.IndexCooccurrences(ctx, source, words, t)
+	})
+}
+
+func (g *Guarded) IndexSentiment(ctx context.Context, word string, score int, t time.Time) error {
+	return g.write(ctx, func(ctx context.Context) error { return g.WordCountRepository.IndexSentiment(ctx, word, score, t) })
+}
+
+func (g *Guarded) IndexSample(ctx context.Context, word string, t tweet.Tweet) error {
+	return g.write(ctx, func(ctx context.Context) error { return g.WordCountRepository.IndexSample(ctx, word, t) })
+}
+
+// IndexAuthor is retried: adding an author again leaves the HyperLogLog as it
+// was.
+func (g *Guarded) IndexAuthor(ctx context.Context, source, word, authorID string, t time.Time) error {
+	return g.replace(ctx, func(ctx context.Context) error {
+		return g.WordCountRepository.IndexAuthor(ctx, source, word, authorID, t)
+	})
+}
+
+func (g *Guarded) IndexSuppressed(ctx context.Context, word, reason string, t time.Time) error {
+	return g.write(ctx, func(ctx context.Context) error { return g.WordCountRepository.IndexSuppressed(ctx, word, reason, t) })
+}
+
+func (g *Guarded) IndexRelated(ctx context.Context, word string, terms []topk.Item) error {
+	return g.replace(ctx, func(ctx context.Context) error { return g.WordCountRepository.IndexRelated(ctx, word, terms) })
+}
+
+func (g *Guarded) Count(ctx context.Context, word string, since time.Time) (uint, error) {
+	count, err := g.read(ctx, func(ctx context.Context) (interface{}, error) { return g.WordCountRepository.Count(ctx, word, since) })
+	if err != nil {
+		return 0, err
+	}
+	return count.(uint), nil
+}
+
+func (g *Guarded) CountBetween(ctx context.Context, word string, since, until time.Time) (uint, error) {
+	count, err := g.read(ctx, func(ctx context.Context) (interface{}, error) {
+		return g.WordCountRepository.CountBetween(ctx, word, since, until)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.(uint), nil
+}
+
+func (g *Guarded) CountRolling(ctx context.Context, word string, p period.Period) (uint, error) {
+	count, err := g.read(ctx, func(ctx context.Context) (interface{}, error) {
+		return g.WordCountRepository.CountRolling(ctx, word, p)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.(uint), nil
+}
+
+// ExpireRolling is retried: an attempt that was applied moves the watermarks
+// up, so repeating it expires nothing twice.
+func (g *Guarded) ExpireRolling(ctx context.Context, word string) (int, error) {
+	expired, err := g.breaker.Do(ctx, true, func(ctx context.Context) (interface{}, error) {
+		return g.WordCountRepository.ExpireRolling(ctx, word)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired.(int), nil
+}
+
+func (g *Guarded) CountAuthors(ctx context.Context, word string, since time.Time) (uint, error) {
+	count, err := g.read(ctx, func(ctx context.Context) (interface{}, error) {
+		return g.WordCountRepository.CountAuthors(ctx, word, since)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.(uint), nil
+}
+
+func (g *Guarded) Suppressed(ctx context.Context, word string, since time.Time) (map[string]uint, error) {
+	counts, err := g.read(ctx, func(ctx context.Context) (interface{}, error) {
+		return g.WordCountRepository.Suppressed(ctx, word, since)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts.(map[string]uint), nil
+}
+
+func (g *Guarded) CountBySource(ctx context.Context, word string, since time.Time) (map[string]uint, error) {
+	counts, err := g.read(ctx, func(ctx context.Context) (interface{}, error) {
+		return g.WordCountRepository.CountBySource(ctx, word, since)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts.(map[string]uint), nil
+}
+
+func (g *Guarded) CountCooccurrences(ctx context.Context, first, second string, since time.Time) (uint, error) {
+	count, err := g.read(ctx, func(ctx context.Context) (interface{}, error) {
+		return g.WordCountRepository.CountCooccurrences(ctx, first, second, since)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.(uint), nil
+}
+
+func (g *Guarded) CountTweets(ctx context.Context, since time.Time) (uint, error) {
+	count, err := g.read(ctx, func(ctx context.Context) (interface{}, error) { return g.WordCountRepository.CountTweets(ctx, since) })
+	if err != nil {
+		return 0, err
+	}
+	return count.(uint), nil
+}
+
+func (g *Guarded) Sentiment(ctx context.Context, word string, since time.Time) (sentiment.Tally, error) {
+	tally, err := g.read(ctx, func(ctx context.Context) (interface{}, error) {
+		return g.WordCountRepository.Sentiment(ctx, word, since)
+	})
+	if err != nil {
+		return sentiment.Tally{}, err
+	}
+	return tally.(sentiment.Tally), nil
+}
+
+func (g *Guarded) Samples(ctx context.Context, word string) ([]tweet.Tweet, []tweet.Tweet, error) {
+	samples, err := g.read(ctx, func(ctx context.Context) (interface{}, error) {
+		recent, reservoir, err := g.WordCountRepository.Samples(ctx, word)
+		return [2][]tweet.Tweet{recent, reservoir}, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	both := samples.([2][]tweet.Tweet)
+	return both[0], both[1], nil
+}
+
+func (g *Guarded) Related(ctx context.Context, word string) ([]topk.Item, error) {
+	terms, err := g.read(ctx, func(ctx context.Context) (interface{}, error) { return g.WordCountRepository.Related(ctx, word) })
+	if err != nil {
+		return nil, err
+	}
+	return terms.([]topk.Item), nil
+}
+
+func (g *Guarded) IndexCandidates(ctx context.Context, candidates []discovery.Candidate) error {
+	return g.replace(ctx, func(ctx context.Context) error { return g.WordCountRepository.IndexCandidates(ctx, candidates) })
+}
+
+func (g *Guarded) Candidates(ctx context.Context) ([]discovery.Candidate, error) {
+	candidates, err := g.read(ctx, func(ctx context.Context) (interface{}, error) { return g.WordCountRepository.Candidates(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return candidates.([]discovery.Candidate), nil
+}
+
+func (g *Guarded) Promote(ctx context.Context, phrase string) error {
+	return g.replace(ctx, func(ctx context.Context) error { return g.WordCountRepository.Promote(ctx, phrase) })
+}
+
+func (g *Guarded) Promoted(ctx context.Context) ([]string, error) {
+	promoted, err := g.read(ctx, func(ctx context.Context) (interface{}, error) { return g.WordCountRepository.Promoted(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return promoted.([]string), nil
+}
+
+func (g *Guarded) ReportStream(ctx context.Context, status health.Stream) error {
+	return g.replace(ctx, func(ctx context.Context) error { return g.WordCountRepository.ReportStream(ctx, status) })
+}
+
+func (g *Guarded) Streams(ctx context.Context) ([]health.Stream, error) {
+	streams, err := g.read(ctx, func(ctx context.Context) (interface{}, error) { return g.WordCountRepository.Streams(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return streams.([]health.Stream), nil
+}
+
+func (g *Guarded) Cursor(ctx context.Context, source string) (int64, error) {
+	cursor, err := g.read(ctx, func(ctx context.Context) (interface{}, error) { return g.WordCountRepository.Cursor(ctx, source) })
+	if err != nil {
+		return 0, err
+	}
+	return cursor.(int64), nil
+}
+
+func (g *Guarded) SaveCursor(ctx context.Context, source string, cursor int64) error {
+	return g.replace(ctx, func(ctx context.Context) error { return g.WordCountRepository.SaveCursor(ctx, source, cursor) })
+}
+
+func (g *Guarded) Seen(ctx context.Context, source, id string) (bool, error) {
+	seen, err := g.read(ctx, func(ctx context.Context) (interface{}, error) { return g.WordCountRepository.Seen(ctx, source, id) })
+	if err != nil {
+		return false, err
+	}
+	return seen.(bool), nil
+}
+
+func (g *Guarded) MarkSeen(ctx context.Context, source, id string) error {
+	return g.replace(ctx, func(ctx context.Context) error { return g.WordCountRepository.MarkSeen(ctx, source, id) })
+}
+
+func (g *Guarded) Ping(ctx context.Context) error {
+	_, err := g.read(ctx, func(ctx context.Context) (interface{}, error) { return nil, g.WordCountRepository.Ping(ctx) })
+	return err
+}
+
+func (g *Guarded) Cleanup(ctx context.Context, word string, before time.Time) error {
+	return g.replace(ctx, func(ctx context.Context) error { return g.WordCountRepository.Cleanup(ctx, word, before) })
+}
+
+// read makes a call that only reads, retrying it if it fails.
+func (g *Guarded) read(ctx context.Context, call func(context.Context) (interface{}, error)) (interface{}, error) {
+	return g.breaker.Do(ctx, true, call)
+}
+
+// replace makes a call that sets a value regardless of what it was before,
+// and so can be retried.
+func (g *Guarded) replace(ctx context.Context, call func(context.Context) error) error {
+	_, err := g.breaker.Do(ctx, true, func(ctx context.Context) (interface{}, error) { return nil, call(ctx) })
+	return err
+}
+
+// write makes a call that increments a value, which is not retried in case
+// the failed attempt was applied.
+func (g *Guarded) write(ctx context.Context, call func(context.Context) error) error {
+	_, err := g.breaker.Do(ctx, false, func(ctx context.Context) (interface{}, error) { return nil, call(ctx) })
+	return err
+}
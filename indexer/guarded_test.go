@@ -0,0 +1,86 @@
+package indexer_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/indexer"
+	"github.com/craigfurman/bovine/indexer/fakes"
+
+	"github.com/garyburd/redigo/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Guarded", func() {
+
+	var (
+		guarded *indexer.Guarded
+		clock   *fakes.FakeClock
+		ctx     = context.Background()
+		policy  = breaker.Policy{
+			Timeout:   time.Second,
+			Retries:   2,
+			Backoff:   time.Millisecond,
+			Threshold: 3,
+			Cooldown:  time.Minute,
+		}
+	)
+
+	BeforeEach(func() {
+		clock = &fakes.FakeClock{}
+		clock.NowReturns(time.Now())
+	})
+
+	AfterEach(func() {
+		Expect(guarded.Close()).To(Succeed())
+	})
+
+	Context("while redis is available", func() {
+
+		BeforeEach(func() {
+			conn, err := redis.Dial("tcp", "localhost:6379")
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Do("DEL", "guarded")
+			Expect(err).NotTo(HaveOccurred())
+			guarded = indexer.NewGuarded(indexer.New("localhost:6379", clock), policy)
+		})
+
+		It("passes calls through to the repository", func() {
+			Expect(guarded.IndexWord(ctx, "guarded")).To(Succeed())
+			Expect(guarded.Count(ctx, "guarded", time.Now().Add(-time.Minute))).To(Equal(uint(1)))
+			recent, reservoir, err := guarded.Samples(ctx, "guarded")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recent).To(BeEmpty())
+			Expect(reservoir).To(BeEmpty())
+			Expect(guarded.BreakerStats().State).To(Equal(breaker.Closed))
+		})
+	})
+
+	Context("while redis is unreachable", func() {
+
+		BeforeEach(func() {
+			guarded = indexer.NewGuarded(indexer.New("127.0.0.1:1", clock), policy)
+		})
+
+		It("retries reads", func() {
+			_, err := guarded.Count(ctx, "guarded", time.Now())
+			Expect(err).To(HaveOccurred())
+			Expect(guarded.BreakerStats().Retries).To(Equal(uint64(2)))
+		})
+
+		It("does not retry counts", func() {
+			Expect(guarded.IndexWord(ctx, "guarded")).NotTo(Succeed())
+			Expect(guarded.BreakerStats().Retries).To(BeZero())
+		})
+
+		It("opens the breaker and fails fast", func() {
+			guarded.Ping(ctx)
+			Expect(guarded.BreakerStats().State).To(Equal(breaker.Open))
+			err := guarded.IndexWord(ctx, "guarded")
+			Expect(err).To(BeAssignableToTypeOf(&breaker.OpenError{}))
+		})
+	})
+})
@@ -1,66 +1,888 @@
 package indexer
 
 import (
+	"context"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/craigfurman/bovine/discovery"
+	"github.com/craigfurman/bovine/health"
+	"github.com/craigfurman/bovine/period"
+	"github.com/craigfurman/bovine/sentiment"
+	"github.com/craigfurman/bovine/topk"
+	"github.com/craigfurman/bovine/tweet"
+
 	"github.com/garyburd/redigo/redis"
 )
 
+const (
+	tweetsKey     = "cooccurrence:tweets"
+	candidatesKey = "discovery:candidates"
+	promotedKey   = "keywords:promoted"
+	streamsKey    = "gatherer:streams"
+
+	sentimentBucket = time.Hour
+	authorsBucket   = time.Hour
+	suppressBucket  = time.Hour
+	// DefaultSource labels the counts indexed before their sources were
+	// recorded, all of which came from Twitter.
+	DefaultSource = "twitter"
+
+	// SampleSize is the number of tweets kept in each of the recent and
+	// reservoir samples for a keyword.
+	SampleSize = 20
+
+	// SeenTTL is how long the IDs of counted tweets are remembered, and so
+	// how late a redelivered tweet can arrive and still not be counted twice.
+	SeenTTL = 7 * 24 * time.Hour
+)
+
+// reservoirSample implements reservoir sampling (algorithm R): the nth tweet
+// seen replaces a random member of the sample with probability SampleSize/n.
+var reservoirSample = redis.NewScript(2, `
+local seen = redis.call("INCR", KEYS[1])
+local size = tonumber(ARGV[1])
+if seen <= size then
+	redis.call("RPUSH", KEYS[2], ARGV[2])
+else
+	local slot = math.floor(tonumber(ARGV[3]) * seen)
+	if slot < size then
+		redis.call("LSET", KEYS[2], slot, ARGV[2])
+	end
+end
+return seen
+`)
+
+// fenced rejects a write made with a fencing token, ARGV[n], older than the
+// latest stored at KEYS[2]. A token of zero is not fenced.
+const fenced = `
+local token = tonumber(ARGV[%d])
+if token > 0 and tonumber(redis.call("GET", KEYS[2]) or "0") > token then
+	return redis.error_reply("stale fencing token " .. token)
+end
+`
+
+// indexWord adds an occurrence to a word's sorted set, to the sorted set of
+// its occurrences from the occurrence's source, and to its rolling count for
+// each period. KEYS[1] is the sorted set, KEYS[2] the fencing token key,
+// KEYS[3] the source's sorted set and KEYS[4] the set of the word's sources,
+// followed by the count and watermark of each period; ARGV[1] is the
+// occurrence's timestamp, ARGV[2] its member, ARGV[3] the writer's fencing
+// token and ARGV[4] the source, followed by each period's cutoff. A count is
+// only incremented if the occurrence is newer than its watermark, since older
+// occurrences have already aged out. A count that does not exist yet is
+// started from the sorted set.
+var indexWord = redis.NewScript(-1, fmt.Sprintf(fenced, 3)+`
+local added = redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+if added == 1 then
+	redis.call("ZADD", KEYS[3], ARGV[1], ARGV[2])
+	redis.call("SADD", KEYS[4], ARGV[4])
+end
+local at = tonumber(ARGV[1])
+for i = 5, #KEYS, 2 do
+	local cutoff = ARGV[(i - 1) / 2 + 3]
+	local watermark = redis.call("GET", KEYS[i + 1])
+	if not watermark then
+		redis.call("SET", KEYS[i], redis.call("ZCOUNT", KEYS[1], "(" .. cutoff, "+inf"))
+		redis.call("SET", KEYS[i + 1], cutoff)
+	elseif added == 1 and at > tonumber(watermark) then
+		redis.call("INCR", KEYS[i])
+	end
+end
+return added
+`)
+
+// expireRolling decrements a word's rolling count for each period by the
+// occurrences that have aged out of it since it was last expired, and moves
+// its watermark up to the period's cutoff. KEYS and ARGV are as for
+// indexWord, without the occurrence or its source.
+var expireRolling = redis.NewScript(-1, fmt.Sprintf(fenced, 1)+`
+local expired = 0
+for i = 3, #KEYS, 2 do
+	local cutoff = ARGV[(i - 1) / 2 + 1]
+	local watermark = redis.call("GET", KEYS[i + 1])
+	if watermark and tonumber(cutoff) > tonumber(watermark) then
+		local n = redis.call("ZCOUNT", KEYS[1], "(" .. watermark, cutoff)
+		redis.call("DECRBY", KEYS[i], n)
+		redis.call("SET", KEYS[i + 1], cutoff)
+		expired = expired + n
+	end
+end
+return expired
+`)
+
+// cleanupWord deletes a word's occurrences at or before ARGV[2], first
+// decrementing each period's rolling count by those it still includes, the
+// ones newer than its watermark, which expireRolling could no longer find.
+// KEYS are as for expireRolling and ARGV[1] is the writer's fencing token.
+var cleanupWord = redis.NewScript(-1, fmt.Sprintf(fenced, 1)+`
+local before = ARGV[2]
+for i = 3, #KEYS, 2 do
+	local watermark = redis.call("GET", KEYS[i + 1])
+	if watermark and tonumber(before) > tonumber(watermark) then
+		redis.call("DECRBY", KEYS[i], redis.call("ZCOUNT", KEYS[1], "(" .. watermark, before))
+	end
+end
+return redis.call("ZREMRANGEBYSCORE", KEYS[1], 0, before)
+`)
+
 //go:generate counterfeiter . Clock
 type Clock interface {
 	Now() time.Time
 }
 
 type WordCountRepository struct {
-	connPool  *redis.Pool
-	randomSrc *rand.Rand
-	clock     Clock
+	pool        *pool
+	randomSrc   *rand.Rand
+	randomMutex sync.Mutex
+	clock       Clock
+
+	fenceMutex sync.Mutex
+	fenceKey   string
+	fenceToken int64
 }
 
 func New(redisURL string, clock Clock) *WordCountRepository {
-	pool := &redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", redisURL)
-		},
-		IdleTimeout: time.Minute * 1,
-	}
 	return &WordCountRepository{
-		connPool:  pool,
+		pool:      newPool(redisURL),
 		randomSrc: rand.New(rand.NewSource(time.Now().UnixNano())),
 		clock:     clock,
 	}
 }
 
-func (repo *WordCountRepository) IndexWord(s string) error {
-	added, err := redis.Int(repo.connPool.Get().Do("ZADD", s, timestamp(repo.clock.Now()), repo.randomString()))
+// Fence makes counts, expiring rolling counts, and the co-occurrences,
+// sentiment, samples, authors, suppressed hits and related terms indexed
+// alongside counts fail once a leader newer than the holder of token has
+// stored its own token at key, so that a leader that has lost its lease
+// without noticing cannot write alongside its successor.
+func (repo *WordCountRepository) Fence(key string, token int64) {
+	repo.fenceMutex.Lock()
+	defer repo.fenceMutex.Unlock()
+	repo.fenceKey, repo.fenceToken = key, token
+}
+
+func (repo *WordCountRepository) fence() (string, int64) {
+	repo.fenceMutex.Lock()
+	defer repo.fenceMutex.Unlock()
+	return repo.fenceKey, repo.fenceToken
+}
+
+func (repo *WordCountRepository) IndexWord(ctx context.Context, s string) error {
+	return repo.IndexWordAt(ctx, DefaultSource, s, repo.clock.Now())
+}
+
+// IndexWordAt counts an occurrence of word from the named source, such as
+// "twitter" or "file:archive.json", at the specified time rather than now,
+// e.g. when backfilling from an archive of tweets.
+func (repo *WordCountRepository) IndexWordAt(ctx context.Context, source, word string, t time.Time) error {
+	added, err := redis.Int(repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		return indexWord.Do(conn, repo.indexWordArgs(source, word, t)...)
+	}))
+	if err != nil {
+		return err
+	}
 	if added != 1 {
-		return fmt.Errorf("Expected to add 1 member to set %s, added %d", s, added)
+		return fmt.Errorf("Expected to add 1 member to set %s, added %d", word, added)
+	}
+	return nil
+}
+
+// IndexWordsAt counts an occurrence of each of words from the named source at
+// the specified time in a single transaction.
+func (repo *WordCountRepository) IndexWordsAt(ctx context.Context, source string, words []string, t time.Time) error {
+	replies, err := redis.Values(repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		conn.Send("MULTI")
+		for _, word := range words {
+			indexWord.Send(conn, repo.indexWordArgs(source, word, t)...)
+		}
+		return conn.Do("EXEC")
+	}))
+	if err != nil {
+		return err
+	}
+	for i, reply := range replies {
+		added, err := redis.Int(reply, nil)
+		if err != nil {
+			return err
+		}
+		if added != 1 {
+			return fmt.Errorf("Expected to add 1 member to set %s, added %d", words[i], added)
+		}
+	}
+	return nil
+}
+
+// IndexCooccurrences records a single tweet from the named source in which
+// all of words were found at the specified time, counting the tweet itself
+// and every unordered pair of words.
+func (repo *WordCountRepository) IndexCooccurrences(ctx context.Context, source string, words []string, t time.Time) error {
+	keys := []string{tweetsKey}
+	for i, first := range words {
+		for _, second := range words[i+1:] {
+			if first != second {
+				keys = append(keys, cooccurrenceKey(first, second))
+			}
+		}
+	}
+	replies, err := repo.fencedMulti(ctx, func(conn redis.Conn) {
+		for _, key := range keys {
+			conn.Send("ZADD", key, timestamp(t), repo.randomString())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for i, reply := range replies {
+		added, err := redis.Int(reply, nil)
+		if err != nil {
+			return err
+		}
+		if added != 1 {
+			return fmt.Errorf("Expected to add 1 member to set %s, added %d", keys[i], added)
+		}
+	}
+	return nil
+}
+
+// IndexSentiment adds the sentiment score of a tweet containing word to the
+// running tally for the hour containing the specified time. Each hour is kept
+// for as long as the longest period.
+func (repo *WordCountRepository) IndexSentiment(ctx context.Context, word string, score int, t time.Time) error {
+	key := sentimentKey(word, t)
+	_, err := repo.fencedMulti(ctx, func(conn redis.Conn) {
+		conn.Send("HINCRBY", key, "sum", score)
+		conn.Send("HINCRBY", key, sentimentField(score), 1)
+		conn.Send("PEXPIREAT", key, int64(t.Truncate(sentimentBucket).Add(sentimentBucket+period.Week.Window).UnixNano()/int64(time.Millisecond)))
+	})
+	return err
+}
+
+// IndexSample adds a tweet containing word to both the rolling sample of the
+// most recent tweets and the reservoir sample of all tweets seen.
+func (repo *WordCountRepository) IndexSample(ctx context.Context, word string, t tweet.Tweet) error {
+	member, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = repo.fencedMulti(ctx, func(conn redis.Conn) {
+		conn.Send("LPUSH", recentSampleKey(word), member)
+		conn.Send("LTRIM", recentSampleKey(word), 0, SampleSize-1)
+		reservoirSample.Send(conn, sampleSeenKey(word), reservoirSampleKey(word), SampleSize, member, repo.randomFloat())
+	})
+	return err
+}
+
+// IndexAuthor adds the author of a tweet containing word, identified by
+// source and ID, to a HyperLogLog of the authors of the hour containing the
+// specified time. Each hour is kept for as long as the longest period.
+func (repo *WordCountRepository) IndexAuthor(ctx context.Context, source, word, authorID string, t time.Time) error {
+	key := authorsKey(word, t)
+	_, err := repo.fencedMulti(ctx, func(conn redis.Conn) {
+		conn.Send("PFADD", key, source+":"+authorID)
+		conn.Send("PEXPIREAT", key, int64(t.Truncate(authorsBucket).Add(authorsBucket+period.Week.Window).UnixNano()/int64(time.Millisecond)))
+	})
+	return err
+}
+
+// IndexSuppressed counts a hit of word that was not counted, such as one from
+// a spam account, under the reason it was suppressed in a tally for the hour
+// containing the specified time. Each hour is kept for as long as the longest
+// period.
+func (repo *WordCountRepository) IndexSuppressed(ctx context.Context, word, reason string, t time.Time) error {
+	key := suppressedKey(word, t)
+	_, err := repo.fencedMulti(ctx, func(conn redis.Conn) {
+		conn.Send("HINCRBY", key, reason, 1)
+		conn.Send("PEXPIREAT", key, int64(t.Truncate(suppressBucket).Add(suppressBucket+period.Week.Window).UnixNano()/int64(time.Millisecond)))
+	})
+	return err
+}
+
+// IndexRelated replaces the terms most frequently found alongside word.
+func (repo *WordCountRepository) IndexRelated(ctx context.Context, word string, terms []topk.Item) error {
+	encoded, err := json.Marshal(terms)
+	if err != nil {
+		return err
+	}
+	_, err = repo.fencedMulti(ctx, func(conn redis.Conn) {
+		conn.Send("SET", relatedKey(word), encoded)
+	})
+	return err
+}
+
+func (repo *WordCountRepository) Count(ctx context.Context, word string, since time.Time) (uint, error) {
+	return repo.count(ctx, word, since)
+}
+
+// CountBetween returns the number of occurrences of word from the specified
+// time up to, but not including, until. Occurrences are only kept until they
+// are cleaned up.
+func (repo *WordCountRepository) CountBetween(ctx context.Context, word string, since, until time.Time) (uint, error) {
+	count, err := redis.Int(repo.do(ctx, "ZCOUNT", word, timestamp(since), "("+timestamp(until)))
+	return uint(count), err
+}
+
+// CountRolling returns the number of occurrences of word in the period ending
+// now from its rolling count, which is kept up to date as words are indexed
+// and expired with ExpireRolling. If no occurrence has been indexed since
+// rolling counts were introduced, it counts the sorted set instead.
+func (repo *WordCountRepository) CountRolling(ctx context.Context, word string, p period.Period) (uint, error) {
+	count, err := redis.Int(repo.do(ctx, "GET", rollingKey(word, p)))
+	if err == redis.ErrNil {
+		// Rolling counts exclude the cutoff itself, so the sorted set must too.
+		count, err := redis.Int(repo.do(ctx, "ZCOUNT", word, "("+timestamp(p.Since(repo.clock.Now())), "+inf"))
+		return uint(count), err
+	}
+	if err != nil {
+		return 0, err
+	}
+	if count < 0 {
+		count = 0
+	}
+	return uint(count), nil
+}
+
+// ExpireRolling removes the occurrences of word that have aged out of each
+// period from its rolling counts, returning how many it removed. It must run
+// more often than the shortest period, and before the occurrences are cleaned
+// up.
+func (repo *WordCountRepository) ExpireRolling(ctx context.Context, word string) (int, error) {
+	now := repo.clock.Now()
+	fenceKey, token := repo.fence()
+	keysAndArgs := []interface{}{2 + 2*len(period.Standard), word, fenceKey}
+	args := []interface{}{token}
+	for _, p := range period.Standard {
+		keysAndArgs = append(keysAndArgs, rollingKey(word, p), rollingWatermarkKey(word, p))
+		args = append(args, timestamp(p.Since(now)))
+	}
+	return redis.Int(repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		return expireRolling.Do(conn, append(keysAndArgs, args...)...)
+	}))
+}
+
+// CountAuthors estimates the number of distinct authors of tweets containing
+// word since the start of the hour containing the specified time, merging
+// each hour's HyperLogLog.
+func (repo *WordCountRepository) CountAuthors(ctx context.Context, word string, since time.Time) (uint, error) {
+	var keys []interface{}
+	for t := since.Truncate(authorsBucket); !t.After(repo.clock.Now()); t = t.Add(authorsBucket) {
+		keys = append(keys, authorsKey(word, t))
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	count, err := redis.Int(repo.do(ctx, "PFCOUNT", keys...))
+	return uint(count), err
+}
+
+// Suppressed returns the number of hits of word suppressed for each reason
+// since the start of the hour containing the specified time.
+func (repo *WordCountRepository) Suppressed(ctx context.Context, word string, since time.Time) (map[string]uint, error) {
+	counts := make(map[string]uint)
+	_, err := repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		buckets := 0
+		for t := since.Truncate(suppressBucket); !t.After(repo.clock.Now()); t = t.Add(suppressBucket) {
+			if err := conn.Send("HGETALL", suppressedKey(word, t)); err != nil {
+				return nil, err
+			}
+			buckets++
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+		for i := 0; i < buckets; i++ {
+			bucket, err := redis.StringMap(conn.Receive())
+			if err != nil {
+				return nil, err
+			}
+			for reason, value := range bucket {
+				count, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				counts[reason] += uint(count)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// CountBySource counts the occurrences of word since the specified time from
+// each source it was found in, from the sorted set of each source's
+// occurrences. Occurrences indexed before sources were recorded are counted
+// under DefaultSource.
+func (repo *WordCountRepository) CountBySource(ctx context.Context, word string, since time.Time) (map[string]uint, error) {
+	sources, err := redis.Strings(repo.do(ctx, "SMEMBERS", sourcesKey(word)))
+	if err != nil {
+		return nil, err
+	}
+	replies, err := redis.Values(repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		conn.Send("MULTI")
+		conn.Send("ZCOUNT", word, timestamp(since), "+inf")
+		for _, source := range sources {
+			conn.Send("ZCOUNT", sourceKey(word, source), timestamp(since), "+inf")
+		}
+		return conn.Do("EXEC")
+	}))
+	if err != nil {
+		return nil, err
+	}
+	total, err := redis.Int(replies[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]uint)
+	for i, source := range sources {
+		count, err := redis.Int(replies[i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			counts[source] += uint(count)
+			total -= count
+		}
+	}
+	if total > 0 {
+		counts[DefaultSource] += uint(total)
+	}
+	return counts, nil
+}
+
+func (repo *WordCountRepository) CountCooccurrences(ctx context.Context, first, second string, since time.Time) (uint, error) {
+	return repo.count(ctx, cooccurrenceKey(first, second), since)
+}
+
+// CountTweets returns the number of tweets indexed with IndexCooccurrences
+// since the specified time.
+func (repo *WordCountRepository) CountTweets(ctx context.Context, since time.Time) (uint, error) {
+	return repo.count(ctx, tweetsKey, since)
+}
+
+// Sentiment returns the tally of sentiment scores for word since the start of
+// the hour containing the specified time.
+func (repo *WordCountRepository) Sentiment(ctx context.Context, word string, since time.Time) (sentiment.Tally, error) {
+	var tally sentiment.Tally
+	_, err := repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		buckets := 0
+		for t := since.Truncate(sentimentBucket); !t.After(repo.clock.Now()); t = t.Add(sentimentBucket) {
+			if err := conn.Send("HMGET", sentimentKey(word, t), "sum", "positive", "negative", "neutral"); err != nil {
+				return nil, err
+			}
+			buckets++
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+		for i := 0; i < buckets; i++ {
+			values, err := redis.Values(conn.Receive())
+			if err != nil {
+				return nil, err
+			}
+			var bucket sentiment.Tally
+			if _, err := redis.Scan(values, &bucket.Sum, &bucket.Positive, &bucket.Negative, &bucket.Neutral); err != nil {
+				return nil, err
+			}
+			tally.Sum += bucket.Sum
+			tally.Positive += bucket.Positive
+			tally.Negative += bucket.Negative
+			tally.Neutral += bucket.Neutral
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return sentiment.Tally{}, err
+	}
+	return tally, nil
+}
+
+// Samples returns the most recent tweets containing word, newest first, and a
+// uniformly random sample of every tweet containing word.
+func (repo *WordCountRepository) Samples(ctx context.Context, word string) ([]tweet.Tweet, []tweet.Tweet, error) {
+	recent, err := repo.samples(ctx, recentSampleKey(word))
+	if err != nil {
+		return nil, nil, err
+	}
+	reservoir, err := repo.samples(ctx, reservoirSampleKey(word))
+	return recent, reservoir, err
+}
+
+func (repo *WordCountRepository) Related(ctx context.Context, word string) ([]topk.Item, error) {
+	encoded, err := redis.Bytes(repo.do(ctx, "GET", relatedKey(word)))
+	if err == redis.ErrNil {
+		return []topk.Item{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var terms []topk.Item
+	err = json.Unmarshal(encoded, &terms)
+	return terms, err
+}
+
+// IndexCandidates replaces the phrases discovered to be rising in frequency.
+func (repo *WordCountRepository) IndexCandidates(ctx context.Context, candidates []discovery.Candidate) error {
+	encoded, err := json.Marshal(candidates)
+	if err != nil {
+		return err
 	}
+	_, err = repo.do(ctx, "SET", candidatesKey, encoded)
 	return err
 }
 
-func (repo *WordCountRepository) Count(word string, since time.Time) (uint, error) {
-	entries, err := redis.Strings(repo.connPool.Get().Do("ZRANGEBYSCORE", word, timestamp(since), "+inf"))
-	return uint(len(entries)), err
+func (repo *WordCountRepository) Candidates(ctx context.Context) ([]discovery.Candidate, error) {
+	encoded, err := redis.Bytes(repo.do(ctx, "GET", candidatesKey))
+	if err == redis.ErrNil {
+		return []discovery.Candidate{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var candidates []discovery.Candidate
+	err = json.Unmarshal(encoded, &candidates)
+	return candidates, err
+}
+
+// Promote adds a phrase to the keywords tracked in addition to those in the
+// keyword definition file.
+func (repo *WordCountRepository) Promote(ctx context.Context, phrase string) error {
+	_, err := repo.do(ctx, "SADD", promotedKey, phrase)
+	return err
+}
+
+// Promoted returns every promoted phrase in alphabetical order.
+func (repo *WordCountRepository) Promoted(ctx context.Context) ([]string, error) {
+	promoted, err := redis.Strings(repo.do(ctx, "SMEMBERS", promotedKey))
+	sort.Strings(promoted)
+	return promoted, err
 }
 
-func (repo *WordCountRepository) Cleanup(word string, before time.Time) error {
-	_, err := repo.connPool.Get().Do("ZREMRANGEBYSCORE", word, 0, timestamp(before))
+// ReportStream records the state of a source's stream, for API processes to
+// report in their health checks. The source is remembered in a set of sources
+// so that the states can be read without scanning the keyspace.
+func (repo *WordCountRepository) ReportStream(ctx context.Context, status health.Stream) error {
+	encoded, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		conn.Send("MULTI")
+		conn.Send("SET", streamKey(status.Source), encoded, "PX", int64(health.StreamStatusTTL/time.Millisecond))
+		conn.Send("SADD", streamsKey, status.Source)
+		return conn.Do("EXEC")
+	})
 	return err
 }
 
+// Streams returns the last reported state of the stream from each source,
+// ordered by source. Sources that have not reported recently are omitted.
+func (repo *WordCountRepository) Streams(ctx context.Context) ([]health.Stream, error) {
+	sources, err := redis.Strings(repo.do(ctx, "SMEMBERS", streamsKey))
+	if err != nil || len(sources) == 0 {
+		return []health.Stream{}, err
+	}
+	sort.Strings(sources)
+	keys := make([]interface{}, len(sources))
+	for i, source := range sources {
+		keys[i] = streamKey(source)
+	}
+	replies, err := redis.Values(repo.do(ctx, "MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+	streams := []health.Stream{}
+	for _, reply := range replies {
+		encoded, ok := reply.([]byte)
+		if !ok {
+			continue
+		}
+		var status health.Stream
+		if err := json.Unmarshal(encoded, &status); err != nil {
+			return nil, err
+		}
+		streams = append(streams, status)
+	}
+	return streams, nil
+}
+
+// Cursor returns the position up to which a source's stream has been read, or
+// zero if it has never been read.
+func (repo *WordCountRepository) Cursor(ctx context.Context, source string) (int64, error) {
+	cursor, err := redis.Int64(repo.do(ctx, "GET", cursorKey(source)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return cursor, err
+}
+
+func (repo *WordCountRepository) SaveCursor(ctx context.Context, source string, cursor int64) error {
+	_, err := repo.do(ctx, "SET", cursorKey(source), cursor)
+	return err
+}
+
+// Seen reports whether a tweet from a source has already been counted.
+func (repo *WordCountRepository) Seen(ctx context.Context, source, id string) (bool, error) {
+	return redis.Bool(repo.do(ctx, "EXISTS", seenKey(source, id)))
+}
+
+// MarkSeen remembers that a tweet from a source has been counted, for
+// SeenTTL.
+func (repo *WordCountRepository) MarkSeen(ctx context.Context, source, id string) error {
+	_, err := repo.do(ctx, "SET", seenKey(source, id), 1, "PX", int64(SeenTTL/time.Millisecond))
+	return err
+}
+
+func (repo *WordCountRepository) Ping(ctx context.Context) error {
+	_, err := repo.do(ctx, "PING")
+	return err
+}
+
+// Cleanup deletes the occurrences of word from before the specified time,
+// first expiring them from its rolling counts so they aren't left counted,
+// along with its occurrences from each source and the tweets it co-occurred in
+// from before then. Occurrences that
+// a rolling count still includes, because the time is inside its period, are
+// removed from it as they are deleted.
+func (repo *WordCountRepository) Cleanup(ctx context.Context, word string, before time.Time) error {
+	if _, err := repo.ExpireRolling(ctx, word); err != nil {
+		return err
+	}
+	fenceKey, token := repo.fence()
+	keysAndArgs := []interface{}{2 + 2*len(period.Standard), word, fenceKey}
+	for _, p := range period.Standard {
+		keysAndArgs = append(keysAndArgs, rollingKey(word, p), rollingWatermarkKey(word, p))
+	}
+	if _, err := repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		return cleanupWord.Do(conn, append(keysAndArgs, token, timestamp(before))...)
+	}); err != nil {
+		return err
+	}
+	sources, err := redis.Strings(repo.do(ctx, "SMEMBERS", sourcesKey(word)))
+	if err != nil {
+		return err
+	}
+	keys, err := repo.cooccurrenceKeys(ctx, word)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, tweetsKey)
+	for _, source := range sources {
+		keys = append(keys, sourceKey(word, source))
+	}
+	for _, key := range keys {
+		if _, err := repo.do(ctx, "ZREMRANGEBYSCORE", key, 0, timestamp(before)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cooccurrenceKeys returns the keys counting the co-occurrences of word with
+// any other word.
+func (repo *WordCountRepository) cooccurrenceKeys(ctx context.Context, word string) ([]string, error) {
+	var keys []string
+	escaped := globEscaper.Replace(word)
+	for _, pattern := range []string{"cooccurrence:" + escaped + ":*", "cooccurrence:*:" + escaped} {
+		cursor := 0
+		for {
+			reply, err := redis.Values(repo.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+			if err != nil {
+				return nil, err
+			}
+			if cursor, err = redis.Int(reply[0], nil); err != nil {
+				return nil, err
+			}
+			found, err := redis.Strings(reply[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, found...)
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return keys, nil
+}
+
+// globEscaper escapes the characters special to the patterns SCAN matches.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
 func (repo *WordCountRepository) Close() error {
-	return repo.connPool.Close()
+	return repo.pool.Close()
+}
+
+// fencedMulti runs the commands queue sends in a transaction, failing if a
+// leader newer than the holder of the fencing token has stored its own token,
+// whether before the transaction or while it is queued. Commands that fail
+// inside the transaction fail it.
+func (repo *WordCountRepository) fencedMulti(ctx context.Context, queue func(redis.Conn)) ([]interface{}, error) {
+	fenceKey, token := repo.fence()
+	stale := fmt.Errorf("stale fencing token %d", token)
+	return redis.Values(repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		if token > 0 {
+			if _, err := conn.Do("WATCH", fenceKey); err != nil {
+				return nil, err
+			}
+			latest, err := redis.Int64(conn.Do("GET", fenceKey))
+			if err != nil && err != redis.ErrNil {
+				return nil, err
+			}
+			if latest > token {
+				return nil, stale
+			}
+		}
+		conn.Send("MULTI")
+		queue(conn)
+		replies, err := redis.Values(conn.Do("EXEC"))
+		if err == redis.ErrNil {
+			return nil, stale
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, reply := range replies {
+			if err, ok := reply.(redis.Error); ok {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}))
+}
+
+// indexWordArgs returns the keys and arguments of the indexWord script for an
+// occurrence of word at t.
+func (repo *WordCountRepository) indexWordArgs(source, word string, t time.Time) []interface{} {
+	now := repo.clock.Now()
+	fenceKey, token := repo.fence()
+	keysAndArgs := []interface{}{4 + 2*len(period.Standard), word, fenceKey, sourceKey(word, source), sourcesKey(word)}
+	args := []interface{}{timestamp(t), repo.randomString(), token, source}
+	for _, p := range period.Standard {
+		keysAndArgs = append(keysAndArgs, rollingKey(word, p), rollingWatermarkKey(word, p))
+		args = append(args, timestamp(p.Since(now)))
+	}
+	return append(keysAndArgs, args...)
+}
+
+func (repo *WordCountRepository) count(ctx context.Context, key string, since time.Time) (uint, error) {
+	count, err := redis.Int(repo.do(ctx, "ZCOUNT", key, timestamp(since), "+inf"))
+	return uint(count), err
+}
+
+func (repo *WordCountRepository) samples(ctx context.Context, key string) ([]tweet.Tweet, error) {
+	members, err := redis.Strings(repo.do(ctx, "LRANGE", key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	tweets := make([]tweet.Tweet, len(members))
+	for i, member := range members {
+		if err := json.Unmarshal([]byte(member), &tweets[i]); err != nil {
+			return nil, err
+		}
+	}
+	return tweets, nil
+}
+
+func (repo *WordCountRepository) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return repo.pool.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do(cmd, args...)
+	})
 }
 
 func (repo *WordCountRepository) randomString() string {
+	repo.randomMutex.Lock()
+	defer repo.randomMutex.Unlock()
 	return fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(repo.randomSrc.Int()))))
 }
 
+func (repo *WordCountRepository) randomFloat() float64 {
+	repo.randomMutex.Lock()
+	defer repo.randomMutex.Unlock()
+	return repo.randomSrc.Float64()
+}
+
 func timestamp(t time.Time) string {
 	return fmt.Sprintf("%d", t.UnixNano()/1000)
 }
+
+func cooccurrenceKey(first, second string) string {
+	pair := []string{first, second}
+	sort.Strings(pair)
+	return fmt.Sprintf("cooccurrence:%s:%s", pair[0], pair[1])
+}
+
+func sentimentKey(word string, t time.Time) string {
+	return fmt.Sprintf("sentiment:%s:%d", word, t.Truncate(sentimentBucket).Unix())
+}
+
+func sentimentField(score int) string {
+	switch {
+	case score > 0:
+		return "positive"
+	case score < 0:
+		return "negative"
+	default:
+		return "neutral"
+	}
+}
+
+func authorsKey(word string, t time.Time) string {
+	return fmt.Sprintf("authors:%s:%d", word, t.Truncate(authorsBucket).Unix())
+}
+
+func suppressedKey(word string, t time.Time) string {
+	return fmt.Sprintf("suppressed:%s:%d", word, t.Truncate(suppressBucket).Unix())
+}
+
+func recentSampleKey(word string) string {
+	return fmt.Sprintf("samples:recent:%s", word)
+}
+
+func reservoirSampleKey(word string) string {
+	return fmt.Sprintf("samples:reservoir:%s", word)
+}
+
+func sampleSeenKey(word string) string {
+	return fmt.Sprintf("samples:seen:%s", word)
+}
+
+func sourceKey(word, source string) string {
+	return fmt.Sprintf("source:%s:%s", source, word)
+}
+
+func sourcesKey(word string) string {
+	return fmt.Sprintf("sources:%s", word)
+}
+
+func streamKey(source string) string {
+	return fmt.Sprintf("gatherer:stream:%s", source)
+}
+
+func cursorKey(source string) string {
+	return fmt.Sprintf("gatherer:cursor:%s", source)
+}
+
+func seenKey(source, id string) string {
+	return fmt.Sprintf("gatherer:seen:%s:%s", source, id)
+}
+
+func rollingKey(word string, p period.Period) string {
+	return fmt.Sprintf("rolling:%s:%s", p.Name, word)
+}
+
+func rollingWatermarkKey(word string, p period.Period) string {
+	return fmt.Sprintf("rolling:%s:%s:watermark", p.Name, word)
+}
+
+func relatedKey(word string) string {
+	return fmt.Sprintf("related:%s", word)
+}
@@ -1,11 +1,19 @@
 package indexer_test
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"time"
 
+	"github.com/craigfurman/bovine/discovery"
+	"github.com/craigfurman/bovine/health"
 	"github.com/craigfurman/bovine/indexer"
 	"github.com/craigfurman/bovine/indexer/fakes"
+	"github.com/craigfurman/bovine/period"
+	"github.com/craigfurman/bovine/sentiment"
+	"github.com/craigfurman/bovine/topk"
+	"github.com/craigfurman/bovine/tweet"
 
 	"github.com/garyburd/redigo/redis"
 	. "github.com/onsi/ginkgo"
@@ -18,6 +26,7 @@ var _ = Describe("Indexer", func() {
 		repo    *indexer.WordCountRepository
 		keyword = "sriracha"
 		clock   *fakes.FakeClock
+		ctx     = context.Background()
 
 		redisConn redis.Conn
 	)
@@ -28,8 +37,16 @@ var _ = Describe("Indexer", func() {
 		var err error
 		redisConn, err = redis.Dial("tcp", redisURL)
 		Expect(err).ToNot(HaveOccurred())
-		_, err = redisConn.Do("DEL", keyword)
+		_, err = redisConn.Do("DEL", keyword, "cooccurrence:tweets", "cooccurrence:ketchup:sriracha", "cooccurrence:mayo:sriracha", "cooccurrence:ketchup:mayo", "samples:recent:"+keyword, "samples:reservoir:"+keyword, "samples:seen:"+keyword, "related:"+keyword, "sources:"+keyword, "discovery:candidates", "keywords:promoted", "gatherer:stream:twitter", "gatherer:stream:mastodon", "gatherer:streams", "gatherer:cursor:bluesky", "gatherer:seen:nats:1", "test:leader:token")
 		Expect(err).ToNot(HaveOccurred())
+		for _, pattern := range []string{"sentiment:" + keyword + ":*", "rolling:*:" + keyword + "*", "authors:" + keyword + ":*", "suppressed:" + keyword + ":*", "source:*:" + keyword} {
+			keys, err := redis.Values(redisConn.Do("KEYS", pattern))
+			Expect(err).ToNot(HaveOccurred())
+			if len(keys) > 0 {
+				_, err = redisConn.Do("DEL", keys...)
+				Expect(err).ToNot(HaveOccurred())
+			}
+		}
 		repo = indexer.New(redisURL, clock)
 	})
 
@@ -41,8 +58,8 @@ var _ = Describe("Indexer", func() {
 	Describe("IndexWord", func() {
 
 		It("increments the count for the specified keyword in redis", func() {
-			Expect(repo.IndexWord(keyword)).To(Succeed())
-			Expect(repo.IndexWord(keyword)).To(Succeed())
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
 			count, err := redis.Int(redisConn.Do("ZCARD", keyword))
 			Expect(err).ToNot(HaveOccurred())
 			Expect(count).To(Equal(2))
@@ -51,13 +68,41 @@ var _ = Describe("Indexer", func() {
 		It("adds current timestamp as the score of each member", func() {
 			now := time.Now()
 			clock.NowReturns(now)
-			Expect(repo.IndexWord(keyword)).To(Succeed())
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
 			scores, err := redis.Strings(redisConn.Do("ZRANGE", keyword, "0", "-1", "WITHSCORES"))
 			Expect(err).ToNot(HaveOccurred())
 			Expect(scores[1]).To(Equal(fmt.Sprintf("%d", now.UnixNano()/1000)))
 		})
 	})
 
+	Describe("IndexWordAt", func() {
+
+		It("uses the specified time as the score", func() {
+			then := time.Now().Add(time.Hour * -48)
+			clock.NowReturns(time.Now())
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, then)).To(Succeed())
+			scores, err := redis.Strings(redisConn.Do("ZRANGE", keyword, "0", "-1", "WITHSCORES"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(scores[1]).To(Equal(fmt.Sprintf("%d", then.UnixNano()/1000)))
+		})
+	})
+
+	Describe("IndexWordsAt", func() {
+
+		It("counts each word at the specified time", func() {
+			then := time.Now().Add(time.Hour * -48)
+			Expect(repo.IndexWordsAt(ctx, "file:archive.json", []string{keyword, keyword}, then)).To(Succeed())
+
+			count, err := repo.Count(ctx, keyword, then)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(uint(2)))
+
+			count, err = repo.Count(ctx, keyword, then.Add(time.Microsecond))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeZero())
+		})
+	})
+
 	Describe("Count", func() {
 
 		It("returns number of entries for word since specified time", func() {
@@ -65,18 +110,481 @@ var _ = Describe("Indexer", func() {
 
 			threeHoursAgo := now.Add(time.Hour * -3)
 			clock.NowReturns(threeHoursAgo)
-			Expect(repo.IndexWord(keyword)).To(Succeed())
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
 
 			oneHourAgo := now.Add(time.Hour * -1)
 			clock.NowReturns(oneHourAgo)
-			Expect(repo.IndexWord(keyword)).To(Succeed())
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
 
-			count, err := repo.Count(keyword, now.Add(time.Hour*-2))
+			count, err := repo.Count(ctx, keyword, now.Add(time.Hour*-2))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(count).To(Equal(uint(1)))
 		})
 	})
 
+	Describe("CountBetween", func() {
+
+		It("returns number of entries for word from the start up to the end", func() {
+			now := time.Now()
+			for _, ago := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Hour} {
+				Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-ago))).To(Succeed())
+			}
+
+			count, err := repo.CountBetween(ctx, keyword, now.Add(-3*time.Hour), now.Add(-time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(uint(2)))
+		})
+	})
+
+	Describe("Fence", func() {
+
+		BeforeEach(func() {
+			clock.NowReturns(time.Now())
+			_, err := redisConn.Do("SET", "test:leader:token", 5)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects counts from a leader that has been succeeded", func() {
+			repo.Fence("test:leader:token", 4)
+			Expect(repo.IndexWord(ctx, keyword)).To(MatchError(ContainSubstring("stale fencing token")))
+			_, err := repo.ExpireRolling(ctx, keyword)
+			Expect(err).To(MatchError(ContainSubstring("stale fencing token")))
+			count, err := redis.Int(redisConn.Do("ZCARD", keyword))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(BeZero())
+		})
+
+		It("rejects a batch of counts from a leader that has been succeeded", func() {
+			repo.Fence("test:leader:token", 4)
+			Expect(repo.IndexWordsAt(ctx, "twitter", []string{keyword}, time.Now())).To(MatchError(ContainSubstring("stale fencing token")))
+		})
+
+		It("rejects everything else indexed alongside counts from a leader that has been succeeded", func() {
+			repo.Fence("test:leader:token", 4)
+			now := time.Now()
+			Expect(repo.IndexCooccurrences(ctx, "twitter", []string{keyword, "ketchup"}, now)).To(MatchError(ContainSubstring("stale fencing token")))
+			Expect(repo.IndexSentiment(ctx, keyword, 3, now)).To(MatchError(ContainSubstring("stale fencing token")))
+			Expect(repo.IndexSample(ctx, keyword, tweet.Tweet{Text: "sriracha"})).To(MatchError(ContainSubstring("stale fencing token")))
+			Expect(repo.IndexAuthor(ctx, "twitter", keyword, "42", now)).To(MatchError(ContainSubstring("stale fencing token")))
+			Expect(repo.IndexSuppressed(ctx, keyword, "spam", now)).To(MatchError(ContainSubstring("stale fencing token")))
+			Expect(repo.IndexRelated(ctx, keyword, []topk.Item{{Term: "ketchup", Count: 1}})).To(MatchError(ContainSubstring("stale fencing token")))
+
+			repo.Fence("test:leader:token", 5)
+			Expect(repo.IndexCooccurrences(ctx, "twitter", []string{keyword, "ketchup"}, now)).To(Succeed())
+			Expect(repo.IndexSample(ctx, keyword, tweet.Tweet{Text: "sriracha"})).To(Succeed())
+			tweets, err := repo.CountTweets(ctx, now.Add(-time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tweets).To(Equal(uint(1)))
+		})
+
+		It("accepts counts from the current leader", func() {
+			repo.Fence("test:leader:token", 5)
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
+			Expect(repo.CountRolling(ctx, keyword, period.Hour)).To(Equal(uint(1)))
+		})
+	})
+
+	Describe("CountRolling", func() {
+
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Now()
+			clock.NowReturns(now)
+		})
+
+		countRolling := func(p period.Period) uint {
+			count, err := repo.CountRolling(ctx, keyword, p)
+			Expect(err).NotTo(HaveOccurred())
+			return count
+		}
+
+		It("counts entries in each period as they are indexed", func() {
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-30*time.Minute))).To(Succeed())
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-3*time.Hour))).To(Succeed())
+			Expect(repo.IndexWordsAt(ctx, "twitter", []string{keyword}, now.Add(-2*24*time.Hour))).To(Succeed())
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-8*24*time.Hour))).To(Succeed())
+
+			Expect(countRolling(period.Hour)).To(Equal(uint(1)))
+			Expect(countRolling(period.Day)).To(Equal(uint(2)))
+			Expect(countRolling(period.Week)).To(Equal(uint(3)))
+		})
+
+		It("reads the count without counting the entries", func() {
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
+			_, err := redisConn.Do("SET", "rolling:day:"+keyword, 42)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countRolling(period.Day)).To(Equal(uint(42)))
+		})
+
+		It("expires entries as they age out of each period", func() {
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-30*time.Minute))).To(Succeed())
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-20*time.Hour))).To(Succeed())
+
+			clock.NowReturns(now.Add(time.Hour))
+			expired, err := repo.ExpireRolling(ctx, keyword)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expired).To(Equal(1))
+			Expect(countRolling(period.Hour)).To(Equal(uint(0)))
+			Expect(countRolling(period.Day)).To(Equal(uint(2)))
+
+			clock.NowReturns(now.Add(5 * time.Hour))
+			Expect(repo.ExpireRolling(ctx, keyword)).To(Equal(1))
+			Expect(repo.ExpireRolling(ctx, keyword)).To(Equal(0))
+			Expect(countRolling(period.Day)).To(Equal(uint(1)))
+			Expect(countRolling(period.Week)).To(Equal(uint(2)))
+		})
+
+		It("does not count entries that have already been expired", func() {
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
+			Expect(repo.ExpireRolling(ctx, keyword)).To(Equal(0))
+			Expect(repo.IndexWordAt(ctx, "file:archive.json", keyword, now.Add(-2*time.Hour))).To(Succeed())
+			Expect(countRolling(period.Hour)).To(Equal(uint(1)))
+			Expect(countRolling(period.Day)).To(Equal(uint(2)))
+		})
+
+		It("starts from the entries already indexed", func() {
+			_, err := redisConn.Do("ZADD", keyword, now.Add(-2*time.Hour).UnixNano()/1000, "twitter:before")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(countRolling(period.Day)).To(Equal(uint(1)))
+
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
+			Expect(countRolling(period.Hour)).To(Equal(uint(1)))
+			Expect(countRolling(period.Day)).To(Equal(uint(2)))
+		})
+
+		It("expires entries before cleaning them up", func() {
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-3*time.Hour))).To(Succeed())
+			clock.NowReturns(now.Add(24 * time.Hour))
+			Expect(repo.Cleanup(ctx, keyword, now)).To(Succeed())
+			Expect(countRolling(period.Day)).To(Equal(uint(0)))
+		})
+	})
+
+	Describe("CountBySource", func() {
+
+		It("counts entries for word since specified time from each source", func() {
+			now := time.Now()
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-3*time.Hour))).To(Succeed())
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now)).To(Succeed())
+			Expect(repo.IndexWordAt(ctx, "mastodon", keyword, now)).To(Succeed())
+			Expect(repo.IndexWordsAt(ctx, "file:archive.json", []string{keyword, keyword}, now)).To(Succeed())
+
+			counts, err := repo.CountBySource(ctx, keyword, now.Add(-2*time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counts).To(Equal(map[string]uint{"twitter": 1, "mastodon": 1, "file:archive.json": 2}))
+		})
+
+		It("keeps each source's entries in a sorted set of their own", func() {
+			now := time.Now()
+			clock.NowReturns(now)
+			Expect(repo.IndexWordAt(ctx, "mastodon", keyword, now.Add(-3*time.Hour))).To(Succeed())
+			Expect(repo.IndexWordAt(ctx, "mastodon", keyword, now)).To(Succeed())
+
+			count, err := redis.Int(redisConn.Do("ZCARD", "source:mastodon:"+keyword))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(2))
+
+			Expect(repo.Cleanup(ctx, keyword, now.Add(-2*time.Hour))).To(Succeed())
+			count, err = redis.Int(redisConn.Do("ZCARD", "source:mastodon:"+keyword))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(1))
+		})
+
+		It("counts entries indexed before sources were recorded as coming from twitter", func() {
+			now := time.Now()
+			_, err := redisConn.Do("ZADD", keyword, now.UnixNano()/1000, "0123456789abcdef")
+			Expect(err).NotTo(HaveOccurred())
+
+			counts, err := repo.CountBySource(ctx, keyword, now.Add(-time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counts).To(Equal(map[string]uint{"twitter": 1}))
+		})
+	})
+
+	Describe("IndexSentiment", func() {
+
+		It("tallies sentiment scores for the keyword by the hour they were tweeted in", func() {
+			now := time.Now()
+			clock.NowReturns(now)
+
+			Expect(repo.IndexSentiment(ctx, keyword, 5, now.Add(time.Hour*-3))).To(Succeed())
+			Expect(repo.IndexSentiment(ctx, keyword, 3, now.Add(time.Hour*-1))).To(Succeed())
+			Expect(repo.IndexSentiment(ctx, keyword, -2, now.Add(time.Hour*-1))).To(Succeed())
+			Expect(repo.IndexSentiment(ctx, keyword, 0, now)).To(Succeed())
+			Expect(repo.IndexSentiment(ctx, keyword, 1, now)).To(Succeed())
+
+			tally, err := repo.Sentiment(ctx, keyword, now.Add(time.Hour*-1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tally).To(Equal(sentiment.Tally{Sum: 2, Positive: 2, Negative: 1, Neutral: 1}))
+		})
+
+		It("expires each hour once it is older than a week", func() {
+			now := time.Now()
+			Expect(repo.IndexSentiment(ctx, keyword, 1, now)).To(Succeed())
+			ttl, err := redis.Int64(redisConn.Do("PTTL", fmt.Sprintf("sentiment:%s:%d", keyword, now.Truncate(time.Hour).Unix())))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(time.Duration(ttl) * time.Millisecond).To(BeNumerically("~", now.Truncate(time.Hour).Add(169*time.Hour).Sub(time.Now()), time.Second))
+		})
+
+		It("returns an empty tally when nothing has been indexed", func() {
+			clock.NowReturns(time.Now())
+			tally, err := repo.Sentiment(ctx, keyword, time.Now().AddDate(0, 0, -1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tally).To(BeZero())
+		})
+	})
+
+	Describe("IndexAuthor", func() {
+
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Now()
+			clock.NowReturns(now)
+		})
+
+		It("counts each author once", func() {
+			Expect(repo.IndexAuthor(ctx, "twitter", keyword, "1", now)).To(Succeed())
+			Expect(repo.IndexAuthor(ctx, "twitter", keyword, "1", now)).To(Succeed())
+			Expect(repo.IndexAuthor(ctx, "twitter", keyword, "2", now)).To(Succeed())
+			Expect(repo.CountAuthors(ctx, keyword, now.Add(-time.Hour))).To(Equal(uint(2)))
+		})
+
+		It("tells apart authors from different sources with the same ID", func() {
+			Expect(repo.IndexAuthor(ctx, "twitter", keyword, "1", now)).To(Succeed())
+			Expect(repo.IndexAuthor(ctx, "mastodon", keyword, "1", now)).To(Succeed())
+			Expect(repo.CountAuthors(ctx, keyword, now.Add(-time.Hour))).To(Equal(uint(2)))
+		})
+
+		It("counts the authors of each hour since the specified time", func() {
+			Expect(repo.IndexAuthor(ctx, "twitter", keyword, "1", now.Add(-3*time.Hour))).To(Succeed())
+			Expect(repo.IndexAuthor(ctx, "twitter", keyword, "2", now.Add(-time.Hour))).To(Succeed())
+			Expect(repo.IndexAuthor(ctx, "twitter", keyword, "3", now)).To(Succeed())
+			Expect(repo.CountAuthors(ctx, keyword, now.Add(-2*time.Hour))).To(Equal(uint(2)))
+			Expect(repo.CountAuthors(ctx, keyword, now.Add(-24*time.Hour))).To(Equal(uint(3)))
+		})
+
+		It("expires each hour once it is older than a week", func() {
+			Expect(repo.IndexAuthor(ctx, "twitter", keyword, "1", now)).To(Succeed())
+			ttl, err := redis.Int64(redisConn.Do("PTTL", fmt.Sprintf("authors:%s:%d", keyword, now.Truncate(time.Hour).Unix())))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(time.Duration(ttl) * time.Millisecond).To(BeNumerically("~", now.Truncate(time.Hour).Add(169*time.Hour).Sub(time.Now()), time.Second))
+		})
+
+		It("counts no authors for keywords without tweets", func() {
+			Expect(repo.CountAuthors(ctx, keyword, now.Add(-time.Hour))).To(BeZero())
+		})
+	})
+
+	Describe("IndexSuppressed", func() {
+
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Now()
+			clock.NowReturns(now)
+		})
+
+		It("tallies suppressed hits for each reason since the specified time", func() {
+			Expect(repo.IndexSuppressed(ctx, keyword, "duplicate", now.Add(-3*time.Hour))).To(Succeed())
+			Expect(repo.IndexSuppressed(ctx, keyword, "duplicate", now)).To(Succeed())
+			Expect(repo.IndexSuppressed(ctx, keyword, "duplicate", now)).To(Succeed())
+			Expect(repo.IndexSuppressed(ctx, keyword, "denied", now.Add(-time.Hour))).To(Succeed())
+
+			Expect(repo.Suppressed(ctx, keyword, now.Add(-time.Hour))).To(Equal(map[string]uint{"duplicate": 2, "denied": 1}))
+			Expect(repo.Suppressed(ctx, keyword, now.Add(-24*time.Hour))).To(Equal(map[string]uint{"duplicate": 3, "denied": 1}))
+		})
+
+		It("expires each hour once it is older than a week", func() {
+			Expect(repo.IndexSuppressed(ctx, keyword, "duplicate", now)).To(Succeed())
+			ttl, err := redis.Int64(redisConn.Do("PTTL", fmt.Sprintf("suppressed:%s:%d", keyword, now.Truncate(time.Hour).Unix())))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(time.Duration(ttl) * time.Millisecond).To(BeNumerically("~", now.Truncate(time.Hour).Add(169*time.Hour).Sub(time.Now()), time.Second))
+		})
+
+		It("reports nothing suppressed for keywords without suppressed hits", func() {
+			Expect(repo.Suppressed(ctx, keyword, now.Add(-time.Hour))).To(BeEmpty())
+		})
+	})
+
+	Describe("IndexSample", func() {
+
+		It("keeps the most recent tweets, newest first", func() {
+			for i := 0; i < indexer.SampleSize+5; i++ {
+				Expect(repo.IndexSample(ctx, keyword, tweet.Tweet{ID: fmt.Sprintf("%d", i), Text: "hot sauce"})).To(Succeed())
+			}
+
+			recent, _, err := repo.Samples(ctx, keyword)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recent).To(HaveLen(indexer.SampleSize))
+			Expect(recent[0]).To(Equal(tweet.Tweet{ID: fmt.Sprintf("%d", indexer.SampleSize+4), Text: "hot sauce"}))
+			Expect(recent[indexer.SampleSize-1].ID).To(Equal("5"))
+		})
+
+		It("keeps a fixed size reservoir sample of every tweet", func() {
+			for i := 0; i < indexer.SampleSize*5; i++ {
+				Expect(repo.IndexSample(ctx, keyword, tweet.Tweet{ID: fmt.Sprintf("%d", i)})).To(Succeed())
+			}
+
+			_, reservoir, err := repo.Samples(ctx, keyword)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reservoir).To(HaveLen(indexer.SampleSize))
+			ids := make(map[string]bool)
+			for _, t := range reservoir {
+				ids[t.ID] = true
+			}
+			Expect(ids).To(HaveLen(indexer.SampleSize))
+		})
+
+		It("returns empty samples for keywords without tweets", func() {
+			recent, reservoir, err := repo.Samples(ctx, keyword)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recent).To(BeEmpty())
+			Expect(reservoir).To(BeEmpty())
+		})
+	})
+
+	Describe("IndexRelated", func() {
+
+		It("replaces the related terms for the keyword", func() {
+			Expect(repo.IndexRelated(ctx, keyword, []topk.Item{{Term: "noodles", Count: 3}})).To(Succeed())
+			terms := []topk.Item{{Term: "#hot", Count: 5, Error: 1}, {Term: "rooster", Count: 4}}
+			Expect(repo.IndexRelated(ctx, keyword, terms)).To(Succeed())
+
+			related, err := repo.Related(ctx, keyword)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(related).To(Equal(terms))
+		})
+
+		It("returns no related terms for keywords without any", func() {
+			related, err := repo.Related(ctx, keyword)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(related).To(BeEmpty())
+		})
+	})
+
+	Describe("IndexCandidates", func() {
+
+		It("replaces the discovered candidate phrases", func() {
+			Expect(repo.IndexCandidates(ctx, []discovery.Candidate{{Phrase: "old news", Count: 5, Growth: 5}})).To(Succeed())
+			candidates := []discovery.Candidate{{Phrase: "hot take", Count: 10, PreviousCount: 2, Growth: 5}}
+			Expect(repo.IndexCandidates(ctx, candidates)).To(Succeed())
+
+			indexed, err := repo.Candidates(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(indexed).To(Equal(candidates))
+		})
+
+		It("returns no candidates before any are indexed", func() {
+			indexed, err := repo.Candidates(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(indexed).To(BeEmpty())
+		})
+	})
+
+	Describe("Promote", func() {
+
+		It("adds the phrase to the promoted keywords once", func() {
+			Expect(repo.Promote(ctx, "hot take")).To(Succeed())
+			Expect(repo.Promote(ctx, "deep dive")).To(Succeed())
+			Expect(repo.Promote(ctx, "hot take")).To(Succeed())
+
+			promoted, err := repo.Promoted(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(promoted).To(Equal([]string{"deep dive", "hot take"}))
+		})
+	})
+
+	Describe("ReportStream", func() {
+
+		It("reports no streams before any gatherer has reported", func() {
+			streams, err := repo.Streams(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(streams).To(BeEmpty())
+		})
+
+		It("reports the last status of each source, expiring it if not renewed", func() {
+			lastTweet := time.Now().Add(-time.Second)
+			Expect(repo.ReportStream(ctx, health.Stream{Source: "twitter", Connected: true})).To(Succeed())
+			Expect(repo.ReportStream(ctx, health.Stream{Source: "twitter", Connected: true, LastTweet: lastTweet})).To(Succeed())
+			Expect(repo.ReportStream(ctx, health.Stream{Source: "mastodon"})).To(Succeed())
+
+			streams, err := repo.Streams(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(streams).To(HaveLen(2))
+			Expect(streams[0].Source).To(Equal("mastodon"))
+			Expect(streams[0].Connected).To(BeFalse())
+			Expect(streams[1].Source).To(Equal("twitter"))
+			Expect(streams[1].Connected).To(BeTrue())
+			Expect(streams[1].LastTweet).To(BeTemporally("==", lastTweet))
+
+			ttl, err := redis.Int(redisConn.Do("PTTL", "gatherer:stream:twitter"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", health.StreamStatusTTL/time.Millisecond, 1000))
+		})
+
+		It("omits sources whose status has expired", func() {
+			Expect(repo.ReportStream(ctx, health.Stream{Source: "twitter", Connected: true})).To(Succeed())
+			Expect(repo.ReportStream(ctx, health.Stream{Source: "mastodon"})).To(Succeed())
+			_, err := redisConn.Do("DEL", "gatherer:stream:twitter")
+			Expect(err).NotTo(HaveOccurred())
+
+			streams, err := repo.Streams(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(streams).To(HaveLen(1))
+			Expect(streams[0].Source).To(Equal("mastodon"))
+		})
+	})
+
+	Describe("SaveCursor", func() {
+
+		It("starts sources from the beginning", func() {
+			cursor, err := repo.Cursor(ctx, "bluesky")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cursor).To(BeZero())
+		})
+
+		It("records the position a source was read up to", func() {
+			Expect(repo.SaveCursor(ctx, "bluesky", 1725911162329308)).To(Succeed())
+			cursor, err := repo.Cursor(ctx, "bluesky")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cursor).To(Equal(int64(1725911162329308)))
+		})
+	})
+
+	Describe("MarkSeen", func() {
+
+		It("remembers which tweets from a source were counted", func() {
+			seen, err := repo.Seen(ctx, "nats", "1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seen).To(BeFalse())
+
+			Expect(repo.MarkSeen(ctx, "nats", "1")).To(Succeed())
+			seen, err = repo.Seen(ctx, "nats", "1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seen).To(BeTrue())
+
+			seen, err = repo.Seen(ctx, "mastodon", "1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seen).To(BeFalse())
+		})
+
+		It("forgets them after a while", func() {
+			Expect(repo.MarkSeen(ctx, "nats", "1")).To(Succeed())
+			ttl, err := redis.Int64(redisConn.Do("PTTL", "gatherer:seen:nats:1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", indexer.SeenTTL/time.Millisecond, 1000))
+		})
+	})
+
+	Describe("Ping", func() {
+
+		It("succeeds while redis is reachable", func() {
+			Expect(repo.Ping(ctx)).To(Succeed())
+		})
+	})
+
 	Describe("Cleanup", func() {
 
 		It("deletes entries for keyword before specified time", func() {
@@ -84,17 +592,144 @@ var _ = Describe("Indexer", func() {
 
 			threeHoursAgo := now.Add(time.Hour * -3)
 			clock.NowReturns(threeHoursAgo)
-			Expect(repo.IndexWord(keyword)).To(Succeed())
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
 
 			oneHourAgo := now.Add(time.Hour * -1)
 			clock.NowReturns(oneHourAgo)
-			Expect(repo.IndexWord(keyword)).To(Succeed())
+			Expect(repo.IndexWord(ctx, keyword)).To(Succeed())
 
-			Expect(repo.Cleanup(keyword, now.Add(time.Hour*-2))).To(Succeed())
+			Expect(repo.Cleanup(ctx, keyword, now.Add(time.Hour*-2))).To(Succeed())
 
 			count, err := redis.Int(redisConn.Do("ZCARD", keyword))
 			Expect(err).ToNot(HaveOccurred())
 			Expect(count).To(Equal(1))
 		})
+
+		It("removes the entries it deletes from the rolling counts that still include them", func() {
+			now := time.Now()
+			clock.NowReturns(now)
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-3*time.Hour))).To(Succeed())
+			Expect(repo.IndexWordAt(ctx, "twitter", keyword, now.Add(-time.Hour))).To(Succeed())
+
+			Expect(repo.Cleanup(ctx, keyword, now.Add(-2*time.Hour))).To(Succeed())
+			Expect(repo.CountRolling(ctx, keyword, period.Day)).To(Equal(uint(1)))
+			Expect(repo.CountRolling(ctx, keyword, period.Hour)).To(Equal(uint(0)))
+
+			clock.NowReturns(now.Add(2 * 24 * time.Hour))
+			Expect(repo.ExpireRolling(ctx, keyword)).To(Equal(1))
+			Expect(repo.CountRolling(ctx, keyword, period.Day)).To(Equal(uint(0)))
+			Expect(repo.CountRolling(ctx, keyword, period.Week)).To(Equal(uint(1)))
+		})
+	})
+
+	Describe("IndexCooccurrences", func() {
+
+		It("counts the tweet and each pair of words found in it", func() {
+			now := time.Now()
+			clock.NowReturns(now)
+			oneHourAgo := now.Add(time.Hour * -1)
+
+			Expect(repo.IndexCooccurrences(ctx, "twitter", []string{keyword, "ketchup", "mayo"}, now)).To(Succeed())
+			Expect(repo.IndexCooccurrences(ctx, "twitter", []string{"ketchup", keyword}, now)).To(Succeed())
+			Expect(repo.IndexCooccurrences(ctx, "twitter", []string{keyword}, now)).To(Succeed())
+
+			tweets, err := repo.CountTweets(ctx, oneHourAgo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tweets).To(Equal(uint(3)))
+
+			count, err := repo.CountCooccurrences(ctx, keyword, "ketchup", oneHourAgo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(uint(2)))
+
+			count, err = repo.CountCooccurrences(ctx, "mayo", keyword, oneHourAgo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(uint(1)))
+
+			count, err = repo.CountCooccurrences(ctx, "ketchup", "mayo", oneHourAgo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(uint(1)))
+		})
+
+		It("only counts co-occurrences tweeted since the specified time", func() {
+			now := time.Now()
+			clock.NowReturns(now)
+
+			Expect(repo.IndexCooccurrences(ctx, "twitter", []string{keyword, "ketchup"}, now.Add(time.Hour*-3))).To(Succeed())
+			Expect(repo.IndexCooccurrences(ctx, "twitter", []string{keyword, "ketchup"}, now.Add(time.Hour*-1))).To(Succeed())
+
+			count, err := repo.CountCooccurrences(ctx, keyword, "ketchup", now.Add(time.Hour*-2))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(uint(1)))
+
+			tweets, err := repo.CountTweets(ctx, now.Add(time.Hour*-2))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tweets).To(Equal(uint(1)))
+		})
+
+		It("deletes co-occurrences from before the cutoff on cleanup", func() {
+			now := time.Now()
+			clock.NowReturns(now)
+
+			Expect(repo.IndexCooccurrences(ctx, "twitter", []string{keyword, "ketchup", "mayo"}, now.Add(time.Hour*-3))).To(Succeed())
+			Expect(repo.IndexCooccurrences(ctx, "twitter", []string{keyword, "mayo"}, now)).To(Succeed())
+			Expect(repo.Cleanup(ctx, keyword, now.Add(time.Hour*-2))).To(Succeed())
+
+			Expect(redis.Int(redisConn.Do("ZCARD", "cooccurrence:ketchup:sriracha"))).To(Equal(0))
+			Expect(redis.Int(redisConn.Do("ZCARD", "cooccurrence:mayo:sriracha"))).To(Equal(1))
+			Expect(redis.Int(redisConn.Do("ZCARD", "cooccurrence:tweets"))).To(Equal(1))
+			Expect(redis.Int(redisConn.Do("ZCARD", "cooccurrence:ketchup:mayo"))).To(Equal(1))
+		})
+	})
+
+	Describe("contexts", func() {
+
+		var (
+			hung     net.Listener
+			hungRepo *indexer.WordCountRepository
+		)
+
+		BeforeEach(func() {
+			var err error
+			hung, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			go func(listener net.Listener) {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+				}
+			}(hung)
+			hungRepo = indexer.New(hung.Addr().String(), clock)
+		})
+
+		AfterEach(func() {
+			hungRepo.Close()
+			hung.Close()
+		})
+
+		It("does not call redis once the context is done", func() {
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			Expect(repo.IndexWord(cancelled, keyword)).To(Equal(context.Canceled))
+			count, err := redis.Int(redisConn.Do("ZCARD", keyword))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeZero())
+		})
+
+		It("interrupts a call when the context is cancelled", func() {
+			cancelled, cancel := context.WithCancel(ctx)
+			time.AfterFunc(50*time.Millisecond, cancel)
+			_, err := hungRepo.Count(cancelled, keyword, time.Now())
+			Expect(err).To(Equal(context.Canceled))
+		})
+
+		It("interrupts a call when the context's deadline passes", func() {
+			expiring, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			Expect(hungRepo.Ping(expiring)).To(Equal(context.DeadlineExceeded))
+		})
+
 	})
 })
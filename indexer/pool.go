@@ -0,0 +1,115 @@
+package indexer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const idleTimeout = time.Minute
+
+// aLongTimeAgo is a deadline in the past, which interrupts reads and writes
+// already blocked on a connection.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// pool keeps idle connections to Redis for reuse. Unlike redis.Pool, it keeps
+// hold of each connection's network connection, so that a call can be
+// interrupted when its context is done.
+type pool struct {
+	address string
+
+	mutex  sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+type conn struct {
+	redis.Conn
+	net       net.Conn
+	idleSince time.Time
+}
+
+func newPool(address string) *pool {
+	return &pool{address: address}
+}
+
+// do makes call with a connection whose deadline is ctx's, interrupting it if
+// ctx is done first. The connection is only reused if call succeeds.
+func (p *pool) do(ctx context.Context, call func(redis.Conn) (interface{}, error)) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if err := c.net.SetDeadline(deadline); err != nil {
+		c.Close()
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		c.net.SetDeadline(aLongTimeAgo)
+	})
+	reply, err := call(c)
+	interrupted := !stop()
+	if err != nil || interrupted {
+		c.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		// The connection's deadline can pass a moment before ctx notices
+		// its own has.
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && hasDeadline {
+			return nil, context.DeadlineExceeded
+		}
+		return reply, err
+	}
+	p.put(c)
+	return reply, nil
+}
+
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.mutex.Lock()
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(c.idleSince) < idleTimeout {
+			p.mutex.Unlock()
+			return c, nil
+		}
+		c.Close()
+	}
+	p.mutex.Unlock()
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: redis.NewConn(netConn, 0, 0), net: netConn}, nil
+}
+
+func (p *pool) put(c *conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		c.Close()
+		return
+	}
+	c.idleSince = time.Now()
+	p.idle = append(p.idle, c)
+}
+
+func (p *pool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+	return nil
+}
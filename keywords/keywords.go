@@ -0,0 +1,171 @@
+package keywords
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Definition describes the ways in which a single cliché can be written.
+// Phrases and hashtags are matched case-insensitively, patterns are Go
+// regular expressions matched against the original tweet text.
+type Definition struct {
+	Phrases  []string `json:"phrases"`
+	Patterns []string `json:"patterns"`
+	Hashtags []string `json:"hashtags"`
+}
+
+type Set struct {
+	keywords []keyword
+}
+
+type keyword struct {
+	name     string
+	phrases  []string
+	patterns []*regexp.Regexp
+}
+
+// Load reads a keyword definition file. See Parse for the file format.
+func Load(path string) (*Set, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse reads a JSON object mapping each canonical keyword name to its
+// definition, e.g.
+//
+//	{"at the end of the day": {"phrases": ["at the end of the day"], "patterns": ["(?i)\\bateotd\\b"], "hashtags": ["ateotd"]}}
+func Parse(r io.Reader) (*Set, error) {
+	definitions := make(map[string]Definition)
+	if err := json.NewDecoder(r).Decode(&definitions); err != nil {
+		return nil, err
+	}
+	return New(definitions)
+}
+
+func New(definitions map[string]Definition) (*Set, error) {
+	set := &Set{}
+	for name, definition := range definitions {
+		if name == "" {
+			return nil, fmt.Errorf("keyword definition has no name")
+		}
+		k := keyword{name: name}
+		for _, phrase := range definition.Phrases {
+			k.phrases = append(k.phrases, strings.ToLower(phrase))
+		}
+		for _, hashtag := range definition.Hashtags {
+			k.phrases = append(k.phrases, "#"+strings.ToLower(strings.TrimPrefix(hashtag, "#")))
+		}
+		for _, pattern := range definition.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("keyword %s: %s", name, err)
+			}
+			k.patterns = append(k.patterns, re)
+		}
+		if len(k.phrases) == 0 && len(k.patterns) == 0 {
+			return nil, fmt.Errorf("keyword %s has no phrases, patterns or hashtags", name)
+		}
+		set.keywords = append(set.keywords, k)
+	}
+	sort.Sort(byName(set.keywords))
+	return set, nil
+}
+
+// With returns a new set containing these keywords and the specified phrases,
+// each tracked as a keyword in its own right. Phrases that are already the
+// name of a keyword are ignored.
+func (set *Set) With(phrases []string) *Set {
+	extended := &Set{keywords: append([]keyword{}, set.keywords...)}
+	for _, phrase := range phrases {
+		if contains(extended.Names(), phrase) {
+			continue
+		}
+		extended.keywords = append(extended.keywords, keyword{
+			name:    phrase,
+			phrases: []string{strings.ToLower(phrase)},
+		})
+	}
+	sort.Sort(byName(extended.keywords))
+	return extended
+}
+
+// Names returns the canonical name of every keyword, in alphabetical order.
+func (set *Set) Names() []string {
+	names := make([]string, len(set.keywords))
+	for i, k := range set.keywords {
+		names[i] = k.name
+	}
+	return names
+}
+
+// Track returns the value of the Twitter streaming API track parameter. Only
+// phrases and hashtags can be tracked, so patterns only match tweets that were
+// streamed because of some other literal.
+func (set *Set) Track() string {
+	var literals []string
+	for _, k := range set.keywords {
+		literals = append(literals, k.phrases...)
+	}
+	return strings.Join(literals, ",")
+}
+
+// Literals returns the phrases and hashtags of each keyword, by canonical
+// name, for streaming APIs that take a rule per keyword rather than a single
+// track parameter.
+func (set *Set) Literals() map[string][]string {
+	literals := make(map[string][]string)
+	for _, k := range set.keywords {
+		literals[k.name] = append([]string{}, k.phrases...)
+	}
+	return literals
+}
+
+// Match returns the canonical names of the keywords found in text.
+func (set *Set) Match(text string) []string {
+	var found []string
+	lower := strings.ToLower(text)
+	for _, k := range set.keywords {
+		if k.matches(text, lower) {
+			found = append(found, k.name)
+		}
+	}
+	return found
+}
+
+func (k keyword) matches(text, lower string) bool {
+	for _, phrase := range k.phrases {
+		if strings.Contains(lower, phrase) {
+			return true
+		}
+	}
+	for _, pattern := range k.patterns {
+		if pattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+type byName []keyword
+
+func (k byName) Len() int           { return len(k) }
+func (k byName) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k byName) Less(i, j int) bool { return k[i].name < k[j].name }
@@ -0,0 +1,13 @@
+package keywords_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestKeywords(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Keywords Suite")
+}
@@ -0,0 +1,119 @@
+package keywords_test
+
+import (
+	"strings"
+
+	"github.com/craigfurman/bovine/keywords"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Keywords", func() {
+
+	var (
+		set *keywords.Set
+		err error
+	)
+
+	BeforeEach(func() {
+		set, err = keywords.Parse(strings.NewReader(`{
+			"at the end of the day": {
+				"phrases": ["At the end of the day"],
+				"patterns": ["(?i)\\bateotd\\b"],
+				"hashtags": ["#EndOfTheDay"]
+			},
+			"bottom line": {
+				"phrases": ["bottom line"]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("Names", func() {
+
+		It("returns canonical keyword names in alphabetical order", func() {
+			Expect(set.Names()).To(Equal([]string{"at the end of the day", "bottom line"}))
+		})
+	})
+
+	Describe("With", func() {
+
+		It("adds phrases as keywords", func() {
+			extended := set.With([]string{"circle back", "bottom line"})
+			Expect(extended.Names()).To(Equal([]string{"at the end of the day", "bottom line", "circle back"}))
+			Expect(extended.Match("Let's Circle Back")).To(ConsistOf("circle back"))
+			Expect(extended.Track()).To(Equal("at the end of the day,#endoftheday,bottom line,circle back"))
+		})
+
+		It("does not change the original set", func() {
+			set.With([]string{"circle back"})
+			Expect(set.Names()).To(HaveLen(2))
+		})
+	})
+
+	Describe("Track", func() {
+
+		It("joins the phrases and hashtags of every keyword", func() {
+			Expect(set.Track()).To(Equal("at the end of the day,#endoftheday,bottom line"))
+		})
+	})
+
+	Describe("Literals", func() {
+
+		It("returns the phrases and hashtags of each keyword", func() {
+			Expect(set.Literals()).To(Equal(map[string][]string{
+				"at the end of the day": {"at the end of the day", "#endoftheday"},
+				"bottom line":           {"bottom line"},
+			}))
+		})
+	})
+
+	Describe("Match", func() {
+
+		It("matches phrases case-insensitively", func() {
+			Expect(set.Match("AT THE END OF THE DAY, it's the bottom line")).To(Equal([]string{"at the end of the day", "bottom line"}))
+		})
+
+		It("matches regular expressions", func() {
+			Expect(set.Match("ATEOTD who cares")).To(ConsistOf("at the end of the day"))
+			Expect(set.Match("plateotdish")).To(BeEmpty())
+		})
+
+		It("matches hashtags", func() {
+			Expect(set.Match("so tired #endoftheday")).To(ConsistOf("at the end of the day"))
+		})
+
+		It("reports each keyword once", func() {
+			Expect(set.Match("at the end of the day #ateotd #endoftheday")).To(ConsistOf("at the end of the day"))
+		})
+	})
+
+	Context("when a pattern is not a valid regular expression", func() {
+
+		It("returns an error", func() {
+			_, err := keywords.New(map[string]keywords.Definition{
+				"broken": {Patterns: []string{"("}},
+			})
+			Expect(err).To(MatchError(ContainSubstring("keyword broken")))
+		})
+	})
+
+	Context("when a keyword has nothing to match", func() {
+
+		It("returns an error", func() {
+			_, err := keywords.New(map[string]keywords.Definition{
+				"empty": {},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the definition file cannot be read", func() {
+
+		It("returns an error", func() {
+			_, err := keywords.Load("/does/not/exist.json")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,202 @@
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// acquire takes the lease if it is free, storing the holder's ID alongside a
+// fencing token that increases with every new leader.
+var acquire = redis.NewScript(2, `
+local token = tonumber(redis.call("GET", KEYS[2]) or "0") + 1
+local value = ARGV[1] .. ":" .. token
+if not redis.call("SET", KEYS[1], value, "NX", "PX", ARGV[2]) then
+	return 0
+end
+redis.call("SET", KEYS[2], token)
+return token
+`)
+
+// renew extends the lease only if this process still holds it.
+var renew = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// release gives up the lease only if this process still holds it, so that a
+// leader whose lease already expired cannot release its successor's.
+var release = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Lock elects a single leader among processes sharing a Redis. The leader
+// holds a lease on a key and keeps renewing it; if the leader dies the lease
+// expires after ttl, and one of the processes waiting in Acquire takes over.
+type Lock struct {
+	connPool *redis.Pool
+	key      string
+	id       string
+	ttl      time.Duration
+	token    int64
+	lost     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     sync.WaitGroup
+}
+
+// New creates a lock on key whose lease lasts ttl. Each call to Redis times out
+// after half the renewal interval, so that a hung renewal cannot keep the
+// leader acting after its lease has expired.
+func New(redisURL, key string, ttl time.Duration) *Lock {
+	timeout := ttl / 6
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.DialTimeout("tcp", redisURL, timeout, timeout, timeout)
+		},
+		IdleTimeout: time.Minute * 1,
+	}
+	return &Lock{
+		connPool: pool,
+		key:      key,
+		id:       newID(),
+		ttl:      ttl,
+		lost:     make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Acquire blocks until this process holds the lock, then renews it in the
+// background until it is lost or released. It returns false if the lock was
+// released or closed, or ctx was done, before being acquired.
+func (l *Lock) Acquire(ctx context.Context) bool {
+	for !l.tryAcquire() {
+		select {
+		case <-time.After(l.interval()):
+		case <-l.stop:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	l.done.Add(1)
+	go l.renewPeriodically()
+	return true
+}
+
+// Token returns the fencing token of this process's lease, which is greater
+// than that of every leader before it. It is zero until the lock is acquired.
+func (l *Lock) Token() int64 {
+	return l.token
+}
+
+// TokenKey is the key at which the fencing token of the latest leader is
+// stored, for writes to be fenced with.
+func (l *Lock) TokenKey() string {
+	return tokenKey(l.key)
+}
+
+// Lost is closed if the lease is about to expire or another process takes over
+// the lock, after which this process must stop acting as the leader.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release stops renewing the lease and gives it up, so that a standby can take
+// over without waiting for it to expire.
+func (l *Lock) Release() error {
+	l.stopRenewing()
+	if l.token == 0 {
+		return nil
+	}
+	conn := l.connPool.Get()
+	defer conn.Close()
+	_, err := release.Do(conn, l.key, l.value())
+	return err
+}
+
+// Close stops renewing or waiting for the lock, without releasing it.
+func (l *Lock) Close() error {
+	l.stopRenewing()
+	return l.connPool.Close()
+}
+
+func (l *Lock) stopRenewing() {
+	l.stopOnce.Do(func() { close(l.stop) })
+	l.done.Wait()
+}
+
+func (l *Lock) tryAcquire() bool {
+	conn := l.connPool.Get()
+	defer conn.Close()
+	token, err := redis.Int64(acquire.Do(conn, l.key, tokenKey(l.key), l.id, l.milliseconds()))
+	if err != nil || token == 0 {
+		return false
+	}
+	l.token = token
+	return true
+}
+
+// renewPeriodically renews the lease several times per TTL, giving up once it
+// has been taken by someone else, or has not been renewed for so long that it
+// would expire before the next attempt. The lease is timed from when each
+// renewal was sent, since Redis extends it some time before replying.
+func (l *Lock) renewPeriodically() {
+	defer l.done.Done()
+	ticker := time.NewTicker(l.interval())
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			sent := time.Now()
+			conn := l.connPool.Get()
+			held, err := redis.Int(renew.Do(conn, l.key, l.value(), l.milliseconds()))
+			conn.Close()
+			if err == nil && held == 1 {
+				renewed = sent
+				continue
+			}
+			if err == nil || time.Since(renewed) >= l.ttl-l.interval() {
+				close(l.lost)
+				return
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *Lock) value() string {
+	return fmt.Sprintf("%s:%d", l.id, l.token)
+}
+
+func (l *Lock) interval() time.Duration {
+	return l.ttl / 3
+}
+
+func (l *Lock) milliseconds() int64 {
+	return int64(l.ttl / time.Millisecond)
+}
+
+func tokenKey(key string) string {
+	return key + ":token"
+}
+
+// newID identifies this process as the holder of a lock.
+func newID() string {
+	hostname, _ := os.Hostname()
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("%s:%d:%x", hostname, os.Getpid(), random)
+}
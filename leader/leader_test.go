@@ -0,0 +1,215 @@
+package leader_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/leader"
+
+	"github.com/garyburd/redigo/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// proxy forwards connections to Redis until it hangs, after which it stops
+// forwarding requests, so that callers wait for replies that never come.
+type proxy struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	hung     bool
+	conns    []net.Conn
+}
+
+func newProxy(target string) *proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	p := &proxy{listener: listener}
+	go p.serve(target)
+	return p
+}
+
+func (p *proxy) serve(target string) {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		p.mutex.Lock()
+		p.conns = append(p.conns, client, upstream)
+		p.mutex.Unlock()
+		go p.forward(upstream, client)
+		go io.Copy(client, upstream)
+	}
+}
+
+func (p *proxy) forward(upstream, client net.Conn) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			return
+		}
+		p.mutex.Lock()
+		hung := p.hung
+		p.mutex.Unlock()
+		if !hung {
+			upstream.Write(buf[:n])
+		}
+	}
+}
+
+func (p *proxy) address() string {
+	return p.listener.Addr().String()
+}
+
+func (p *proxy) hang() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.hung = true
+}
+
+func (p *proxy) close() {
+	p.listener.Close()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+}
+
+var _ = Describe("Lock", func() {
+
+	const (
+		redisURL = "localhost:6379"
+		key      = "test:leader"
+		ttl      = 300 * time.Millisecond
+	)
+
+	var (
+		first, second *leader.Lock
+
+		redisConn redis.Conn
+	)
+
+	acquire := func(lock *leader.Lock) <-chan struct{} {
+		acquired := make(chan struct{})
+		go func() {
+			if lock.Acquire(context.Background()) {
+				close(acquired)
+			}
+		}()
+		return acquired
+	}
+
+	BeforeEach(func() {
+		var err error
+		redisConn, err = redis.Dial("tcp", redisURL)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = redisConn.Do("DEL", key, key+":token")
+		Expect(err).ToNot(HaveOccurred())
+		first = leader.New(redisURL, key, ttl)
+		second = leader.New(redisURL, key, ttl)
+	})
+
+	AfterEach(func() {
+		first.Close()
+		second.Close()
+		redisConn.Close()
+	})
+
+	It("is held by one process at a time", func() {
+		Eventually(acquire(first)).Should(BeClosed())
+		Consistently(acquire(second), 3*ttl).ShouldNot(BeClosed())
+		Expect(first.Lost()).NotTo(BeClosed())
+	})
+
+	It("is taken over by a waiting process once the leader stops renewing it", func() {
+		Eventually(acquire(first)).Should(BeClosed())
+		secondAcquired := acquire(second)
+		first.Close()
+		Eventually(secondAcquired, 3*ttl).Should(BeClosed())
+	})
+
+	It("is lost if another process takes it over", func() {
+		Eventually(acquire(first)).Should(BeClosed())
+		_, err := redisConn.Do("SET", key, "someone else")
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(first.Lost(), 3*ttl).Should(BeClosed())
+	})
+	It("steps down before its lease expires if Redis stops replying", func() {
+		p := newProxy(redisURL)
+		defer p.close()
+		lock := leader.New(p.address(), key, ttl)
+		defer lock.Close()
+		Eventually(acquire(lock)).Should(BeClosed())
+
+		p.hang()
+		Eventually(lock.Lost(), 2*ttl).Should(BeClosed())
+		remaining, err := redis.Int64(redisConn.Do("PTTL", key))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remaining).To(BeNumerically(">", 0))
+	})
+
+	It("gives each new leader a greater fencing token", func() {
+		Eventually(acquire(first)).Should(BeClosed())
+		secondAcquired := acquire(second)
+		Expect(first.Release()).To(Succeed())
+		Eventually(secondAcquired).Should(BeClosed())
+		Expect(first.Token()).To(BeNumerically(">", 0))
+		Expect(second.Token()).To(BeNumerically(">", first.Token()))
+	})
+
+	It("is taken over by a waiting process as soon as the leader releases it", func() {
+		Eventually(acquire(first)).Should(BeClosed())
+		secondAcquired := acquire(second)
+		Expect(first.Release()).To(Succeed())
+		Eventually(secondAcquired, ttl/2).Should(BeClosed())
+		Expect(first.Lost()).NotTo(BeClosed())
+	})
+
+	It("cannot be released by a leader whose lease has expired", func() {
+		Eventually(acquire(first)).Should(BeClosed())
+		_, err := redisConn.Do("DEL", key)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(acquire(second)).Should(BeClosed())
+
+		Expect(first.Release()).To(Succeed())
+		holder, err := redis.String(redisConn.Do("GET", key))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(holder).To(HaveSuffix(fmt.Sprintf(":%d", second.Token())))
+	})
+
+	It("stops waiting once released", func() {
+		Eventually(acquire(first)).Should(BeClosed())
+		stopped := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(second.Acquire(context.Background())).To(BeFalse())
+			close(stopped)
+		}()
+		Expect(second.Release()).To(Succeed())
+		Eventually(stopped).Should(BeClosed())
+	})
+
+	It("stops waiting once ctx is done", func() {
+		Eventually(acquire(first)).Should(BeClosed())
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(second.Acquire(ctx)).To(BeFalse())
+			close(stopped)
+		}()
+		cancel()
+		Eventually(stopped).Should(BeClosed())
+	})
+})
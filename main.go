@@ -1,41 +1,107 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+)
 
-	"github.com/craigfurman/bovine/gatherer"
-	"github.com/craigfurman/bovine/indexer"
-	"github.com/craigfurman/bovine/web"
+const usage = `usage: bovine [COMMAND] [FLAGS] [ARGS]
 
-	"github.com/codegangsta/negroni"
-)
+Commands:
+  all                 gather tweets and serve the API (default)
+  serve               serve the API only
+  gather              gather tweets only
+  count KEYWORD       print how often KEYWORD was tweeted
+  cleanup             delete counts older than --before
+  backfill ARCHIVE... index keyword hits from archives of tweets
+  export              print counts per keyword and time bucket as CSV
+
+Run 'bovine COMMAND -h' for the flags of each command. Flags default to the
+environment variables named in their descriptions.
+`
+
+var commands = map[string]func(args []string) error{
+	"all":      all,
+	"serve":    serve,
+	"gather":   gather,
+	"count":    count,
+	"cleanup":  cleanup,
+	"backfill": backfill,
+	"export":   export,
+}
 
 func main() {
-	commaSeparatedKeywords := os.Getenv("KEYWORDS")
-	keywords := strings.Split(commaSeparatedKeywords, ",")
+	name, args := "all", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := command(args); err != nil {
+		fmt.Fprintf(os.Stderr, "bovine %s: %s\n", name, err)
+		os.Exit(1)
+	}
+}
 
-	// TODO make redis URL configurable. Use VCAP services if on CF
-	i := indexer.New("localhost:6379", clock{})
-	defer i.Close()
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage of bovine %s:\n", name)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseArgs parses flags given before, after or between the positional
+// arguments, as in `count bacon --since 24h`, and returns the positional
+// arguments. Everything after "--" is positional.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		rest := flags.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
 
-	g := gatherer.New(i, os.Getenv("TWITTER_CONSUMER_KEY"), os.Getenv("TWITTER_CONSUMER_SECRET"), os.Getenv("TWITTER_ACCESS_TOKEN"), os.Getenv("TWITTER_ACCESS_TOKEN_SECRET"), "https://stream.twitter.com")
-	go g.Stream(commaSeparatedKeywords)
+// env returns the value of an environment variable, or def if it is unset.
+func env(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
 
-	api := web.New(i, keywords, clock{})
-	server := negroni.Classic()
-	server.UseHandler(api)
-	server.Run(fmt.Sprintf(":%s", port()))
+// envDuration parses an environment variable such as "10m", or returns def if
+// it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return d
+	}
+	return def
 }
 
-func port() string {
-	if os.Getenv("PORT") != "" {
-		return os.Getenv("PORT")
-	} else {
-		return "3000"
+// envInt parses an integer environment variable, or returns def if it is
+// unset or invalid.
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
 	}
+	return def
 }
 
 type clock struct{}
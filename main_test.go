@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("parseArgs", func() {
+
+	var since *time.Duration
+
+	parse := func(args ...string) []string {
+		flags := newFlagSet("count")
+		since = flags.Duration("since", 24*time.Hour, "")
+		return parseArgs(flags, args)
+	}
+
+	It("parses flags before the positional arguments", func() {
+		Expect(parse("--since", "1h", "bacon")).To(Equal([]string{"bacon"}))
+		Expect(*since).To(Equal(time.Hour))
+	})
+
+	It("parses flags after the positional arguments", func() {
+		Expect(parse("bacon", "--since", "1h")).To(Equal([]string{"bacon"}))
+		Expect(*since).To(Equal(time.Hour))
+	})
+
+	It("parses flags between the positional arguments", func() {
+		Expect(parse("bacon", "--since", "1h", "eggs")).To(Equal([]string{"bacon", "eggs"}))
+		Expect(*since).To(Equal(time.Hour))
+	})
+
+	It("treats everything after -- as positional", func() {
+		Expect(parse("bacon", "--", "--since", "1h")).To(Equal([]string{"bacon", "--since", "1h"}))
+		Expect(*since).To(Equal(24 * time.Hour))
+	})
+})
@@ -0,0 +1,38 @@
+package period
+
+import (
+	"fmt"
+	"time"
+)
+
+// Period is a window of time ending now that counts are reported over, such
+// as the last day for /wordcount/day.
+type Period struct {
+	Name   string
+	Window time.Duration
+}
+
+var (
+	Hour = Period{Name: "hour", Window: time.Hour}
+	Day  = Period{Name: "day", Window: 24 * time.Hour}
+	Week = Period{Name: "week", Window: 7 * 24 * time.Hour}
+
+	// Standard lists the periods that rolling counts are kept for, shortest
+	// first.
+	Standard = []Period{Hour, Day, Week}
+)
+
+// Parse returns the standard period with the given name.
+func Parse(name string) (Period, error) {
+	for _, p := range Standard {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return Period{}, fmt.Errorf("unknown period %q, expected hour, day or week", name)
+}
+
+// Since returns the start of the period ending at now.
+func (p Period) Since(now time.Time) time.Time {
+	return now.Add(-p.Window)
+}
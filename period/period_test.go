@@ -0,0 +1,33 @@
+package period_test
+
+import (
+	"time"
+
+	"github.com/craigfurman/bovine/period"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Period", func() {
+
+	It("parses the standard periods by name", func() {
+		for _, name := range []string{"hour", "day", "week"} {
+			p, err := period.Parse(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Name).To(Equal(name))
+		}
+		week, _ := period.Parse("week")
+		Expect(week.Window).To(Equal(7 * 24 * time.Hour))
+	})
+
+	It("rejects unknown periods", func() {
+		_, err := period.Parse("fortnight")
+		Expect(err).To(MatchError(`unknown period "fortnight", expected hour, day or week`))
+	})
+
+	It("starts a window before now", func() {
+		now := time.Now()
+		Expect(period.Day.Since(now)).To(Equal(now.Add(-24 * time.Hour)))
+	})
+})
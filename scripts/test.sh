@@ -1,4 +1,7 @@
 #!/bin/bash -e
 
+# Dependencies are vendored with godep rather than Go modules.
+export GO111MODULE=off
+
 go get -u -v github.com/onsi/ginkgo/ginkgo
 GOPATH=$PWD/Godeps/_workspace:$GOPATH ginkgo -r
@@ -0,0 +1,157 @@
+package sentiment
+
+// lexicon maps words to a valence between -5 (very negative) and 5 (very
+// positive), in the spirit of the AFINN word list.
+var lexicon = map[string]int{
+	"agree":        2,
+	"amazing":      5,
+	"angry":        -3,
+	"annoyed":      -2,
+	"annoying":     -2,
+	"awesome":      5,
+	"awful":        -3,
+	"bad":          -2,
+	"bastard":      -5,
+	"beautiful":    3,
+	"benefit":      2,
+	"best":         3,
+	"better":       2,
+	"bored":        -1,
+	"boring":       -1,
+	"breathtaking": 5,
+	"brilliant":    5,
+	"broken":       -2,
+	"calm":         1,
+	"catastrophic": -4,
+	"celebrate":    3,
+	"confused":     -2,
+	"cool":         2,
+	"crap":         -3,
+	"dead":         -3,
+	"delighted":    4,
+	"disappointed": -2,
+	"disaster":     -3,
+	"disgusted":    -4,
+	"disgusting":   -3,
+	"doubt":        -1,
+	"dumb":         -3,
+	"easy":         2,
+	"enjoy":        2,
+	"enjoyed":      2,
+	"excellent":    4,
+	"excited":      3,
+	"exciting":     3,
+	"fabulous":     4,
+	"fail":         -2,
+	"failed":       -2,
+	"failing":      -2,
+	"fair":         1,
+	"fantastic":    5,
+	"favorite":     2,
+	"favourite":    2,
+	"fear":         -2,
+	"fine":         2,
+	"fun":          3,
+	"furious":      -4,
+	"glad":         3,
+	"good":         2,
+	"grateful":     2,
+	"great":        3,
+	"happy":        3,
+	"hate":         -3,
+	"hated":        -3,
+	"hell":         -4,
+	"helpful":      2,
+	"hilarious":    3,
+	"hope":         2,
+	"horrible":     -3,
+	"impressive":   2,
+	"incredible":   4,
+	"interested":   1,
+	"interesting":  2,
+	"joy":          3,
+	"kind":         2,
+	"laugh":        2,
+	"like":         2,
+	"liked":        2,
+	"lol":          2,
+	"lost":         -2,
+	"love":         4,
+	"loved":        4,
+	"lovely":       3,
+	"loving":       4,
+	"magnificent":  4,
+	"marvellous":   4,
+	"marvelous":    4,
+	"mess":         -2,
+	"miss":         -1,
+	"missed":       -1,
+	"nice":         2,
+	"nightmare":    -3,
+	"ok":           1,
+	"okay":         1,
+	"outstanding":  5,
+	"pathetic":     -3,
+	"perfect":      4,
+	"pleased":      2,
+	"poor":         -2,
+	"problem":      -1,
+	"proud":        3,
+	"recommend":    2,
+	"sad":          -2,
+	"safe":         1,
+	"scared":       -2,
+	"sick":         -2,
+	"slow":         -2,
+	"smile":        2,
+	"sorry":        -1,
+	"stupid":       -3,
+	"success":      2,
+	"super":        3,
+	"superb":       5,
+	"support":      1,
+	"sure":         1,
+	"terrible":     -3,
+	"thank":        2,
+	"thanks":       2,
+	"thrilled":     5,
+	"tired":        -1,
+	"ugly":         -2,
+	"unclear":      -1,
+	"upset":        -2,
+	"useless":      -3,
+	"wait":         -1,
+	"weak":         -2,
+	"win":          2,
+	"winning":      2,
+	"wonderful":    4,
+	"worried":      -2,
+	"worst":        -3,
+	"wow":          4,
+	"wrong":        -2,
+	"yay":          2,
+	"yes":          1,
+}
+
+var negations = map[string]bool{
+	"ain't":   true,
+	"aren't":  true,
+	"arent":   true,
+	"can't":   true,
+	"cant":    true,
+	"didn't":  true,
+	"didnt":   true,
+	"doesn't": true,
+	"doesnt":  true,
+	"don't":   true,
+	"dont":    true,
+	"isn't":   true,
+	"isnt":    true,
+	"never":   true,
+	"no":      true,
+	"not":     true,
+	"wasn't":  true,
+	"wasnt":   true,
+	"won't":   true,
+	"wont":    true,
+}
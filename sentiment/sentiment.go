@@ -0,0 +1,74 @@
+package sentiment
+
+import (
+	"strings"
+	"unicode"
+)
+
+type Scorer struct {
+	lexicon map[string]int
+}
+
+// New returns a Scorer using the word list bundled with bovine.
+func New() *Scorer {
+	return &Scorer{lexicon: lexicon}
+}
+
+// Score sums the valence of every word in text that appears in the lexicon.
+// Positive scores are positive in tone, negative scores negative. A word
+// directly preceded by a negation such as "not" has its valence flipped.
+func (s *Scorer) Score(text string) int {
+	score := 0
+	negated := false
+	for _, word := range tokenize(text) {
+		if negations[word] {
+			negated = true
+			continue
+		}
+		valence := s.lexicon[word]
+		if negated {
+			valence = -valence
+		}
+		score += valence
+		negated = false
+	}
+	return score
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+}
+
+// Tally aggregates the scores of many tweets.
+type Tally struct {
+	Sum      int
+	Positive uint
+	Negative uint
+	Neutral  uint
+}
+
+func (t *Tally) Add(score int) {
+	t.Sum += score
+	switch {
+	case score > 0:
+		t.Positive++
+	case score < 0:
+		t.Negative++
+	default:
+		t.Neutral++
+	}
+}
+
+func (t Tally) Total() uint {
+	return t.Positive + t.Negative + t.Neutral
+}
+
+// Average returns the mean score of all tallied tweets, or 0 if there are none.
+func (t Tally) Average() float64 {
+	if t.Total() == 0 {
+		return 0
+	}
+	return float64(t.Sum) / float64(t.Total())
+}
@@ -0,0 +1,13 @@
+package sentiment_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSentiment(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Sentiment Suite")
+}
@@ -0,0 +1,57 @@
+package sentiment_test
+
+import (
+	"github.com/craigfurman/bovine/sentiment"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sentiment", func() {
+
+	Describe("Scorer", func() {
+
+		var scorer *sentiment.Scorer
+
+		BeforeEach(func() {
+			scorer = sentiment.New()
+		})
+
+		It("scores positive text above zero", func() {
+			Expect(scorer.Score("I LOVE this, it's great!")).To(Equal(7))
+		})
+
+		It("scores negative text below zero", func() {
+			Expect(scorer.Score("what a terrible, boring meeting")).To(Equal(-4))
+		})
+
+		It("scores text without any known words as zero", func() {
+			Expect(scorer.Score("at the end of the day")).To(BeZero())
+		})
+
+		It("flips the valence of negated words", func() {
+			Expect(scorer.Score("this is not good")).To(Equal(-2))
+		})
+	})
+
+	Describe("Tally", func() {
+
+		It("counts positive, negative and neutral scores", func() {
+			var tally sentiment.Tally
+			tally.Add(3)
+			tally.Add(-1)
+			tally.Add(0)
+			tally.Add(2)
+
+			Expect(tally.Positive).To(Equal(uint(2)))
+			Expect(tally.Negative).To(Equal(uint(1)))
+			Expect(tally.Neutral).To(Equal(uint(1)))
+			Expect(tally.Total()).To(Equal(uint(4)))
+			Expect(tally.Average()).To(BeNumerically("~", 1))
+		})
+
+		It("averages to zero when empty", func() {
+			Expect(sentiment.Tally{}.Average()).To(BeZero())
+		})
+	})
+})
@@ -0,0 +1,289 @@
+// Package spool is a durable, append-only queue of keyword counts on local
+// disk, holding counts that could not be stored until they can be replayed.
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy is when appended records are flushed to disk with fsync.
+type Policy string
+
+const (
+	// FsyncAlways syncs every append, so no acknowledged record is lost if
+	// the machine crashes.
+	FsyncAlways Policy = "always"
+	// FsyncInterval syncs once a second, losing at most a second of records
+	// if the machine crashes.
+	FsyncInterval Policy = "interval"
+	// FsyncNever leaves syncing to the operating system.
+	FsyncNever Policy = "never"
+
+	syncInterval = time.Second
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch policy := Policy(s); policy {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown fsync policy %s, expected always, interval or never", s)
+}
+
+// Record is a keyword count, kept with the time it was counted at so that
+// replaying it later counts it at the same time.
+type Record struct {
+	Source string    `json:"source"`
+	Word   string    `json:"word"`
+	At     time.Time `json:"at"`
+}
+
+// Spool appends records to a file of newline delimited JSON. The offset up to
+// which records have been replayed is kept alongside it in a file with the
+// suffix ".offset", and both are truncated once every record is replayed.
+type Spool struct {
+	path   string
+	policy Policy
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	depth  int
+	dirty  bool
+	offset int64
+
+	replayMutex sync.Mutex
+	stop        chan struct{}
+	closeOnce   sync.Once
+	done        sync.WaitGroup
+}
+
+// Open opens the spool at path, creating it if it does not exist, and
+// discarding a partially written record left by a crash.
+func Open(path string, policy Policy) (*Spool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{path: path, policy: policy, file: file, stop: make(chan struct{})}
+	if err := s.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if policy == FsyncInterval {
+		s.done.Add(1)
+		go s.syncPeriodically()
+	}
+	return s, nil
+}
+
+// recover finds the end of the last complete record, the replayed offset and
+// the number of records left to replay.
+func (s *Spool) recover() error {
+	contents, err := ioutil.ReadAll(s.file)
+	if err != nil {
+		return err
+	}
+	complete := int64(bytes.LastIndexByte(contents, '\n') + 1)
+	if complete < int64(len(contents)) {
+		if err := s.file.Truncate(complete); err != nil {
+			return err
+		}
+	}
+	if _, err := s.file.Seek(complete, io.SeekStart); err != nil {
+		return err
+	}
+	s.size = complete
+	offset, err := ioutil.ReadFile(s.offsetPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(offset) > 0 {
+		if s.offset, err = strconv.ParseInt(strings.TrimSpace(string(offset)), 10, 64); err != nil {
+			return fmt.Errorf("corrupt spool offset %s: %s", s.offsetPath(), err)
+		}
+	}
+	if s.offset > s.size {
+		s.offset = s.size
+	}
+	s.depth = bytes.Count(contents[s.offset:complete], []byte{'\n'})
+	return nil
+}
+
+// Append adds a record to the end of the spool.
+func (s *Spool) Append(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	s.size += int64(len(line))
+	s.depth++
+	if s.policy == FsyncAlways {
+		return s.file.Sync()
+	}
+	s.dirty = true
+	return nil
+}
+
+// Depth returns the number of records waiting to be replayed.
+func (s *Spool) Depth() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.depth
+}
+
+// Replay applies records in the order they were appended, including any
+// appended while replaying, until apply fails or none are left. It returns
+// the number applied. Records that cannot be decoded are skipped. Once every
+// record is replayed the spool is emptied.
+func (s *Spool) Replay(apply func(Record) error) (int, error) {
+	s.replayMutex.Lock()
+	defer s.replayMutex.Unlock()
+	replayed := 0
+	for {
+		line, err := s.next()
+		if err != nil {
+			return replayed, err
+		}
+		if line == nil {
+			return replayed, s.compact()
+		}
+		var record Record
+		if err := json.Unmarshal(line, &record); err == nil {
+			if err := apply(record); err != nil {
+				return replayed, err
+			}
+			replayed++
+		}
+		if err := s.advance(int64(len(line))); err != nil {
+			return replayed, err
+		}
+	}
+}
+
+// next reads the record at the replay offset, or returns nil if there is
+// none.
+func (s *Spool) next() ([]byte, error) {
+	s.mutex.Lock()
+	offset, size := s.offset, s.size
+	s.mutex.Unlock()
+	if offset >= size {
+		return nil, nil
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(s.file, offset, size-offset)).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+// advance moves the replay offset past a replayed record, saving it so that
+// the record is not replayed again after a restart.
+func (s *Spool) advance(n int64) error {
+	s.mutex.Lock()
+	s.offset += n
+	s.depth--
+	offset := s.offset
+	s.mutex.Unlock()
+	return s.saveOffset(offset)
+}
+
+// compact empties the spool if nothing was appended since replaying.
+func (s *Spool) compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.offset < s.size || s.size == 0 {
+		return nil
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.size, s.offset, s.depth = 0, 0, 0
+	return s.saveOffset(0)
+}
+
+func (s *Spool) saveOffset(offset int64) error {
+	tmp := s.offsetPath() + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, offset); err != nil {
+		file.Close()
+		return err
+	}
+	if s.policy == FsyncAlways {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.offsetPath())
+}
+
+func (s *Spool) offsetPath() string {
+	return s.path + ".offset"
+}
+
+func (s *Spool) syncPeriodically() {
+	defer s.done.Done()
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sync()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Spool) sync() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	s.dirty = false
+	return s.file.Sync()
+}
+
+// Close waits for a replay in progress, syncs the spool, unless its policy is
+// never to, and closes it. Closing it again does nothing.
+func (s *Spool) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.replayMutex.Lock()
+		defer s.replayMutex.Unlock()
+		close(s.stop)
+		s.done.Wait()
+		if s.policy != FsyncNever {
+			s.sync()
+		}
+		err = s.file.Close()
+	})
+	return err
+}
@@ -0,0 +1,176 @@
+package spool_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/craigfurman/bovine/spool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Spool", func() {
+
+	var (
+		dir  string
+		path string
+		s    *spool.Spool
+		at   time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spool")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "counts.spool")
+		s, err = spool.Open(path, spool.FsyncAlways)
+		Expect(err).NotTo(HaveOccurred())
+		at = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	AfterEach(func() {
+		s.Close()
+		os.RemoveAll(dir)
+	})
+
+	appendWords := func(words ...string) {
+		for i, word := range words {
+			Expect(s.Append(spool.Record{Source: "twitter", Word: word, At: at.Add(time.Duration(i) * time.Second)})).To(Succeed())
+		}
+	}
+
+	replayAll := func() []spool.Record {
+		var replayed []spool.Record
+		_, err := s.Replay(func(r spool.Record) error {
+			replayed = append(replayed, r)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return replayed
+	}
+
+	It("replays records in the order they were appended, at their original times", func() {
+		appendWords("python", "ruby", "go")
+		Expect(s.Depth()).To(Equal(3))
+
+		replayed := replayAll()
+		Expect(replayed).To(HaveLen(3))
+		Expect(replayed[0].Word).To(Equal("python"))
+		Expect(replayed[0].Source).To(Equal("twitter"))
+		Expect(replayed[0].At).To(BeTemporally("==", at))
+		Expect(replayed[2].Word).To(Equal("go"))
+		Expect(s.Depth()).To(BeZero())
+	})
+
+	It("empties the file once everything is replayed", func() {
+		appendWords("python")
+		replayAll()
+		info, err := os.Stat(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeZero())
+
+		appendWords("ruby")
+		Expect(replayAll()).To(HaveLen(1))
+	})
+
+	Context("when replaying fails part way", func() {
+
+		It("resumes from the first record not replayed", func() {
+			appendWords("python", "ruby", "go")
+			n, err := s.Replay(func(r spool.Record) error {
+				if r.Word == "ruby" {
+					return errors.New("redis went away")
+				}
+				return nil
+			})
+			Expect(err).To(MatchError("redis went away"))
+			Expect(n).To(Equal(1))
+			Expect(s.Depth()).To(Equal(2))
+
+			replayed := replayAll()
+			Expect(replayed).To(HaveLen(2))
+			Expect(replayed[0].Word).To(Equal("ruby"))
+		})
+	})
+
+	It("can be closed twice", func() {
+		Expect(s.Close()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+	})
+
+	Context("after a restart", func() {
+
+		It("replays only the records not yet replayed", func() {
+			appendWords("python", "ruby", "go")
+			s.Replay(func(r spool.Record) error {
+				if r.Word == "go" {
+					return errors.New("redis went away")
+				}
+				return nil
+			})
+			Expect(s.Close()).To(Succeed())
+
+			var err error
+			s, err = spool.Open(path, spool.FsyncAlways)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Depth()).To(Equal(1))
+			replayed := replayAll()
+			Expect(replayed).To(HaveLen(1))
+			Expect(replayed[0].Word).To(Equal("go"))
+		})
+
+		It("discards a record that was only partly written", func() {
+			appendWords("python")
+			Expect(s.Close()).To(Succeed())
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = f.WriteString(`{"source":"twitter","wo`)
+			Expect(err).NotTo(HaveOccurred())
+			f.Close()
+
+			s, err = spool.Open(path, spool.FsyncAlways)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Depth()).To(Equal(1))
+			appendWords("ruby")
+			replayed := replayAll()
+			Expect(replayed).To(HaveLen(2))
+			Expect(replayed[1].Word).To(Equal("ruby"))
+		})
+	})
+
+	Context("with the interval fsync policy", func() {
+
+		It("keeps records across a restart", func() {
+			Expect(s.Close()).To(Succeed())
+			var err error
+			s, err = spool.Open(path, spool.FsyncInterval)
+			Expect(err).NotTo(HaveOccurred())
+			appendWords("python", "ruby")
+			Expect(s.Close()).To(Succeed())
+
+			s, err = spool.Open(path, spool.FsyncInterval)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(replayAll()).To(HaveLen(2))
+		})
+	})
+
+	Describe("ParsePolicy", func() {
+
+		It("accepts always, interval and never", func() {
+			for _, name := range []string{"always", "interval", "never"} {
+				policy, err := spool.ParsePolicy(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(policy)).To(Equal(name))
+			}
+		})
+
+		It("rejects anything else", func() {
+			_, err := spool.ParsePolicy("sometimes")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,113 @@
+package suppress
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"time"
+
+	"github.com/craigfurman/bovine/tokenize"
+)
+
+const (
+	// maxDistance is the most bits in which the fingerprints of two texts
+	// may differ for them to be near duplicates.
+	maxDistance = 3
+
+	// bands is the number of 16 bit bands fingerprints are indexed by. Two
+	// fingerprints within maxDistance of each other must have at least one
+	// band in common, since each differing bit is in a single band.
+	bands = 4
+)
+
+// SimHash returns a 64 bit fingerprint of the words in text, ignoring links
+// and mentions, such that similar texts have fingerprints that differ in few
+// bits. Each word's hash votes on every bit of the fingerprint.
+func SimHash(text string) uint64 {
+	var votes [64]int
+	for _, word := range tokenize.Words(text) {
+		h := fnv.New64a()
+		h.Write([]byte(word))
+		sum := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<uint(bit)) != 0 {
+				votes[bit]++
+			} else {
+				votes[bit]--
+			}
+		}
+	}
+	var fingerprint uint64
+	for bit, vote := range votes {
+		if vote > 0 {
+			fingerprint |= 1 << uint(bit)
+		}
+	}
+	return fingerprint
+}
+
+func band(fingerprint uint64, i int) uint16 {
+	return uint16(fingerprint >> uint(16*i))
+}
+
+type fingerprint struct {
+	hash uint64
+	at   time.Time
+}
+
+// nearDuplicates remembers the fingerprints of texts seen within a window,
+// indexed by band so that a text can be checked against them without
+// comparing it to every one.
+type nearDuplicates struct {
+	window time.Duration
+	queue  []fingerprint
+	bands  [bands]map[uint16]map[uint64]int
+}
+
+func newNearDuplicates(window time.Duration) *nearDuplicates {
+	d := &nearDuplicates{window: window}
+	for i := range d.bands {
+		d.bands[i] = make(map[uint16]map[uint64]int)
+	}
+	return d
+}
+
+// seen reports whether a text nearly the same as one with the given
+// fingerprint was seen within the window before at, and remembers this one.
+// Fingerprints must be added in order of time.
+func (d *nearDuplicates) seen(hash uint64, at time.Time) bool {
+	d.expire(at)
+	duplicate := false
+	for i := range d.bands {
+		for other := range d.bands[i][band(hash, i)] {
+			if bits.OnesCount64(hash^other) <= maxDistance {
+				duplicate = true
+			}
+		}
+	}
+	d.queue = append(d.queue, fingerprint{hash: hash, at: at})
+	for i := range d.bands {
+		b := band(hash, i)
+		if d.bands[i][b] == nil {
+			d.bands[i][b] = make(map[uint64]int)
+		}
+		d.bands[i][b][hash]++
+	}
+	return duplicate
+}
+
+func (d *nearDuplicates) expire(now time.Time) {
+	for len(d.queue) > 0 && now.Sub(d.queue[0].at) >= d.window {
+		hash := d.queue[0].hash
+		d.queue = d.queue[1:]
+		for i := range d.bands {
+			b := band(hash, i)
+			d.bands[i][b][hash]--
+			if d.bands[i][b][hash] == 0 {
+				delete(d.bands[i][b], hash)
+			}
+			if len(d.bands[i][b]) == 0 {
+				delete(d.bands[i], b)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package suppress
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/bovine/tweet"
+)
+
+// Reason is why a keyword hit was not counted.
+type Reason string
+
+const (
+	// Denied hits are from authors on the deny list.
+	Denied Reason = "denied"
+	// Duplicate hits are from posts nearly the same as one seen recently.
+	Duplicate Reason = "duplicate"
+	// RateLimited hits are from authors who have already used the keyword
+	// as often as they may.
+	RateLimited Reason = "rateLimited"
+)
+
+type Config struct {
+	// Deny lists patterns matched against each post's source and author ID,
+	// such as "twitter:12345" or "bluesky:did:plc:*". Posts by authors who
+	// match are never counted.
+	Deny []string
+
+	// DuplicateWindow is how long a post's text is remembered for. Posts
+	// nearly the same as one seen within it are not counted. Zero means
+	// every post is counted however similar.
+	DuplicateWindow time.Duration
+
+	// AuthorLimit is how many hits of each keyword are counted from the same
+	// author per AuthorWindow. Zero means no limit.
+	AuthorLimit  int
+	AuthorWindow time.Duration
+}
+
+// Enabled reports whether any post could be suppressed.
+func (c Config) Enabled() bool {
+	return len(c.Deny) > 0 || c.DuplicateWindow > 0 || (c.AuthorLimit > 0 && c.AuthorWindow > 0)
+}
+
+// LoadDenyList reads deny list patterns from a file with one per line,
+// ignoring blank lines and comments starting with #.
+func LoadDenyList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseDenyList(f)
+}
+
+func ParseDenyList(r io.Reader) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// Suppressor decides which keyword hits in each post are noise from spam and
+// bots rather than people using the keyword. It is safe for concurrent use.
+type Suppressor struct {
+	config Config
+
+	mutex      sync.Mutex
+	duplicates *nearDuplicates
+	authorHits map[string]*authorHits
+	lastPruned time.Time
+}
+
+// authorHits counts the hits of a keyword from an author in the window
+// starting at start.
+type authorHits struct {
+	start time.Time
+	count int
+}
+
+func New(config Config) *Suppressor {
+	s := &Suppressor{
+		config:     config,
+		authorHits: make(map[string]*authorHits),
+	}
+	if config.DuplicateWindow > 0 {
+		s.duplicates = newNearDuplicates(config.DuplicateWindow)
+	}
+	return s
+}
+
+// Filter splits the keywords found in a post at the specified time into those
+// to count and those suppressed, and says why they were suppressed. Posts
+// must be filtered in order of time.
+func (s *Suppressor) Filter(t tweet.Tweet, found []string, at time.Time) (counted, suppressed []string, reason Reason) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	author := ""
+	if t.AuthorID != "" {
+		author = t.Source + ":" + t.AuthorID
+	}
+	if author != "" && s.denied(author) {
+		return nil, found, Denied
+	}
+	if s.duplicates != nil && len(strings.TrimSpace(t.Text)) > 0 && s.duplicates.seen(SimHash(t.Text), at) {
+		return nil, found, Duplicate
+	}
+	if author == "" || s.config.AuthorLimit <= 0 || s.config.AuthorWindow <= 0 {
+		return found, nil, ""
+	}
+	s.prune(at)
+	for _, keyword := range found {
+		if s.rateLimited(author, keyword, at) {
+			suppressed = append(suppressed, keyword)
+		} else {
+			counted = append(counted, keyword)
+		}
+	}
+	if len(suppressed) > 0 {
+		reason = RateLimited
+	}
+	return counted, suppressed, reason
+}
+
+func (s *Suppressor) denied(author string) bool {
+	for _, pattern := range s.config.Deny {
+		if matched, _ := path.Match(pattern, author); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimited counts a hit of keyword from author, reporting whether the
+// author has already used up their limit for the current window.
+func (s *Suppressor) rateLimited(author, keyword string, at time.Time) bool {
+	key := author + "\x00" + keyword
+	hits, ok := s.authorHits[key]
+	if !ok || at.Sub(hits.start) >= s.config.AuthorWindow {
+		hits = &authorHits{start: at}
+		s.authorHits[key] = hits
+	}
+	hits.count++
+	return hits.count > s.config.AuthorLimit
+}
+
+// prune forgets the authors whose windows have ended, once per window.
+func (s *Suppressor) prune(now time.Time) {
+	if now.Sub(s.lastPruned) < s.config.AuthorWindow {
+		return
+	}
+	for key, hits := range s.authorHits {
+		if now.Sub(hits.start) >= s.config.AuthorWindow {
+			delete(s.authorHits, key)
+		}
+	}
+	s.lastPruned = now
+}
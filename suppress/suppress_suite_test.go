@@ -0,0 +1,13 @@
+package suppress_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSuppress(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Suppress Suite")
+}
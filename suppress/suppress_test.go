@@ -0,0 +1,156 @@
+package suppress_test
+
+import (
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/craigfurman/bovine/suppress"
+	"github.com/craigfurman/bovine/tweet"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Suppress", func() {
+
+	var (
+		config     suppress.Config
+		suppressor *suppress.Suppressor
+		now        time.Time
+	)
+
+	BeforeEach(func() {
+		config = suppress.Config{}
+		now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	JustBeforeEach(func() {
+		suppressor = suppress.New(config)
+	})
+
+	post := func(source, author, text string) tweet.Tweet {
+		return tweet.Tweet{Source: source, AuthorID: author, Text: text}
+	}
+
+	It("counts everything when disabled", func() {
+		Expect(config.Enabled()).To(BeFalse())
+		for i := 0; i < 3; i++ {
+			counted, suppressed, _ := suppressor.Filter(post("twitter", "1", "synergy"), []string{"synergy"}, now)
+			Expect(counted).To(Equal([]string{"synergy"}))
+			Expect(suppressed).To(BeEmpty())
+		}
+	})
+
+	Describe("deny list", func() {
+
+		BeforeEach(func() {
+			config.Deny = []string{"twitter:666", "bluesky:did:plc:spam*"}
+		})
+
+		It("suppresses every hit from matching authors", func() {
+			counted, suppressed, reason := suppressor.Filter(post("twitter", "666", "synergy and pivot"), []string{"synergy", "pivot"}, now)
+			Expect(counted).To(BeEmpty())
+			Expect(suppressed).To(Equal([]string{"synergy", "pivot"}))
+			Expect(reason).To(Equal(suppress.Denied))
+
+			_, suppressed, _ = suppressor.Filter(post("bluesky", "did:plc:spambot42", "synergy"), []string{"synergy"}, now)
+			Expect(suppressed).To(Equal([]string{"synergy"}))
+		})
+
+		It("counts other authors, including those with the same ID on another network", func() {
+			counted, _, _ := suppressor.Filter(post("mastodon", "666", "synergy"), []string{"synergy"}, now)
+			Expect(counted).To(Equal([]string{"synergy"}))
+			counted, _, _ = suppressor.Filter(post("twitter", "", "synergy"), []string{"synergy"}, now)
+			Expect(counted).To(Equal([]string{"synergy"}))
+		})
+
+		It("is read from a file of patterns, skipping comments", func() {
+			patterns, err := suppress.ParseDenyList(strings.NewReader("# spammers\ntwitter:666\n\n  bluesky:did:plc:spam*\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(patterns).To(Equal([]string{"twitter:666", "bluesky:did:plc:spam*"}))
+		})
+
+		It("rejects malformed patterns", func() {
+			_, err := suppress.ParseDenyList(strings.NewReader("twitter:[\n"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("near duplicates", func() {
+
+		BeforeEach(func() {
+			config.DuplicateWindow = 10 * time.Minute
+		})
+
+		It("suppresses posts nearly the same as one seen within the window", func() {
+			counted, _, _ := suppressor.Filter(post("twitter", "1", "Leverage synergy to move the needle this quarter with our platform http://spam.example/a"), []string{"synergy"}, now)
+			Expect(counted).To(Equal([]string{"synergy"}))
+
+			counted, suppressed, reason := suppressor.Filter(post("twitter", "2", "leverage SYNERGY to move the needle this quarter with our platform! @you http://spam.example/b"), []string{"synergy"}, now.Add(time.Minute))
+			Expect(counted).To(BeEmpty())
+			Expect(suppressed).To(Equal([]string{"synergy"}))
+			Expect(reason).To(Equal(suppress.Duplicate))
+		})
+
+		It("counts different posts", func() {
+			suppressor.Filter(post("twitter", "1", "Leverage synergy to move the needle this quarter"), []string{"synergy"}, now)
+			counted, _, _ := suppressor.Filter(post("twitter", "2", "Honestly the word synergy makes me want to quit my job"), []string{"synergy"}, now.Add(time.Minute))
+			Expect(counted).To(Equal([]string{"synergy"}))
+		})
+
+		It("forgets posts once the window has passed", func() {
+			suppressor.Filter(post("twitter", "1", "Leverage synergy to move the needle"), []string{"synergy"}, now)
+			counted, _, _ := suppressor.Filter(post("twitter", "1", "Leverage synergy to move the needle"), []string{"synergy"}, now.Add(10*time.Minute))
+			Expect(counted).To(Equal([]string{"synergy"}))
+		})
+	})
+
+	Describe("rate limiting authors", func() {
+
+		BeforeEach(func() {
+			config.AuthorLimit = 2
+			config.AuthorWindow = time.Hour
+		})
+
+		It("counts only so many hits of each keyword from an author per window", func() {
+			for i := 0; i < 2; i++ {
+				counted, _, _ := suppressor.Filter(post("twitter", "1", "synergy"), []string{"synergy"}, now)
+				Expect(counted).To(Equal([]string{"synergy"}))
+			}
+			counted, suppressed, reason := suppressor.Filter(post("twitter", "1", "synergy and pivot"), []string{"synergy", "pivot"}, now.Add(time.Minute))
+			Expect(counted).To(Equal([]string{"pivot"}))
+			Expect(suppressed).To(Equal([]string{"synergy"}))
+			Expect(reason).To(Equal(suppress.RateLimited))
+
+			counted, _, _ = suppressor.Filter(post("twitter", "2", "synergy"), []string{"synergy"}, now.Add(time.Minute))
+			Expect(counted).To(Equal([]string{"synergy"}))
+		})
+
+		It("counts an author's hits again in the next window", func() {
+			for i := 0; i < 3; i++ {
+				suppressor.Filter(post("twitter", "1", "synergy"), []string{"synergy"}, now)
+			}
+			counted, _, _ := suppressor.Filter(post("twitter", "1", "synergy"), []string{"synergy"}, now.Add(time.Hour))
+			Expect(counted).To(Equal([]string{"synergy"}))
+		})
+
+		It("does not limit posts without an author", func() {
+			for i := 0; i < 3; i++ {
+				counted, _, _ := suppressor.Filter(post("nats", "", "synergy"), []string{"synergy"}, now)
+				Expect(counted).To(Equal([]string{"synergy"}))
+			}
+		})
+	})
+
+	Describe("SimHash", func() {
+
+		It("gives similar texts fingerprints that differ in few bits", func() {
+			a := suppress.SimHash("the quick brown fox jumps over the lazy dog again and again")
+			b := suppress.SimHash("The quick brown fox jumps over the lazy dog again and again!")
+			c := suppress.SimHash("an entirely unrelated sentence about quarterly planning")
+			Expect(a).To(Equal(b))
+			Expect(bits.OnesCount64(a ^ c)).To(BeNumerically(">", 3))
+		})
+	})
+})
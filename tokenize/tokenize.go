@@ -0,0 +1,48 @@
+package tokenize
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Words splits text into lower case words, keeping a leading # on hashtags
+// and skipping links and mentions.
+func Words(text string) []string {
+	var words []string
+	for _, field := range strings.Fields(strings.ToLower(text)) {
+		if strings.HasPrefix(field, "http") || strings.HasPrefix(field, "@") {
+			continue
+		}
+		word := strings.TrimFunc(field, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '#'
+		})
+		word = strings.TrimRight(word, "#")
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+func IsStopWord(word string) bool {
+	return stopWords[word]
+}
+
+var stopWords = map[string]bool{
+	"a": true, "about": true, "after": true, "all": true, "also": true, "an": true,
+	"and": true, "any": true, "are": true, "as": true, "at": true, "be": true,
+	"because": true, "been": true, "before": true, "being": true, "but": true, "by": true,
+	"can": true, "could": true, "did": true, "do": true, "does": true, "for": true,
+	"from": true, "had": true, "has": true, "have": true, "he": true, "her": true,
+	"here": true, "him": true, "his": true, "how": true, "i": true, "if": true,
+	"in": true, "into": true, "is": true, "it": true, "its": true, "just": true,
+	"like": true, "me": true, "more": true, "most": true, "my": true, "no": true,
+	"not": true, "now": true, "of": true, "on": true, "only": true, "or": true,
+	"other": true, "our": true, "out": true, "over": true, "rt": true, "she": true,
+	"should": true, "so": true, "some": true, "than": true, "that": true, "the": true,
+	"their": true, "them": true, "then": true, "there": true, "these": true, "they": true,
+	"this": true, "those": true, "to": true, "too": true, "up": true, "us": true,
+	"very": true, "was": true, "we": true, "were": true, "what": true, "when": true,
+	"where": true, "which": true, "who": true, "why": true, "will": true, "with": true,
+	"would": true, "you": true, "your": true,
+}
@@ -0,0 +1,13 @@
+package tokenize_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tokenize Suite")
+}
@@ -0,0 +1,34 @@
+package tokenize_test
+
+import (
+	"github.com/craigfurman/bovine/tokenize"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tokenize", func() {
+
+	Describe("Words", func() {
+
+		It("splits text into lower case words without surrounding punctuation", func() {
+			Expect(tokenize.Words("At the end of the day, it's FINE!")).To(Equal([]string{"at", "the", "end", "of", "the", "day", "it's", "fine"}))
+		})
+
+		It("keeps hashtags", func() {
+			Expect(tokenize.Words("so #Blessed.")).To(Equal([]string{"so", "#blessed"}))
+		})
+
+		It("skips links and mentions", func() {
+			Expect(tokenize.Words("@bob look http://t.co/abc")).To(Equal([]string{"look"}))
+		})
+	})
+
+	Describe("IsStopWord", func() {
+
+		It("recognises common English words", func() {
+			Expect(tokenize.IsStopWord("the")).To(BeTrue())
+			Expect(tokenize.IsStopWord("cliché")).To(BeFalse())
+		})
+	})
+})
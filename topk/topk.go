@@ -0,0 +1,141 @@
+package topk
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Item is a term and its estimated count. The true count lies between
+// Count-Error and Count.
+type Item struct {
+	Term  string `json:"term"`
+	Count uint   `json:"count"`
+	Error uint   `json:"error"`
+}
+
+// SpaceSaving estimates the most frequent terms in a stream using the
+// Space-Saving algorithm, monitoring at most capacity terms at a time. Any
+// term occurring more than 1/capacity of the time is guaranteed to be
+// monitored. It is not safe for concurrent use.
+type SpaceSaving struct {
+	capacity int
+	counters counterHeap
+	index    map[string]*counter
+}
+
+type counter struct {
+	Item
+	position int
+}
+
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	return &SpaceSaving{
+		capacity: capacity,
+		index:    make(map[string]*counter),
+	}
+}
+
+func (s *SpaceSaving) Add(term string) {
+	if c, ok := s.index[term]; ok {
+		c.Count++
+		heap.Fix(&s.counters, c.position)
+		return
+	}
+	if len(s.counters) < s.capacity {
+		c := &counter{Item: Item{Term: term, Count: 1}}
+		s.index[term] = c
+		heap.Push(&s.counters, c)
+		return
+	}
+	min := s.counters[0]
+	delete(s.index, min.Term)
+	min.Term = term
+	min.Error = min.Count
+	min.Count++
+	s.index[term] = min
+	heap.Fix(&s.counters, min.position)
+}
+
+// Estimate returns the estimated count of term, or 0 if it is not monitored.
+func (s *SpaceSaving) Estimate(term string) uint {
+	if c, ok := s.index[term]; ok {
+		return c.Count
+	}
+	return 0
+}
+
+// Top returns the k terms with the highest estimated counts, highest first.
+func (s *SpaceSaving) Top(k int) []Item {
+	items := make([]Item, len(s.counters))
+	for i, c := range s.counters {
+		items[i] = c.Item
+	}
+	sort.Sort(byCount(items))
+	if len(items) > k {
+		items = items[:k]
+	}
+	return items
+}
+
+// Merge combines the items estimated by several sketches, summing the counts
+// and errors of each term, and returns the k terms with the highest combined
+// counts, highest first.
+func Merge(k int, lists ...[]Item) []Item {
+	merged := make(map[string]*Item)
+	items := []Item{}
+	for _, list := range lists {
+		for _, item := range list {
+			if m, ok := merged[item.Term]; ok {
+				m.Count += item.Count
+				m.Error += item.Error
+				continue
+			}
+			item := item
+			merged[item.Term] = &item
+		}
+	}
+	for _, item := range merged {
+		items = append(items, *item)
+	}
+	sort.Sort(byCount(items))
+	if len(items) > k {
+		items = items[:k]
+	}
+	return items
+}
+
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].position = i
+	h[j].position = j
+}
+
+func (h *counterHeap) Push(x interface{}) {
+	c := x.(*counter)
+	c.position = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+type byCount []Item
+
+func (items byCount) Len() int      { return len(items) }
+func (items byCount) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+
+func (items byCount) Less(i, j int) bool {
+	if items[i].Count != items[j].Count {
+		return items[i].Count > items[j].Count
+	}
+	return items[i].Term < items[j].Term
+}
@@ -0,0 +1,13 @@
+package topk_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestTopk(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Topk Suite")
+}
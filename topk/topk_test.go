@@ -0,0 +1,91 @@
+package topk_test
+
+import (
+	"fmt"
+
+	"github.com/craigfurman/bovine/topk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SpaceSaving", func() {
+
+	var sketch *topk.SpaceSaving
+
+	BeforeEach(func() {
+		sketch = topk.NewSpaceSaving(3)
+	})
+
+	It("counts terms exactly while under capacity", func() {
+		sketch.Add("bacon")
+		sketch.Add("eggs")
+		sketch.Add("bacon")
+
+		Expect(sketch.Top(10)).To(Equal([]topk.Item{
+			{Term: "bacon", Count: 2},
+			{Term: "eggs", Count: 1},
+		}))
+	})
+
+	It("returns at most k terms", func() {
+		sketch.Add("bacon")
+		sketch.Add("eggs")
+		sketch.Add("beans")
+
+		Expect(sketch.Top(2)).To(HaveLen(2))
+	})
+
+	It("replaces the least frequent term when over capacity, recording the overestimate", func() {
+		sketch.Add("bacon")
+		sketch.Add("bacon")
+		sketch.Add("eggs")
+		sketch.Add("eggs")
+		sketch.Add("beans")
+		sketch.Add("toast")
+
+		Expect(sketch.Top(3)).To(Equal([]topk.Item{
+			{Term: "bacon", Count: 2},
+			{Term: "eggs", Count: 2},
+			{Term: "toast", Count: 2, Error: 1},
+		}))
+	})
+
+	It("estimates the count of monitored terms", func() {
+		sketch.Add("bacon")
+		sketch.Add("bacon")
+
+		Expect(sketch.Estimate("bacon")).To(Equal(uint(2)))
+		Expect(sketch.Estimate("tofu")).To(BeZero())
+	})
+
+	It("keeps frequent terms among many infrequent ones", func() {
+		sketch = topk.NewSpaceSaving(10)
+		for i := 0; i < 1000; i++ {
+			sketch.Add(fmt.Sprintf("rare%d", i))
+			if i%3 == 0 {
+				sketch.Add("common")
+			}
+		}
+
+		top := sketch.Top(1)
+		Expect(top[0].Term).To(Equal("common"))
+		Expect(top[0].Count - top[0].Error).To(BeNumerically("<=", 334))
+		Expect(top[0].Count).To(BeNumerically(">=", 334))
+	})
+})
+
+var _ = Describe("Merge", func() {
+
+	It("sums the estimates of each term and returns the top k", func() {
+		merged := topk.Merge(2,
+			[]topk.Item{{Term: "bacon", Count: 3}, {Term: "eggs", Count: 2, Error: 1}},
+			[]topk.Item{{Term: "eggs", Count: 2}, {Term: "beans", Count: 1}},
+		)
+
+		Expect(merged).To(Equal([]topk.Item{
+			{Term: "eggs", Count: 4, Error: 1},
+			{Term: "bacon", Count: 3},
+		}))
+	})
+})
@@ -0,0 +1,12 @@
+package tweet
+
+import "time"
+
+type Tweet struct {
+	ID        string    `json:"id"`
+	AuthorID  string    `json:"-"`
+	Text      string    `json:"text,omitempty"`
+	Lang      string    `json:"lang,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	CreatedAt time.Time `json:"-"`
+}
@@ -1,11 +1,24 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/discovery"
+	"github.com/craigfurman/bovine/period"
+	"github.com/craigfurman/bovine/sentiment"
+	"github.com/craigfurman/bovine/topk"
+	"github.com/craigfurman/bovine/tweet"
+
 	"github.com/gorilla/mux"
 )
 
@@ -15,47 +28,576 @@ type Clock interface {
 
 //go:generate counterfeiter . WordCounter
 type WordCounter interface {
-	Count(word string, since time.Time) (uint, error)
+	HealthChecker
+	Count(ctx context.Context, word string, since time.Time) (uint, error)
+	CountBetween(ctx context.Context, word string, since, until time.Time) (uint, error)
+	CountRolling(ctx context.Context, word string, p period.Period) (uint, error)
+	CountAuthors(ctx context.Context, word string, since time.Time) (uint, error)
+	CountBySource(ctx context.Context, word string, since time.Time) (map[string]uint, error)
+	CountCooccurrences(ctx context.Context, first, second string, since time.Time) (uint, error)
+	CountTweets(ctx context.Context, since time.Time) (uint, error)
+	Sentiment(ctx context.Context, word string, since time.Time) (sentiment.Tally, error)
+	Suppressed(ctx context.Context, word string, since time.Time) (map[string]uint, error)
+	Samples(ctx context.Context, word string) (recent []tweet.Tweet, reservoir []tweet.Tweet, err error)
+	Related(ctx context.Context, word string) ([]topk.Item, error)
+	Candidates(ctx context.Context) ([]discovery.Candidate, error)
+	Promote(ctx context.Context, phrase string) error
+	Promoted(ctx context.Context) ([]string, error)
 }
 
 type handler struct {
 	wordCounter WordCounter
 	keywords    []string
 	clock       Clock
+	cache       *cache
+	apiKey      string
+}
+
+type sourceCounts struct {
+	Total   uint            `json:"total"`
+	Sources map[string]uint `json:"sources"`
+}
+
+type suppressedCounts struct {
+	Total   uint            `json:"total"`
+	Reasons map[string]uint `json:"reasons"`
+}
+
+type authorCounts struct {
+	Count         uint `json:"count"`
+	UniqueAuthors uint `json:"uniqueAuthors"`
+}
+
+// leaderboardEntry is a keyword's place in the leaderboard. Its previous rank
+// and rank change are null if it was not used in the previous period.
+type leaderboardEntry struct {
+	Keyword       string  `json:"keyword"`
+	Count         uint    `json:"count"`
+	Rank          int     `json:"rank"`
+	Share         float64 `json:"share"`
+	PreviousCount uint    `json:"previousCount"`
+	PreviousRank  *int    `json:"previousRank"`
+	RankChange    *int    `json:"rankChange"`
+}
+
+type cooccurrence struct {
+	Count uint     `json:"count"`
+	Lift  float64  `json:"lift"`
+	PMI   *float64 `json:"pmi"`
+}
+
+type keywordSentiment struct {
+	Count    uint    `json:"count"`
+	Average  float64 `json:"average"`
+	Positive uint    `json:"positive"`
+	Negative uint    `json:"negative"`
+	Neutral  uint    `json:"neutral"`
 }
 
-func New(wordCounter WordCounter, keywords []string, clock Clock) *mux.Router {
+type samples struct {
+	Recent    []tweet.Tweet `json:"recent"`
+	Reservoir []tweet.Tweet `json:"reservoir"`
+}
+
+// New serves the API, caching /wordcount responses for cacheTTL, or not at
+// all if it is zero. Candidates can only be promoted by clients presenting
+// apiKey as a bearer token, and not at all if it is empty.
+func New(wordCounter WordCounter, keywords []string, clock Clock, cacheTTL time.Duration, apiKey string) *mux.Router {
 	api := &handler{
 		wordCounter: wordCounter,
 		keywords:    keywords,
 		clock:       clock,
+		cache:       newCache(cacheTTL, clock),
+		apiKey:      apiKey,
 	}
 	r := mux.NewRouter()
 	r.HandleFunc("/wordcount/{period}", api.handleWordCount).
 		Methods("GET")
+	r.HandleFunc("/cooccurrence/{period}", api.handleCooccurrence).
+		Methods("GET")
+	r.HandleFunc("/sentiment/{period}", api.handleSentiment).
+		Methods("GET")
+	r.HandleFunc("/suppressed/{period}", api.handleSuppressed).
+		Methods("GET")
+	r.HandleFunc("/leaderboard/{period}", api.handleLeaderboard).
+		Methods("GET")
+	r.HandleFunc("/keywords/{word}/samples", api.handleSamples).
+		Methods("GET")
+	r.HandleFunc("/keywords/{word}/related", api.handleRelated).
+		Methods("GET")
+	r.HandleFunc("/discover", api.handleDiscover).
+		Methods("GET")
+	r.HandleFunc("/discover/{phrase}/promote", api.handlePromote).
+		Methods("POST")
+	addHealthRoutes(r, wordCounter, "", nil)
 	return r
 }
 
+// handleWordCount counts each keyword over the last hour, day or week from
+// its rolling count, and authors=unique reports an estimate of the number of
+// distinct authors alongside each count. Repeated source parameters restrict
+// the counts to those sources, and breakdown=source reports the count from
+// each source alongside the total, both of which count every occurrence
+// instead. Authors cannot be counted by source. Responses are cached for a
+// short time.
 func (h *handler) handleWordCount(w http.ResponseWriter, req *http.Request) {
-	wordCounts := make(map[string]uint)
-	for _, keyword := range h.keywords {
-		count, err := h.wordCounter.Count(keyword, h.clock.Now().AddDate(0, 0, -1))
+	ctx := req.Context()
+	p, err := period.Parse(mux.Vars(req)["period"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	query := req.URL.Query()
+	sources := query["source"]
+	breakdown := query.Get("breakdown") == "source"
+	authors := query.Get("authors") == "unique"
+	if authors && (breakdown || len(sources) > 0) {
+		http.Error(w, "authors cannot be counted by source", http.StatusBadRequest)
+		return
+	}
+	key := wordCountKey(p.Name, sources, breakdown, authors)
+	entry, err := h.cache.get(ctx, key, func(ctx context.Context) (interface{}, error) {
+		keywords, err := h.trackedKeywords(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if authors {
+			return h.authorCounts(ctx, keywords, p)
+		}
+		if !breakdown && len(sources) == 0 {
+			return h.rollingCounts(ctx, keywords, p)
+		}
+		counts, err := h.sourceCounts(ctx, keywords, sources, p.Since(h.clock.Now()))
+		if err != nil || breakdown {
+			return counts, err
+		}
+		wordCounts := make(map[string]uint)
+		for keyword, c := range counts {
+			wordCounts[keyword] = c.Total
+		}
+		return wordCounts, nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.cache.write(w, req, entry)
+}
+
+// wordCountKey identifies a /wordcount response by its period and query,
+// regardless of the order sources are listed in.
+func wordCountKey(period string, sources []string, breakdown, authors bool) string {
+	sources = append([]string{}, sources...)
+	sort.Strings(sources)
+	return fmt.Sprintf("%s|%q|%t|%t", period, sources, breakdown, authors)
+}
+
+// handleCooccurrence reports how often each pair of keywords was found in
+// the same tweet in the last hour, day or week.
+func (h *handler) handleCooccurrence(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	p, err := period.Parse(mux.Vars(req)["period"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	keywords, err := h.trackedKeywords(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	since := p.Since(h.clock.Now())
+	wordCounts, err := h.wordCounts(ctx, keywords, since)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	tweets, err := h.wordCounter.CountTweets(ctx, since)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	matrix := make(map[string]map[string]cooccurrence)
+	for _, first := range keywords {
+		matrix[first] = make(map[string]cooccurrence)
+		for _, second := range keywords {
+			if first == second {
+				continue
+			}
+			count, err := h.wordCounter.CountCooccurrences(ctx, first, second, since)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			matrix[first][second] = newCooccurrence(count, wordCounts[first], wordCounts[second], tweets)
+		}
+	}
+	writeJSON(w, matrix)
+}
+
+// handleSentiment reports how many tweets containing each keyword were
+// positive, negative or neutral in the last hour, day or week.
+func (h *handler) handleSentiment(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	p, err := period.Parse(mux.Vars(req)["period"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	keywords, err := h.trackedKeywords(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	since := p.Since(h.clock.Now())
+	sentiments := make(map[string]keywordSentiment)
+	for _, keyword := range keywords {
+		count, err := h.wordCounter.Count(ctx, keyword, since)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		tally, err := h.wordCounter.Sentiment(ctx, keyword, since)
 		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+			writeError(w, err)
 			return
 		}
+		sentiments[keyword] = keywordSentiment{
+			Count:    count,
+			Average:  tally.Average(),
+			Positive: tally.Positive,
+			Negative: tally.Negative,
+			Neutral:  tally.Neutral,
+		}
+	}
+	writeJSON(w, sentiments)
+}
+
+// handleSuppressed reports how many hits of each keyword were not counted in
+// the last hour, day or week because they looked like spam, by reason.
+func (h *handler) handleSuppressed(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	p, err := period.Parse(mux.Vars(req)["period"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	keywords, err := h.trackedKeywords(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	since := p.Since(h.clock.Now())
+	suppressed := make(map[string]suppressedCounts)
+	for _, keyword := range keywords {
+		reasons, err := h.wordCounter.Suppressed(ctx, keyword, since)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		counts := suppressedCounts{Reasons: reasons}
+		for _, count := range reasons {
+			counts.Total += count
+		}
+		suppressed[keyword] = counts
+	}
+	writeJSON(w, suppressed)
+}
+
+// handleLeaderboard ranks the keywords by their count over the last hour, day
+// or week, most used first, alongside each one's share of the total
+// and how its rank has changed since the period before, e.g. yesterday for
+// day. Both periods are counted from the stored occurrences so that they are
+// ranked alike. Keywords with the same count share a rank.
+func (h *handler) handleLeaderboard(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	p, err := period.Parse(mux.Vars(req)["period"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	keywords, err := h.trackedKeywords(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	now := h.clock.Now()
+	since := p.Since(now)
+	counts, err := h.countsBetween(ctx, keywords, since, now)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	previousCounts, err := h.countsBetween(ctx, keywords, p.Since(since), since)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ranks, previousRanks := rank(counts), rank(previousCounts)
+	var total uint
+	for _, count := range counts {
+		total += count
+	}
+	leaderboard := make([]leaderboardEntry, 0, len(counts))
+	for keyword, count := range counts {
+		entry := leaderboardEntry{
+			Keyword:       keyword,
+			Count:         count,
+			Rank:          ranks[keyword],
+			PreviousCount: previousCounts[keyword],
+		}
+		if total > 0 {
+			entry.Share = float64(count) / float64(total)
+		}
+		if entry.PreviousCount > 0 {
+			previousRank := previousRanks[keyword]
+			change := previousRank - entry.Rank
+			entry.PreviousRank, entry.RankChange = &previousRank, &change
+		}
+		leaderboard = append(leaderboard, entry)
+	}
+	sort.Sort(byRank(leaderboard))
+	writeJSON(w, leaderboard)
+}
+
+// rank numbers the keywords from 1 in descending order of count, giving
+// keywords with the same count the same rank and leaving a gap after them.
+func rank(counts map[string]uint) map[string]int {
+	ranks := make(map[string]int)
+	for keyword, count := range counts {
+		ranks[keyword] = 1
+		for _, other := range counts {
+			if other > count {
+				ranks[keyword]++
+			}
+		}
+	}
+	return ranks
+}
+
+type byRank []leaderboardEntry
+
+func (l byRank) Len() int      { return len(l) }
+func (l byRank) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l byRank) Less(i, j int) bool {
+	if l[i].Rank != l[j].Rank {
+		return l[i].Rank < l[j].Rank
+	}
+	return l[i].Keyword < l[j].Keyword
+}
+
+func (h *handler) handleSamples(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	word := mux.Vars(req)["word"]
+	tracked, err := h.tracked(ctx, word)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !tracked {
+		http.NotFound(w, req)
+		return
+	}
+	recent, reservoir, err := h.wordCounter.Samples(ctx, word)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, samples{Recent: recent, Reservoir: reservoir})
+}
+
+func (h *handler) handleRelated(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	word := mux.Vars(req)["word"]
+	tracked, err := h.tracked(ctx, word)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !tracked {
+		http.NotFound(w, req)
+		return
+	}
+	related, err := h.wordCounter.Related(ctx, word)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, related)
+}
+
+func (h *handler) tracked(ctx context.Context, word string) (bool, error) {
+	keywords, err := h.trackedKeywords(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, keyword := range keywords {
+		if keyword == word {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// trackedKeywords returns the configured keywords followed by any promoted
+// from discovered phrases.
+func (h *handler) trackedKeywords(ctx context.Context) ([]string, error) {
+	promoted, err := h.wordCounter.Promoted(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keywords := append([]string{}, h.keywords...)
+	for _, phrase := range promoted {
+		if !contains(keywords, phrase) {
+			keywords = append(keywords, phrase)
+		}
+	}
+	return keywords, nil
+}
+
+func (h *handler) wordCounts(ctx context.Context, keywords []string, since time.Time) (map[string]uint, error) {
+	wordCounts := make(map[string]uint)
+	for _, keyword := range keywords {
+		count, err := h.wordCounter.Count(ctx, keyword, since)
+		if err != nil {
+			return nil, err
+		}
 		wordCounts[keyword] = count
 	}
-	wordCountBytes, err := json.Marshal(wordCounts)
+	return wordCounts, nil
+}
+
+func (h *handler) rollingCounts(ctx context.Context, keywords []string, p period.Period) (map[string]uint, error) {
+	wordCounts := make(map[string]uint)
+	for _, keyword := range keywords {
+		count, err := h.wordCounter.CountRolling(ctx, keyword, p)
+		if err != nil {
+			return nil, err
+		}
+		wordCounts[keyword] = count
+	}
+	return wordCounts, nil
+}
+
+// countsBetween counts each keyword's stored occurrences from since until
+// until.
+func (h *handler) countsBetween(ctx context.Context, keywords []string, since, until time.Time) (map[string]uint, error) {
+	wordCounts := make(map[string]uint)
+	for _, keyword := range keywords {
+		count, err := h.wordCounter.CountBetween(ctx, keyword, since, until)
+		if err != nil {
+			return nil, err
+		}
+		wordCounts[keyword] = count
+	}
+	return wordCounts, nil
+}
+
+// authorCounts reports the rolling count of each keyword alongside the
+// number of distinct authors who used it in the period.
+func (h *handler) authorCounts(ctx context.Context, keywords []string, p period.Period) (map[string]authorCounts, error) {
+	counts := make(map[string]authorCounts)
+	since := p.Since(h.clock.Now())
+	for _, keyword := range keywords {
+		count, err := h.wordCounter.CountRolling(ctx, keyword, p)
+		if err != nil {
+			return nil, err
+		}
+		authors, err := h.wordCounter.CountAuthors(ctx, keyword, since)
+		if err != nil {
+			return nil, err
+		}
+		counts[keyword] = authorCounts{Count: count, UniqueAuthors: authors}
+	}
+	return counts, nil
+}
+
+// sourceCounts counts each keyword from each source, keeping only the given
+// sources unless there are none.
+func (h *handler) sourceCounts(ctx context.Context, keywords, sources []string, since time.Time) (map[string]sourceCounts, error) {
+	breakdown := make(map[string]sourceCounts)
+	for _, keyword := range keywords {
+		bySource, err := h.wordCounter.CountBySource(ctx, keyword, since)
+		if err != nil {
+			return nil, err
+		}
+		counts := sourceCounts{Sources: make(map[string]uint)}
+		for source, count := range bySource {
+			if len(sources) > 0 && !contains(sources, source) {
+				continue
+			}
+			counts.Sources[source] = count
+			counts.Total += count
+		}
+		breakdown[keyword] = counts
+	}
+	return breakdown, nil
+}
+
+// newCooccurrence computes the lift of a pair of words, i.e. how much more
+// often they appear together than they would if they were independent. PMI is
+// the base 2 log of the lift, and is left null when the pair never co-occurs.
+func newCooccurrence(count, firstCount, secondCount, tweets uint) cooccurrence {
+	c := cooccurrence{Count: count}
+	if count == 0 || firstCount == 0 || secondCount == 0 {
+		return c
+	}
+	c.Lift = float64(count) * float64(tweets) / (float64(firstCount) * float64(secondCount))
+	pmi := math.Log2(c.Lift)
+	c.PMI = &pmi
+	return c
+}
+
+func contains(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		writeError(w, err)
 		return
 	}
 	w.Header()["Content-Type"] = []string{"application/json"}
-	_, err = w.Write(wordCountBytes)
-	if err != nil {
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
 		log.Println(err)
 	}
 }
+
+// writeError responds with 503 Service Unavailable while the circuit breaker
+// around Redis is open, and 500 Internal Server Error otherwise.
+func writeError(w http.ResponseWriter, err error) {
+	if setRetryAfter(w, err) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(500)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// setRetryAfter sets the Retry-After header to the number of seconds until
+// the circuit breaker will let calls through, if err is because it is open.
+func setRetryAfter(w http.ResponseWriter, err error) bool {
+	var open *breaker.OpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	seconds := int(math.Ceil(open.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return true
+}
@@ -1,6 +1,7 @@
 package web_test
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,7 +10,13 @@ import (
 	"net/http/httptest"
 	"time"
 
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/discovery"
 	indexerFakes "github.com/craigfurman/bovine/indexer/fakes"
+	"github.com/craigfurman/bovine/period"
+	"github.com/craigfurman/bovine/sentiment"
+	"github.com/craigfurman/bovine/topk"
+	"github.com/craigfurman/bovine/tweet"
 	"github.com/craigfurman/bovine/web"
 	"github.com/craigfurman/bovine/web/fakes"
 
@@ -20,8 +27,10 @@ import (
 var _ = Describe("API", func() {
 
 	var (
-		server *httptest.Server
-		now    time.Time
+		server   *httptest.Server
+		now      time.Time
+		keywords []string
+		cacheTTL time.Duration
 
 		clock       *indexerFakes.FakeClock
 		wordCounter *fakes.FakeWordCounter
@@ -32,7 +41,12 @@ var _ = Describe("API", func() {
 		now = time.Now()
 		clock.NowReturns(now)
 		wordCounter = new(fakes.FakeWordCounter)
-		api := web.New(wordCounter, []string{"bacon"}, clock)
+		keywords = []string{"bacon"}
+		cacheTTL = 0
+	})
+
+	JustBeforeEach(func() {
+		api := web.New(wordCounter, keywords, clock, cacheTTL, "secret")
 		server = httptest.NewServer(api)
 	})
 
@@ -40,8 +54,8 @@ var _ = Describe("API", func() {
 		server.Close()
 	})
 
-	It("returns number of times each keyword has been tweeted in the last 24 hours", func() {
-		wordCounter.CountReturns(42, nil)
+	It("returns the rolling count of times each keyword has been tweeted in the period", func() {
+		wordCounter.CountRollingReturns(42, nil)
 		response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "wordcount/day"))
 		Expect(err).NotTo(HaveOccurred())
 		bodyBytes, err := ioutil.ReadAll(response.Body)
@@ -55,16 +69,53 @@ var _ = Describe("API", func() {
 		Expect(wordCounts).To(HaveLen(1))
 		Expect(int(wordCounts["bacon"])).To(Equal(42))
 
-		Expect(wordCounter.CountCallCount()).To(Equal(1))
-		word, since := wordCounter.CountArgsForCall(0)
+		Expect(wordCounter.CountRollingCallCount()).To(Equal(1))
+		_, word, p := wordCounter.CountRollingArgsForCall(0)
 		Expect(word).To(Equal("bacon"))
-		Expect(since).To(Equal(now.AddDate(0, 0, -1)))
+		Expect(p).To(Equal(period.Day))
+	})
+
+	It("counts over the last hour, day or week", func() {
+		for _, name := range []string{"hour", "week"} {
+			response, err := http.Get(fmt.Sprintf("%s/wordcount/%s", server.URL, name))
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+		_, _, hour := wordCounter.CountRollingArgsForCall(0)
+		Expect(hour).To(Equal(period.Hour))
+		_, _, week := wordCounter.CountRollingArgsForCall(1)
+		Expect(week).To(Equal(period.Week))
+	})
+
+	It("does not know of other periods", func() {
+		response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "wordcount/fortnight"))
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(wordCounter.CountRollingCallCount()).To(Equal(0))
+	})
+
+	It("passes on the request's context, so counting stops once the client goes away", func() {
+		cancelled := make(chan error, 1)
+		wordCounter.CountRollingStub = func(ctx context.Context, word string, p period.Period) (uint, error) {
+			<-ctx.Done()
+			cancelled <- ctx.Err()
+			return 0, ctx.Err()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", server.URL, "wordcount/day"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = http.DefaultClient.Do(req.WithContext(ctx))
+		Expect(err).To(HaveOccurred())
+		Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
 	})
 
 	Context("when getting word count fails", func() {
 
 		BeforeEach(func() {
-			wordCounter.CountReturns(0, errors.New("o no!"))
+			wordCounter.CountRollingReturns(0, errors.New("o no!"))
 		})
 
 		It("returns the error over HTTP", func() {
@@ -78,4 +129,657 @@ var _ = Describe("API", func() {
 			Expect(string(bodyBytes)).To(Equal("o no!"))
 		})
 	})
+
+	Context("while the circuit breaker around redis is open", func() {
+
+		BeforeEach(func() {
+			wordCounter.CountRollingReturns(0, &breaker.OpenError{RetryAfter: 7200 * time.Millisecond})
+		})
+
+		It("responds service unavailable, saying when to retry", func() {
+			response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "wordcount/day"))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+
+			Expect(response.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(response.Header.Get("Retry-After")).To(Equal("8"))
+		})
+	})
+
+	Describe("counts by source", func() {
+
+		BeforeEach(func() {
+			keywords = []string{"bacon", "eggs"}
+			wordCounter.CountBySourceStub = func(_ context.Context, word string, since time.Time) (map[string]uint, error) {
+				if word == "bacon" {
+					return map[string]uint{"twitter": 5, "mastodon": 3, "file:archive.json": 2}, nil
+				}
+				return map[string]uint{"mastodon": 1}, nil
+			}
+		})
+
+		getBody := func(path string, v interface{}) *http.Response {
+			response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, path))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			bodyBytes, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(bodyBytes, v)).To(Succeed())
+			return response
+		}
+
+		It("counts only the requested sources", func() {
+			wordCounts := make(map[string]uint)
+			response := getBody("wordcount/day?source=twitter&source=mastodon", &wordCounts)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(wordCounts).To(Equal(map[string]uint{"bacon": 8, "eggs": 1}))
+
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(0))
+			_, _, since := wordCounter.CountBySourceArgsForCall(0)
+			Expect(since).To(Equal(now.Add(-24 * time.Hour)))
+		})
+
+		It("breaks the counts down by source", func() {
+			var breakdown map[string]struct {
+				Total   uint            `json:"total"`
+				Sources map[string]uint `json:"sources"`
+			}
+			response := getBody("wordcount/day?breakdown=source", &breakdown)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(breakdown["bacon"].Total).To(Equal(uint(10)))
+			Expect(breakdown["bacon"].Sources).To(Equal(map[string]uint{"twitter": 5, "mastodon": 3, "file:archive.json": 2}))
+			Expect(breakdown["eggs"].Total).To(Equal(uint(1)))
+			Expect(breakdown["eggs"].Sources).To(Equal(map[string]uint{"mastodon": 1}))
+		})
+
+		It("breaks down only the requested sources", func() {
+			var breakdown map[string]struct {
+				Total   uint            `json:"total"`
+				Sources map[string]uint `json:"sources"`
+			}
+			getBody("wordcount/day?breakdown=source&source=file:archive.json", &breakdown)
+			Expect(breakdown["bacon"].Total).To(Equal(uint(2)))
+			Expect(breakdown["bacon"].Sources).To(Equal(map[string]uint{"file:archive.json": 2}))
+			Expect(breakdown["eggs"].Total).To(Equal(uint(0)))
+		})
+
+		Context("when counting by source fails", func() {
+
+			BeforeEach(func() {
+				wordCounter.CountBySourceReturns(nil, errors.New("o no!"))
+			})
+
+			It("returns the error over HTTP", func() {
+				response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "wordcount/day?source=twitter"))
+				Expect(err).NotTo(HaveOccurred())
+				defer response.Body.Close()
+				Expect(response.StatusCode).To(Equal(500))
+			})
+		})
+	})
+
+	Describe("unique authors", func() {
+
+		BeforeEach(func() {
+			keywords = []string{"bacon", "eggs"}
+			wordCounter.CountRollingReturns(10, nil)
+			wordCounter.CountAuthorsStub = func(_ context.Context, word string, since time.Time) (uint, error) {
+				if word == "bacon" {
+					return 1, nil
+				}
+				return 7, nil
+			}
+		})
+
+		It("reports the number of distinct authors alongside each count", func() {
+			response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "wordcount/week?authors=unique"))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			var counts map[string]map[string]uint
+			Expect(json.NewDecoder(response.Body).Decode(&counts)).To(Succeed())
+			Expect(counts).To(Equal(map[string]map[string]uint{
+				"bacon": {"count": 10, "uniqueAuthors": 1},
+				"eggs":  {"count": 10, "uniqueAuthors": 7},
+			}))
+
+			_, _, since := wordCounter.CountAuthorsArgsForCall(0)
+			Expect(since).To(Equal(now.Add(-7 * 24 * time.Hour)))
+		})
+
+		It("does not count authors by source", func() {
+			response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "wordcount/day?authors=unique&source=twitter"))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(wordCounter.CountAuthorsCallCount()).To(BeZero())
+		})
+
+		Context("when counting authors fails", func() {
+
+			BeforeEach(func() {
+				wordCounter.CountAuthorsReturns(0, errors.New("o no!"))
+			})
+
+			It("returns the error over HTTP", func() {
+				response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "wordcount/day?authors=unique"))
+				Expect(err).NotTo(HaveOccurred())
+				defer response.Body.Close()
+				Expect(response.StatusCode).To(Equal(500))
+			})
+		})
+	})
+
+	Describe("caching word counts", func() {
+
+		get := func(path, etag string) *http.Response {
+			req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", server.URL, path), nil)
+			Expect(err).NotTo(HaveOccurred())
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			return response
+		}
+
+		BeforeEach(func() {
+			cacheTTL = 10 * time.Second
+			wordCounter.CountRollingReturns(42, nil)
+		})
+
+		It("reuses a response until it expires", func() {
+			first := get("wordcount/day", "")
+			Expect(first.Header.Get("Cache-Control")).To(Equal("max-age=10"))
+			Expect(first.Header.Get("ETag")).NotTo(BeEmpty())
+			Expect(get("wordcount/day", "").Header.Get("ETag")).To(Equal(first.Header.Get("ETag")))
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(1))
+
+			clock.NowReturns(now.Add(4 * time.Second))
+			Expect(get("wordcount/day", "").Header.Get("Cache-Control")).To(Equal("max-age=6"))
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(1))
+
+			clock.NowReturns(now.Add(10 * time.Second))
+			get("wordcount/day", "")
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(2))
+		})
+
+		It("caches each period and set of query parameters separately", func() {
+			get("wordcount/day", "")
+			get("wordcount/week", "")
+			get("wordcount/day?source=twitter", "")
+			get("wordcount/day?source=twitter", "")
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(2))
+			Expect(wordCounter.CountBySourceCallCount()).To(Equal(1))
+		})
+
+		It("counts newly promoted keywords once the response expires", func() {
+			get("wordcount/day", "")
+			wordCounter.PromotedReturns([]string{"eggs"}, nil)
+			get("wordcount/day", "")
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(1))
+
+			clock.NowReturns(now.Add(10 * time.Second))
+			get("wordcount/day", "")
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(3))
+		})
+
+		It("counts keywords promoted through the API straight away", func() {
+			get("wordcount/day", "")
+			wordCounter.CandidatesReturns([]discovery.Candidate{{Phrase: "eggs"}}, nil)
+			wordCounter.PromotedReturns([]string{"eggs"}, nil)
+			req, err := http.NewRequest("POST", fmt.Sprintf("%s/discover/eggs/promote", server.URL), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer secret")
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			response.Body.Close()
+			get("wordcount/day", "")
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(3))
+		})
+
+		It("responds not modified when the client already has the response", func() {
+			etag := get("wordcount/day", "").Header.Get("ETag")
+			response := get("wordcount/day", etag)
+			Expect(response.StatusCode).To(Equal(http.StatusNotModified))
+			Expect(response.Header.Get("ETag")).To(Equal(etag))
+
+			wordCounter.CountRollingReturns(43, nil)
+			clock.NowReturns(now.Add(time.Minute))
+			Expect(get("wordcount/day", etag).StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("counts once for concurrent identical requests", func() {
+			release := make(chan struct{})
+			wordCounter.CountRollingStub = func(context.Context, string, period.Period) (uint, error) {
+				<-release
+				return 42, nil
+			}
+			responses := make(chan *http.Response)
+			for i := 0; i < 5; i++ {
+				go func() {
+					defer GinkgoRecover()
+					responses <- get("wordcount/day", "")
+				}()
+			}
+			Eventually(wordCounter.CountRollingCallCount).Should(Equal(1))
+			Consistently(wordCounter.CountRollingCallCount, "100ms").Should(Equal(1))
+			close(release)
+			for i := 0; i < 5; i++ {
+				Expect((<-responses).StatusCode).To(Equal(http.StatusOK))
+			}
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(1))
+			Expect(wordCounter.PromotedCallCount()).To(Equal(1))
+		})
+
+		It("does not cache errors", func() {
+			wordCounter.CountRollingReturns(0, errors.New("o no!"))
+			Expect(get("wordcount/day", "").StatusCode).To(Equal(500))
+			wordCounter.CountRollingReturns(42, nil)
+			Expect(get("wordcount/day", "").StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("suppressed hits", func() {
+
+		BeforeEach(func() {
+			keywords = []string{"bacon", "eggs"}
+			wordCounter.SuppressedStub = func(_ context.Context, word string, since time.Time) (map[string]uint, error) {
+				if word == "bacon" {
+					return map[string]uint{"duplicate": 5, "denied": 2}, nil
+				}
+				return map[string]uint{}, nil
+			}
+		})
+
+		It("reports the hits of each keyword suppressed in the period, by reason", func() {
+			response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "suppressed/hour"))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			var suppressed map[string]struct {
+				Total   uint            `json:"total"`
+				Reasons map[string]uint `json:"reasons"`
+			}
+			Expect(json.NewDecoder(response.Body).Decode(&suppressed)).To(Succeed())
+			Expect(suppressed["bacon"].Total).To(Equal(uint(7)))
+			Expect(suppressed["bacon"].Reasons).To(Equal(map[string]uint{"duplicate": 5, "denied": 2}))
+			Expect(suppressed["eggs"].Total).To(BeZero())
+
+			_, _, since := wordCounter.SuppressedArgsForCall(0)
+			Expect(since).To(Equal(now.Add(-time.Hour)))
+		})
+
+		It("does not know of other periods", func() {
+			response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "suppressed/fortnight"))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		})
+
+		Context("when getting suppressed hits fails", func() {
+
+			BeforeEach(func() {
+				wordCounter.SuppressedReturns(nil, errors.New("o no!"))
+			})
+
+			It("returns the error over HTTP", func() {
+				response, err := http.Get(fmt.Sprintf("%s/%s", server.URL, "suppressed/day"))
+				Expect(err).NotTo(HaveOccurred())
+				defer response.Body.Close()
+				Expect(response.StatusCode).To(Equal(500))
+			})
+		})
+	})
+
+	Describe("leaderboard", func() {
+
+		type entry struct {
+			Keyword       string  `json:"keyword"`
+			Count         uint    `json:"count"`
+			Rank          int     `json:"rank"`
+			Share         float64 `json:"share"`
+			PreviousCount uint    `json:"previousCount"`
+			PreviousRank  *int    `json:"previousRank"`
+			RankChange    *int    `json:"rankChange"`
+		}
+
+		intPtr := func(i int) *int { return &i }
+
+		BeforeEach(func() {
+			keywords = []string{"bacon", "eggs", "beans", "toast"}
+			counts := map[string]uint{"bacon": 10, "eggs": 20, "beans": 5, "toast": 5}
+			previousCounts := map[string]uint{"bacon": 30, "eggs": 20, "beans": 0, "toast": 10}
+			wordCounter.CountBetweenStub = func(_ context.Context, word string, since, until time.Time) (uint, error) {
+				if until.Equal(now) {
+					return counts[word], nil
+				}
+				return previousCounts[word], nil
+			}
+		})
+
+		getLeaderboard := func(p string) *http.Response {
+			response, err := http.Get(fmt.Sprintf("%s/leaderboard/%s", server.URL, p))
+			Expect(err).NotTo(HaveOccurred())
+			return response
+		}
+
+		It("ranks keywords by count with their share and rank change since the previous period", func() {
+			response := getLeaderboard("day")
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			var leaderboard []entry
+			Expect(json.NewDecoder(response.Body).Decode(&leaderboard)).To(Succeed())
+			Expect(leaderboard).To(Equal([]entry{
+				{Keyword: "eggs", Count: 20, Rank: 1, Share: 0.5, PreviousCount: 20, PreviousRank: intPtr(2), RankChange: intPtr(1)},
+				{Keyword: "bacon", Count: 10, Rank: 2, Share: 0.25, PreviousCount: 30, PreviousRank: intPtr(1), RankChange: intPtr(-1)},
+				{Keyword: "beans", Count: 5, Rank: 3, Share: 0.125},
+				{Keyword: "toast", Count: 5, Rank: 3, Share: 0.125, PreviousCount: 10, PreviousRank: intPtr(3), RankChange: intPtr(0)},
+			}))
+		})
+
+		It("counts the current period and the one before it alike", func() {
+			response := getLeaderboard("day")
+			response.Body.Close()
+			Expect(wordCounter.CountRollingCallCount()).To(Equal(0))
+			_, _, since, until := wordCounter.CountBetweenArgsForCall(0)
+			Expect(since).To(Equal(period.Day.Since(now)))
+			Expect(until).To(Equal(now))
+			_, _, since, until = wordCounter.CountBetweenArgsForCall(len(keywords))
+			Expect(since).To(Equal(period.Day.Since(period.Day.Since(now))))
+			Expect(until).To(Equal(period.Day.Since(now)))
+		})
+
+		It("does not know of other periods", func() {
+			response := getLeaderboard("fortnight")
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		})
+
+		Context("when counting the previous period fails", func() {
+
+			BeforeEach(func() {
+				wordCounter.CountBetweenStub = func(_ context.Context, _ string, _, until time.Time) (uint, error) {
+					if until.Equal(now) {
+						return 1, nil
+					}
+					return 0, errors.New("o no!")
+				}
+			})
+
+			It("returns the error over HTTP", func() {
+				response := getLeaderboard("week")
+				response.Body.Close()
+				Expect(response.StatusCode).To(Equal(500))
+			})
+		})
+	})
+
+	Describe("cooccurrence", func() {
+
+		var wordCounts map[string]uint
+
+		BeforeEach(func() {
+			keywords = []string{"bacon", "eggs", "beans"}
+			wordCounts = map[string]uint{"bacon": 20, "eggs": 10, "beans": 5}
+			wordCounter.CountStub = func(_ context.Context, word string, since time.Time) (uint, error) {
+				return wordCounts[word], nil
+			}
+			wordCounter.CountTweetsReturns(40, nil)
+			wordCounter.CountCooccurrencesStub = func(_ context.Context, first, second string, since time.Time) (uint, error) {
+				if (first == "bacon" && second == "eggs") || (first == "eggs" && second == "bacon") {
+					return 10, nil
+				}
+				return 0, nil
+			}
+		})
+
+		getMatrixFor := func(p string) (*http.Response, []byte) {
+			response, err := http.Get(fmt.Sprintf("%s/cooccurrence/%s", server.URL, p))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			bodyBytes, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return response, bodyBytes
+		}
+
+		getMatrix := func() (*http.Response, []byte) {
+			return getMatrixFor("day")
+		}
+
+		It("returns co-occurrence counts, lift and PMI for each pair of keywords in the last 24 hours", func() {
+			response, bodyBytes := getMatrix()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(response.Header["Content-Type"]).To(ConsistOf("application/json"))
+
+			var matrix map[string]map[string]struct {
+				Count uint     `json:"count"`
+				Lift  float64  `json:"lift"`
+				PMI   *float64 `json:"pmi"`
+			}
+			Expect(json.Unmarshal(bodyBytes, &matrix)).To(Succeed())
+			Expect(matrix).To(HaveLen(3))
+			Expect(matrix["bacon"]).To(HaveLen(2))
+			Expect(matrix["bacon"]).NotTo(HaveKey("bacon"))
+
+			baconEggs := matrix["bacon"]["eggs"]
+			Expect(baconEggs.Count).To(Equal(uint(10)))
+			Expect(baconEggs.Lift).To(BeNumerically("~", 2))
+			Expect(*baconEggs.PMI).To(BeNumerically("~", 1))
+			Expect(matrix["eggs"]["bacon"]).To(Equal(baconEggs))
+
+			baconBeans := matrix["bacon"]["beans"]
+			Expect(baconBeans.Count).To(BeZero())
+			Expect(baconBeans.Lift).To(BeZero())
+			Expect(baconBeans.PMI).To(BeNil())
+
+			Expect(wordCounter.CountTweetsCallCount()).To(Equal(1))
+			_, tweetsSince := wordCounter.CountTweetsArgsForCall(0)
+			Expect(tweetsSince).To(Equal(period.Day.Since(now)))
+			_, _, _, since := wordCounter.CountCooccurrencesArgsForCall(0)
+			Expect(since).To(Equal(period.Day.Since(now)))
+		})
+
+		It("counts co-occurrences over the requested period", func() {
+			response, _ := getMatrixFor("week")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			_, tweetsSince := wordCounter.CountTweetsArgsForCall(0)
+			Expect(tweetsSince).To(Equal(period.Week.Since(now)))
+			_, _, _, since := wordCounter.CountCooccurrencesArgsForCall(0)
+			Expect(since).To(Equal(period.Week.Since(now)))
+			_, _, countSince := wordCounter.CountArgsForCall(0)
+			Expect(countSince).To(Equal(period.Week.Since(now)))
+		})
+
+		It("returns 404 for an unknown period", func() {
+			response, _ := getMatrixFor("fortnight")
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		})
+
+		Context("when counting tweets fails", func() {
+
+			BeforeEach(func() {
+				wordCounter.CountTweetsReturns(0, errors.New("o no!"))
+			})
+
+			It("returns the error over HTTP", func() {
+				response, bodyBytes := getMatrix()
+				Expect(response.StatusCode).To(Equal(500))
+				Expect(string(bodyBytes)).To(Equal("o no!"))
+			})
+		})
+
+		Context("when counting co-occurrences fails", func() {
+
+			BeforeEach(func() {
+				wordCounter.CountCooccurrencesStub = nil
+				wordCounter.CountCooccurrencesReturns(0, errors.New("o no!"))
+			})
+
+			It("returns the error over HTTP", func() {
+				response, bodyBytes := getMatrix()
+				Expect(response.StatusCode).To(Equal(500))
+				Expect(string(bodyBytes)).To(Equal("o no!"))
+			})
+		})
+	})
+
+	Describe("sentiment", func() {
+
+		BeforeEach(func() {
+			wordCounter.CountReturns(4, nil)
+			wordCounter.SentimentReturns(sentiment.Tally{Sum: 6, Positive: 2, Negative: 1, Neutral: 1}, nil)
+		})
+
+		getSentimentFor := func(p string) (*http.Response, []byte) {
+			response, err := http.Get(fmt.Sprintf("%s/sentiment/%s", server.URL, p))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			bodyBytes, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return response, bodyBytes
+		}
+
+		getSentiment := func() (*http.Response, []byte) {
+			return getSentimentFor("day")
+		}
+
+		It("returns the count and sentiment of each keyword in the last 24 hours", func() {
+			response, bodyBytes := getSentiment()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(response.Header["Content-Type"]).To(ConsistOf("application/json"))
+			Expect(bodyBytes).To(MatchJSON(`{"bacon": {"count": 4, "average": 1.5, "positive": 2, "negative": 1, "neutral": 1}}`))
+
+			Expect(wordCounter.SentimentCallCount()).To(Equal(1))
+			_, word, since := wordCounter.SentimentArgsForCall(0)
+			Expect(word).To(Equal("bacon"))
+			Expect(since).To(Equal(period.Day.Since(now)))
+		})
+
+		It("reports sentiment over the requested period", func() {
+			response, _ := getSentimentFor("hour")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			_, _, since := wordCounter.SentimentArgsForCall(0)
+			Expect(since).To(Equal(period.Hour.Since(now)))
+			_, _, countSince := wordCounter.CountArgsForCall(0)
+			Expect(countSince).To(Equal(period.Hour.Since(now)))
+		})
+
+		It("returns 404 for an unknown period", func() {
+			response, _ := getSentimentFor("fortnight")
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		})
+
+		Context("when getting sentiment fails", func() {
+
+			BeforeEach(func() {
+				wordCounter.SentimentReturns(sentiment.Tally{}, errors.New("o no!"))
+			})
+
+			It("returns the error over HTTP", func() {
+				response, bodyBytes := getSentiment()
+				Expect(response.StatusCode).To(Equal(500))
+				Expect(string(bodyBytes)).To(Equal("o no!"))
+			})
+		})
+	})
+
+	Describe("samples", func() {
+
+		getSamples := func(word string) (*http.Response, []byte) {
+			response, err := http.Get(fmt.Sprintf("%s/keywords/%s/samples", server.URL, word))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			bodyBytes, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return response, bodyBytes
+		}
+
+		It("returns the recent and reservoir samples of tweets containing the keyword", func() {
+			wordCounter.SamplesReturns(
+				[]tweet.Tweet{{ID: "2", Text: "crispy bacon"}},
+				[]tweet.Tweet{{ID: "1"}},
+				nil,
+			)
+			response, bodyBytes := getSamples("bacon")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(response.Header["Content-Type"]).To(ConsistOf("application/json"))
+			Expect(bodyBytes).To(MatchJSON(`{"recent": [{"id": "2", "text": "crispy bacon"}], "reservoir": [{"id": "1"}]}`))
+
+			Expect(wordCounter.SamplesCallCount()).To(Equal(1))
+			_, word := wordCounter.SamplesArgsForCall(0)
+			Expect(word).To(Equal("bacon"))
+		})
+
+		Context("when the keyword is not tracked", func() {
+
+			It("returns 404", func() {
+				response, _ := getSamples("tofu")
+				Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+				Expect(wordCounter.SamplesCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when getting samples fails", func() {
+
+			BeforeEach(func() {
+				wordCounter.SamplesReturns(nil, nil, errors.New("o no!"))
+			})
+
+			It("returns the error over HTTP", func() {
+				response, bodyBytes := getSamples("bacon")
+				Expect(response.StatusCode).To(Equal(500))
+				Expect(string(bodyBytes)).To(Equal("o no!"))
+			})
+		})
+	})
+
+	Describe("related terms", func() {
+
+		getRelated := func(word string) (*http.Response, []byte) {
+			response, err := http.Get(fmt.Sprintf("%s/keywords/%s/related", server.URL, word))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			bodyBytes, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return response, bodyBytes
+		}
+
+		It("returns the terms most often found alongside the keyword", func() {
+			wordCounter.RelatedReturns([]topk.Item{{Term: "eggs", Count: 10, Error: 2}, {Term: "#brunch", Count: 4}}, nil)
+			response, bodyBytes := getRelated("bacon")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(response.Header["Content-Type"]).To(ConsistOf("application/json"))
+			Expect(bodyBytes).To(MatchJSON(`[{"term": "eggs", "count": 10, "error": 2}, {"term": "#brunch", "count": 4, "error": 0}]`))
+			_, word := wordCounter.RelatedArgsForCall(0)
+			Expect(word).To(Equal("bacon"))
+		})
+
+		Context("when the keyword is not tracked", func() {
+
+			It("returns 404", func() {
+				response, _ := getRelated("tofu")
+				Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+				Expect(wordCounter.RelatedCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when getting related terms fails", func() {
+
+			BeforeEach(func() {
+				wordCounter.RelatedReturns(nil, errors.New("o no!"))
+			})
+
+			It("returns the error over HTTP", func() {
+				response, bodyBytes := getRelated("bacon")
+				Expect(response.StatusCode).To(Equal(500))
+				Expect(string(bodyBytes)).To(Equal("o no!"))
+			})
+		})
+	})
 })
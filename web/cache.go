@@ -0,0 +1,181 @@
+package web
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cache keeps rendered responses for a short time, and coalesces concurrent
+// requests for the same key into a single computation, so a dashboard
+// refreshed by many browsers at once makes the same number of calls to Redis
+// as one refreshed by a single browser.
+type cache struct {
+	ttl   time.Duration
+	clock Clock
+
+	mutex     sync.Mutex
+	entries   map[string]*cacheEntry
+	flights   map[string]*flight
+	lastSwept time.Time
+}
+
+type cacheEntry struct {
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// flight is a computation shared by every request waiting for it. Its context
+// is cancelled once they have all gone away, and a later request starts a new
+// one.
+type flight struct {
+	done    chan struct{}
+	entry   *cacheEntry
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newCache(ttl time.Duration, clock Clock) *cache {
+	return &cache{
+		ttl:     ttl,
+		clock:   clock,
+		entries: make(map[string]*cacheEntry),
+		flights: make(map[string]*flight),
+	}
+}
+
+// get returns the response cached under key, or renders the result of
+// compute as JSON if there isn't one that's still fresh. Errors are not
+// cached.
+func (c *cache) get(ctx context.Context, key string, compute func(context.Context) (interface{}, error)) (*cacheEntry, error) {
+	c.mutex.Lock()
+	c.sweep(c.clock.Now())
+	if entry, ok := c.entries[key]; ok {
+		if c.clock.Now().Before(entry.expires) {
+			c.mutex.Unlock()
+			return entry, nil
+		}
+		delete(c.entries, key)
+	}
+	f, ok := c.flights[key]
+	if !ok {
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		c.flights[key] = f
+		go c.fly(flightCtx, key, f, compute)
+	}
+	f.waiters++
+	c.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.entry, f.err
+	case <-ctx.Done():
+		c.mutex.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			if c.flights[key] == f {
+				delete(c.flights, key)
+			}
+		}
+		c.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// sweep deletes expired entries once per ttl, so that responses to queries
+// that are never repeated do not accumulate.
+func (c *cache) sweep(now time.Time) {
+	if now.Sub(c.lastSwept) < c.ttl {
+		return
+	}
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.lastSwept = now
+}
+
+// clear deletes every entry, for when what they were computed from has
+// changed.
+func (c *cache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]*cacheEntry)
+}
+
+func (c *cache) fly(ctx context.Context, key string, f *flight, compute func(context.Context) (interface{}, error)) {
+	defer f.cancel()
+	v, err := compute(ctx)
+	if err == nil {
+		f.entry, f.err = c.render(v)
+	} else {
+		f.err = err
+	}
+	c.mutex.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	if f.err == nil && c.ttl > 0 {
+		c.entries[key] = f.entry
+	}
+	c.mutex.Unlock()
+	close(f.done)
+}
+
+func (c *cache) render(v interface{}) (*cacheEntry, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(body)
+	return &cacheEntry{
+		body:    body,
+		etag:    `"` + hex.EncodeToString(sum[:]) + `"`,
+		expires: c.clock.Now().Add(c.ttl),
+	}, nil
+}
+
+// write responds with entry, or with 304 Not Modified if the client already
+// has it. Clients may reuse the response for as long as it stays cached.
+func (c *cache) write(w http.ResponseWriter, req *http.Request, entry *cacheEntry) {
+	maxAge := int(math.Ceil(entry.expires.Sub(c.clock.Now()).Seconds()))
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", entry.etag)
+	if etagMatches(req.Header.Get("If-None-Match"), entry.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header()["Content-Type"] = []string{"application/json"}
+	if _, err := w.Write(entry.body); err != nil {
+		log.Println(err)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, ignoring
+// weak validators' W/ prefix as the weak comparison requires.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/craigfurman/bovine/discovery"
+
+	"github.com/gorilla/mux"
+)
+
+func (h *handler) handleDiscover(w http.ResponseWriter, req *http.Request) {
+	candidates, err := h.wordCounter.Candidates(req.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, candidates)
+}
+
+// handlePromote adds a current candidate phrase to the tracked keywords. This
+// process reports it straight away, and others once their cached responses
+// expire, but the gatherer only tracks it once restarted.
+func (h *handler) handlePromote(w http.ResponseWriter, req *http.Request) {
+	if !authorized(req, h.apiKey) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="bovine"`)
+		http.Error(w, "invalid API key", http.StatusUnauthorized)
+		return
+	}
+	ctx := req.Context()
+	phrase := mux.Vars(req)["phrase"]
+	candidates, err := h.wordCounter.Candidates(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !isCandidate(candidates, phrase) {
+		http.Error(w, fmt.Sprintf("%q is not a candidate", phrase), http.StatusNotFound)
+		return
+	}
+	if err := h.wordCounter.Promote(ctx, phrase); err != nil {
+		writeError(w, err)
+		return
+	}
+	h.cache.clear()
+	writeJSON(w, promotion{
+		Phrase: phrase,
+		Note:   "counted once running gatherers are restarted",
+	})
+}
+
+// promotion tells the client that a promoted phrase is not counted until the
+// gatherers, which load the tracked keywords when they start, are restarted.
+type promotion struct {
+	Phrase string `json:"phrase"`
+	Note   string `json:"note"`
+}
+
+func isCandidate(candidates []discovery.Candidate, phrase string) bool {
+	for _, candidate := range candidates {
+		if candidate.Phrase == phrase {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package web_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/craigfurman/bovine/discovery"
+	indexerFakes "github.com/craigfurman/bovine/indexer/fakes"
+	"github.com/craigfurman/bovine/web"
+	"github.com/craigfurman/bovine/web/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Discovery API", func() {
+
+	var (
+		server *httptest.Server
+
+		wordCounter *fakes.FakeWordCounter
+	)
+
+	BeforeEach(func() {
+		clock := new(indexerFakes.FakeClock)
+		clock.NowReturns(time.Now())
+		wordCounter = new(fakes.FakeWordCounter)
+		server = httptest.NewServer(web.New(wordCounter, []string{"bacon"}, clock, 0, "secret"))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("GET /discover", func() {
+
+		It("returns candidate phrases", func() {
+			wordCounter.CandidatesReturns([]discovery.Candidate{{Phrase: "circle back", Count: 6, PreviousCount: 1, Growth: 6}}, nil)
+			response, err := http.Get(fmt.Sprintf("%s/discover", server.URL))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			bodyBytes, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(response.Header["Content-Type"]).To(ConsistOf("application/json"))
+			Expect(bodyBytes).To(MatchJSON(`[{"phrase": "circle back", "count": 6, "previousCount": 1, "growth": 6}]`))
+		})
+
+		Context("when getting candidates fails", func() {
+
+			It("returns the error over HTTP", func() {
+				wordCounter.CandidatesReturns(nil, errors.New("o no!"))
+				response, err := http.Get(fmt.Sprintf("%s/discover", server.URL))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response.StatusCode).To(Equal(500))
+			})
+		})
+	})
+
+	Describe("POST /discover/{phrase}/promote", func() {
+
+		var body []byte
+
+		promote := func(apiKey string) *http.Response {
+			req, err := http.NewRequest("POST", fmt.Sprintf("%s/discover/circle%%20back/promote", server.URL), nil)
+			Expect(err).NotTo(HaveOccurred())
+			if apiKey != "" {
+				req.Header.Set("Authorization", "Bearer "+apiKey)
+			}
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			body, err = ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return response
+		}
+
+		BeforeEach(func() {
+			wordCounter.CandidatesReturns([]discovery.Candidate{{Phrase: "circle back", Count: 6, PreviousCount: 1, Growth: 6}}, nil)
+		})
+
+		It("promotes the phrase to a tracked keyword", func() {
+			response := promote("secret")
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"phrase": "circle back", "note": "counted once running gatherers are restarted"}`))
+			Expect(wordCounter.PromoteCallCount()).To(Equal(1))
+			_, phrase := wordCounter.PromoteArgsForCall(0)
+			Expect(phrase).To(Equal("circle back"))
+		})
+
+		It("rejects clients without the API key", func() {
+			Expect(promote("").StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(promote("wrong").StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(wordCounter.PromoteCallCount()).To(BeZero())
+		})
+
+		It("returns 404 for phrases that are not candidates", func() {
+			wordCounter.CandidatesReturns([]discovery.Candidate{{Phrase: "deep dive"}}, nil)
+			Expect(promote("secret").StatusCode).To(Equal(http.StatusNotFound))
+			Expect(wordCounter.PromoteCallCount()).To(BeZero())
+		})
+
+		Context("when getting candidates fails", func() {
+
+			It("returns the error over HTTP", func() {
+				wordCounter.CandidatesReturns(nil, errors.New("o no!"))
+				Expect(promote("secret").StatusCode).To(Equal(500))
+				Expect(wordCounter.PromoteCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when promoting fails", func() {
+
+			It("returns the error over HTTP", func() {
+				wordCounter.PromoteReturns(errors.New("o no!"))
+				Expect(promote("secret").StatusCode).To(Equal(500))
+			})
+		})
+
+		Context("when no API key is configured", func() {
+
+			BeforeEach(func() {
+				server.Close()
+				server = httptest.NewServer(web.New(wordCounter, []string{"bacon"}, new(indexerFakes.FakeClock), 0, ""))
+			})
+
+			It("rejects every client", func() {
+				Expect(promote("").StatusCode).To(Equal(http.StatusUnauthorized))
+				Expect(wordCounter.PromoteCallCount()).To(BeZero())
+			})
+		})
+	})
+
+	Context("when phrases have been promoted", func() {
+
+		BeforeEach(func() {
+			wordCounter.PromotedReturns([]string{"bacon", "circle back"}, nil)
+			wordCounter.CountRollingReturns(3, nil)
+		})
+
+		It("counts them alongside the configured keywords", func() {
+			response, err := http.Get(fmt.Sprintf("%s/wordcount/day", server.URL))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			bodyBytes, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bodyBytes).To(MatchJSON(`{"bacon": 3, "circle back": 3}`))
+		})
+
+		It("serves their samples", func() {
+			response, err := http.Get(fmt.Sprintf("%s/keywords/circle%%20back/samples", server.URL))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("when getting promoted phrases fails", func() {
+
+		It("returns the error over HTTP", func() {
+			wordCounter.PromotedReturns(nil, errors.New("o no!"))
+			response, err := http.Get(fmt.Sprintf("%s/wordcount/day", server.URL))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(500))
+		})
+	})
+})
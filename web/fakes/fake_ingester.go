@@ -0,0 +1,59 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"context"
+	"sync"
+
+	"github.com/craigfurman/bovine/tweet"
+	"github.com/craigfurman/bovine/web"
+)
+
+type FakeIngester struct {
+	IngestStub        func(ctx context.Context, posts []tweet.Tweet) (uint, error)
+	ingestMutex       sync.RWMutex
+	ingestArgsForCall []struct {
+		ctx   context.Context
+		posts []tweet.Tweet
+	}
+	ingestReturns struct {
+		result1 uint
+		result2 error
+	}
+}
+
+func (fake *FakeIngester) Ingest(ctx context.Context, posts []tweet.Tweet) (uint, error) {
+	fake.ingestMutex.Lock()
+	fake.ingestArgsForCall = append(fake.ingestArgsForCall, struct {
+		ctx   context.Context
+		posts []tweet.Tweet
+	}{ctx, posts})
+	fake.ingestMutex.Unlock()
+	if fake.IngestStub != nil {
+		return fake.IngestStub(ctx, posts)
+	} else {
+		return fake.ingestReturns.result1, fake.ingestReturns.result2
+	}
+}
+
+func (fake *FakeIngester) IngestCallCount() int {
+	fake.ingestMutex.RLock()
+	defer fake.ingestMutex.RUnlock()
+	return len(fake.ingestArgsForCall)
+}
+
+func (fake *FakeIngester) IngestArgsForCall(i int) (context.Context, []tweet.Tweet) {
+	fake.ingestMutex.RLock()
+	defer fake.ingestMutex.RUnlock()
+	return fake.ingestArgsForCall[i].ctx, fake.ingestArgsForCall[i].posts
+}
+
+func (fake *FakeIngester) IngestReturns(result1 uint, result2 error) {
+	fake.IngestStub = nil
+	fake.ingestReturns = struct {
+		result1 uint
+		result2 error
+	}{result1, result2}
+}
+
+var _ web.Ingester = new(FakeIngester)
@@ -2,16 +2,24 @@
 package fakes
 
 import (
+	"context"
 	"sync"
 	"time"
 
+	"github.com/craigfurman/bovine/discovery"
+	"github.com/craigfurman/bovine/health"
+	"github.com/craigfurman/bovine/period"
+	"github.com/craigfurman/bovine/sentiment"
+	"github.com/craigfurman/bovine/topk"
+	"github.com/craigfurman/bovine/tweet"
 	"github.com/craigfurman/bovine/web"
 )
 
 type FakeWordCounter struct {
-	CountStub        func(word string, since time.Time) (uint, error)
+	CountStub        func(ctx context.Context, word string, since time.Time) (uint, error)
 	countMutex       sync.RWMutex
 	countArgsForCall []struct {
+		ctx   context.Context
 		word  string
 		since time.Time
 	}
@@ -19,17 +27,172 @@ type FakeWordCounter struct {
 		result1 uint
 		result2 error
 	}
+	CountBetweenStub        func(ctx context.Context, word string, since time.Time, until time.Time) (uint, error)
+	countBetweenMutex       sync.RWMutex
+	countBetweenArgsForCall []struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+		until time.Time
+	}
+	countBetweenReturns struct {
+		result1 uint
+		result2 error
+	}
+	CountRollingStub        func(ctx context.Context, word string, p period.Period) (uint, error)
+	countRollingMutex       sync.RWMutex
+	countRollingArgsForCall []struct {
+		ctx  context.Context
+		word string
+		p    period.Period
+	}
+	countRollingReturns struct {
+		result1 uint
+		result2 error
+	}
+	CountAuthorsStub        func(ctx context.Context, word string, since time.Time) (uint, error)
+	countAuthorsMutex       sync.RWMutex
+	countAuthorsArgsForCall []struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+	}
+	countAuthorsReturns struct {
+		result1 uint
+		result2 error
+	}
+	CountBySourceStub        func(ctx context.Context, word string, since time.Time) (map[string]uint, error)
+	countBySourceMutex       sync.RWMutex
+	countBySourceArgsForCall []struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+	}
+	countBySourceReturns struct {
+		result1 map[string]uint
+		result2 error
+	}
+	CountCooccurrencesStub        func(ctx context.Context, first string, second string, since time.Time) (uint, error)
+	countCooccurrencesMutex       sync.RWMutex
+	countCooccurrencesArgsForCall []struct {
+		ctx    context.Context
+		first  string
+		second string
+		since  time.Time
+	}
+	countCooccurrencesReturns struct {
+		result1 uint
+		result2 error
+	}
+	CountTweetsStub        func(ctx context.Context, since time.Time) (uint, error)
+	countTweetsMutex       sync.RWMutex
+	countTweetsArgsForCall []struct {
+		ctx   context.Context
+		since time.Time
+	}
+	countTweetsReturns struct {
+		result1 uint
+		result2 error
+	}
+	SentimentStub        func(ctx context.Context, word string, since time.Time) (sentiment.Tally, error)
+	sentimentMutex       sync.RWMutex
+	sentimentArgsForCall []struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+	}
+	sentimentReturns struct {
+		result1 sentiment.Tally
+		result2 error
+	}
+	SuppressedStub        func(ctx context.Context, word string, since time.Time) (map[string]uint, error)
+	suppressedMutex       sync.RWMutex
+	suppressedArgsForCall []struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+	}
+	suppressedReturns struct {
+		result1 map[string]uint
+		result2 error
+	}
+	SamplesStub        func(ctx context.Context, word string) ([]tweet.Tweet, []tweet.Tweet, error)
+	samplesMutex       sync.RWMutex
+	samplesArgsForCall []struct {
+		ctx  context.Context
+		word string
+	}
+	samplesReturns struct {
+		result1 []tweet.Tweet
+		result2 []tweet.Tweet
+		result3 error
+	}
+	RelatedStub        func(ctx context.Context, word string) ([]topk.Item, error)
+	relatedMutex       sync.RWMutex
+	relatedArgsForCall []struct {
+		ctx  context.Context
+		word string
+	}
+	relatedReturns struct {
+		result1 []topk.Item
+		result2 error
+	}
+	CandidatesStub        func(ctx context.Context) ([]discovery.Candidate, error)
+	candidatesMutex       sync.RWMutex
+	candidatesArgsForCall []struct {
+		ctx context.Context
+	}
+	candidatesReturns struct {
+		result1 []discovery.Candidate
+		result2 error
+	}
+	PromoteStub        func(ctx context.Context, phrase string) error
+	promoteMutex       sync.RWMutex
+	promoteArgsForCall []struct {
+		ctx    context.Context
+		phrase string
+	}
+	promoteReturns struct {
+		result1 error
+	}
+	PromotedStub        func(ctx context.Context) ([]string, error)
+	promotedMutex       sync.RWMutex
+	promotedArgsForCall []struct {
+		ctx context.Context
+	}
+	promotedReturns struct {
+		result1 []string
+		result2 error
+	}
+	PingStub        func(ctx context.Context) error
+	pingMutex       sync.RWMutex
+	pingArgsForCall []struct {
+		ctx context.Context
+	}
+	pingReturns struct {
+		result1 error
+	}
+	StreamsStub        func(ctx context.Context) ([]health.Stream, error)
+	streamsMutex       sync.RWMutex
+	streamsArgsForCall []struct {
+		ctx context.Context
+	}
+	streamsReturns struct {
+		result1 []health.Stream
+		result2 error
+	}
 }
 
-func (fake *FakeWordCounter) Count(word string, since time.Time) (uint, error) {
+func (fake *FakeWordCounter) Count(ctx context.Context, word string, since time.Time) (uint, error) {
 	fake.countMutex.Lock()
 	fake.countArgsForCall = append(fake.countArgsForCall, struct {
+		ctx   context.Context
 		word  string
 		since time.Time
-	}{word, since})
+	}{ctx, word, since})
 	fake.countMutex.Unlock()
 	if fake.CountStub != nil {
-		return fake.CountStub(word, since)
+		return fake.CountStub(ctx, word, since)
 	} else {
 		return fake.countReturns.result1, fake.countReturns.result2
 	}
@@ -41,10 +204,10 @@ func (fake *FakeWordCounter) CountCallCount() int {
 	return len(fake.countArgsForCall)
 }
 
-func (fake *FakeWordCounter) CountArgsForCall(i int) (string, time.Time) {
+func (fake *FakeWordCounter) CountArgsForCall(i int) (context.Context, string, time.Time) {
 	fake.countMutex.RLock()
 	defer fake.countMutex.RUnlock()
-	return fake.countArgsForCall[i].word, fake.countArgsForCall[i].since
+	return fake.countArgsForCall[i].ctx, fake.countArgsForCall[i].word, fake.countArgsForCall[i].since
 }
 
 func (fake *FakeWordCounter) CountReturns(result1 uint, result2 error) {
@@ -55,4 +218,518 @@ func (fake *FakeWordCounter) CountReturns(result1 uint, result2 error) {
 	}{result1, result2}
 }
 
+func (fake *FakeWordCounter) CountBetween(ctx context.Context, word string, since time.Time, until time.Time) (uint, error) {
+	fake.countBetweenMutex.Lock()
+	fake.countBetweenArgsForCall = append(fake.countBetweenArgsForCall, struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+		until time.Time
+	}{ctx, word, since, until})
+	fake.countBetweenMutex.Unlock()
+	if fake.CountBetweenStub != nil {
+		return fake.CountBetweenStub(ctx, word, since, until)
+	} else {
+		return fake.countBetweenReturns.result1, fake.countBetweenReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) CountBetweenCallCount() int {
+	fake.countBetweenMutex.RLock()
+	defer fake.countBetweenMutex.RUnlock()
+	return len(fake.countBetweenArgsForCall)
+}
+
+func (fake *FakeWordCounter) CountBetweenArgsForCall(i int) (context.Context, string, time.Time, time.Time) {
+	fake.countBetweenMutex.RLock()
+	defer fake.countBetweenMutex.RUnlock()
+	return fake.countBetweenArgsForCall[i].ctx, fake.countBetweenArgsForCall[i].word, fake.countBetweenArgsForCall[i].since, fake.countBetweenArgsForCall[i].until
+}
+
+func (fake *FakeWordCounter) CountBetweenReturns(result1 uint, result2 error) {
+	fake.CountBetweenStub = nil
+	fake.countBetweenReturns = struct {
+		result1 uint
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) CountRolling(ctx context.Context, word string, p period.Period) (uint, error) {
+	fake.countRollingMutex.Lock()
+	fake.countRollingArgsForCall = append(fake.countRollingArgsForCall, struct {
+		ctx  context.Context
+		word string
+		p    period.Period
+	}{ctx, word, p})
+	fake.countRollingMutex.Unlock()
+	if fake.CountRollingStub != nil {
+		return fake.CountRollingStub(ctx, word, p)
+	} else {
+		return fake.countRollingReturns.result1, fake.countRollingReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) CountRollingCallCount() int {
+	fake.countRollingMutex.RLock()
+	defer fake.countRollingMutex.RUnlock()
+	return len(fake.countRollingArgsForCall)
+}
+
+func (fake *FakeWordCounter) CountRollingArgsForCall(i int) (context.Context, string, period.Period) {
+	fake.countRollingMutex.RLock()
+	defer fake.countRollingMutex.RUnlock()
+	return fake.countRollingArgsForCall[i].ctx, fake.countRollingArgsForCall[i].word, fake.countRollingArgsForCall[i].p
+}
+
+func (fake *FakeWordCounter) CountRollingReturns(result1 uint, result2 error) {
+	fake.CountRollingStub = nil
+	fake.countRollingReturns = struct {
+		result1 uint
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) CountAuthors(ctx context.Context, word string, since time.Time) (uint, error) {
+	fake.countAuthorsMutex.Lock()
+	fake.countAuthorsArgsForCall = append(fake.countAuthorsArgsForCall, struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+	}{ctx, word, since})
+	fake.countAuthorsMutex.Unlock()
+	if fake.CountAuthorsStub != nil {
+		return fake.CountAuthorsStub(ctx, word, since)
+	} else {
+		return fake.countAuthorsReturns.result1, fake.countAuthorsReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) CountAuthorsCallCount() int {
+	fake.countAuthorsMutex.RLock()
+	defer fake.countAuthorsMutex.RUnlock()
+	return len(fake.countAuthorsArgsForCall)
+}
+
+func (fake *FakeWordCounter) CountAuthorsArgsForCall(i int) (context.Context, string, time.Time) {
+	fake.countAuthorsMutex.RLock()
+	defer fake.countAuthorsMutex.RUnlock()
+	return fake.countAuthorsArgsForCall[i].ctx, fake.countAuthorsArgsForCall[i].word, fake.countAuthorsArgsForCall[i].since
+}
+
+func (fake *FakeWordCounter) CountAuthorsReturns(result1 uint, result2 error) {
+	fake.CountAuthorsStub = nil
+	fake.countAuthorsReturns = struct {
+		result1 uint
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) CountBySource(ctx context.Context, word string, since time.Time) (map[string]uint, error) {
+	fake.countBySourceMutex.Lock()
+	fake.countBySourceArgsForCall = append(fake.countBySourceArgsForCall, struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+	}{ctx, word, since})
+	fake.countBySourceMutex.Unlock()
+	if fake.CountBySourceStub != nil {
+		return fake.CountBySourceStub(ctx, word, since)
+	} else {
+		return fake.countBySourceReturns.result1, fake.countBySourceReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) CountBySourceCallCount() int {
+	fake.countBySourceMutex.RLock()
+	defer fake.countBySourceMutex.RUnlock()
+	return len(fake.countBySourceArgsForCall)
+}
+
+func (fake *FakeWordCounter) CountBySourceArgsForCall(i int) (context.Context, string, time.Time) {
+	fake.countBySourceMutex.RLock()
+	defer fake.countBySourceMutex.RUnlock()
+	return fake.countBySourceArgsForCall[i].ctx, fake.countBySourceArgsForCall[i].word, fake.countBySourceArgsForCall[i].since
+}
+
+func (fake *FakeWordCounter) CountBySourceReturns(result1 map[string]uint, result2 error) {
+	fake.CountBySourceStub = nil
+	fake.countBySourceReturns = struct {
+		result1 map[string]uint
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) CountCooccurrences(ctx context.Context, first string, second string, since time.Time) (uint, error) {
+	fake.countCooccurrencesMutex.Lock()
+	fake.countCooccurrencesArgsForCall = append(fake.countCooccurrencesArgsForCall, struct {
+		ctx    context.Context
+		first  string
+		second string
+		since  time.Time
+	}{ctx, first, second, since})
+	fake.countCooccurrencesMutex.Unlock()
+	if fake.CountCooccurrencesStub != nil {
+		return fake.CountCooccurrencesStub(ctx, first, second, since)
+	} else {
+		return fake.countCooccurrencesReturns.result1, fake.countCooccurrencesReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) CountCooccurrencesCallCount() int {
+	fake.countCooccurrencesMutex.RLock()
+	defer fake.countCooccurrencesMutex.RUnlock()
+	return len(fake.countCooccurrencesArgsForCall)
+}
+
+func (fake *FakeWordCounter) CountCooccurrencesArgsForCall(i int) (context.Context, string, string, time.Time) {
+	fake.countCooccurrencesMutex.RLock()
+	defer fake.countCooccurrencesMutex.RUnlock()
+	return fake.countCooccurrencesArgsForCall[i].ctx, fake.countCooccurrencesArgsForCall[i].first, fake.countCooccurrencesArgsForCall[i].second, fake.countCooccurrencesArgsForCall[i].since
+}
+
+func (fake *FakeWordCounter) CountCooccurrencesReturns(result1 uint, result2 error) {
+	fake.CountCooccurrencesStub = nil
+	fake.countCooccurrencesReturns = struct {
+		result1 uint
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) CountTweets(ctx context.Context, since time.Time) (uint, error) {
+	fake.countTweetsMutex.Lock()
+	fake.countTweetsArgsForCall = append(fake.countTweetsArgsForCall, struct {
+		ctx   context.Context
+		since time.Time
+	}{ctx, since})
+	fake.countTweetsMutex.Unlock()
+	if fake.CountTweetsStub != nil {
+		return fake.CountTweetsStub(ctx, since)
+	} else {
+		return fake.countTweetsReturns.result1, fake.countTweetsReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) CountTweetsCallCount() int {
+	fake.countTweetsMutex.RLock()
+	defer fake.countTweetsMutex.RUnlock()
+	return len(fake.countTweetsArgsForCall)
+}
+
+func (fake *FakeWordCounter) CountTweetsArgsForCall(i int) (context.Context, time.Time) {
+	fake.countTweetsMutex.RLock()
+	defer fake.countTweetsMutex.RUnlock()
+	return fake.countTweetsArgsForCall[i].ctx, fake.countTweetsArgsForCall[i].since
+}
+
+func (fake *FakeWordCounter) CountTweetsReturns(result1 uint, result2 error) {
+	fake.CountTweetsStub = nil
+	fake.countTweetsReturns = struct {
+		result1 uint
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) Sentiment(ctx context.Context, word string, since time.Time) (sentiment.Tally, error) {
+	fake.sentimentMutex.Lock()
+	fake.sentimentArgsForCall = append(fake.sentimentArgsForCall, struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+	}{ctx, word, since})
+	fake.sentimentMutex.Unlock()
+	if fake.SentimentStub != nil {
+		return fake.SentimentStub(ctx, word, since)
+	} else {
+		return fake.sentimentReturns.result1, fake.sentimentReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) SentimentCallCount() int {
+	fake.sentimentMutex.RLock()
+	defer fake.sentimentMutex.RUnlock()
+	return len(fake.sentimentArgsForCall)
+}
+
+func (fake *FakeWordCounter) SentimentArgsForCall(i int) (context.Context, string, time.Time) {
+	fake.sentimentMutex.RLock()
+	defer fake.sentimentMutex.RUnlock()
+	return fake.sentimentArgsForCall[i].ctx, fake.sentimentArgsForCall[i].word, fake.sentimentArgsForCall[i].since
+}
+
+func (fake *FakeWordCounter) SentimentReturns(result1 sentiment.Tally, result2 error) {
+	fake.SentimentStub = nil
+	fake.sentimentReturns = struct {
+		result1 sentiment.Tally
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) Suppressed(ctx context.Context, word string, since time.Time) (map[string]uint, error) {
+	fake.suppressedMutex.Lock()
+	fake.suppressedArgsForCall = append(fake.suppressedArgsForCall, struct {
+		ctx   context.Context
+		word  string
+		since time.Time
+	}{ctx, word, since})
+	fake.suppressedMutex.Unlock()
+	if fake.SuppressedStub != nil {
+		return fake.SuppressedStub(ctx, word, since)
+	} else {
+		return fake.suppressedReturns.result1, fake.suppressedReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) SuppressedCallCount() int {
+	fake.suppressedMutex.RLock()
+	defer fake.suppressedMutex.RUnlock()
+	return len(fake.suppressedArgsForCall)
+}
+
+func (fake *FakeWordCounter) SuppressedArgsForCall(i int) (context.Context, string, time.Time) {
+	fake.suppressedMutex.RLock()
+	defer fake.suppressedMutex.RUnlock()
+	return fake.suppressedArgsForCall[i].ctx, fake.suppressedArgsForCall[i].word, fake.suppressedArgsForCall[i].since
+}
+
+func (fake *FakeWordCounter) SuppressedReturns(result1 map[string]uint, result2 error) {
+	fake.SuppressedStub = nil
+	fake.suppressedReturns = struct {
+		result1 map[string]uint
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) Samples(ctx context.Context, word string) ([]tweet.Tweet, []tweet.Tweet, error) {
+	fake.samplesMutex.Lock()
+	fake.samplesArgsForCall = append(fake.samplesArgsForCall, struct {
+		ctx  context.Context
+		word string
+	}{ctx, word})
+	fake.samplesMutex.Unlock()
+	if fake.SamplesStub != nil {
+		return fake.SamplesStub(ctx, word)
+	} else {
+		return fake.samplesReturns.result1, fake.samplesReturns.result2, fake.samplesReturns.result3
+	}
+}
+
+func (fake *FakeWordCounter) SamplesCallCount() int {
+	fake.samplesMutex.RLock()
+	defer fake.samplesMutex.RUnlock()
+	return len(fake.samplesArgsForCall)
+}
+
+func (fake *FakeWordCounter) SamplesArgsForCall(i int) (context.Context, string) {
+	fake.samplesMutex.RLock()
+	defer fake.samplesMutex.RUnlock()
+	return fake.samplesArgsForCall[i].ctx, fake.samplesArgsForCall[i].word
+}
+
+func (fake *FakeWordCounter) SamplesReturns(result1 []tweet.Tweet, result2 []tweet.Tweet, result3 error) {
+	fake.SamplesStub = nil
+	fake.samplesReturns = struct {
+		result1 []tweet.Tweet
+		result2 []tweet.Tweet
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeWordCounter) Related(ctx context.Context, word string) ([]topk.Item, error) {
+	fake.relatedMutex.Lock()
+	fake.relatedArgsForCall = append(fake.relatedArgsForCall, struct {
+		ctx  context.Context
+		word string
+	}{ctx, word})
+	fake.relatedMutex.Unlock()
+	if fake.RelatedStub != nil {
+		return fake.RelatedStub(ctx, word)
+	} else {
+		return fake.relatedReturns.result1, fake.relatedReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) RelatedCallCount() int {
+	fake.relatedMutex.RLock()
+	defer fake.relatedMutex.RUnlock()
+	return len(fake.relatedArgsForCall)
+}
+
+func (fake *FakeWordCounter) RelatedArgsForCall(i int) (context.Context, string) {
+	fake.relatedMutex.RLock()
+	defer fake.relatedMutex.RUnlock()
+	return fake.relatedArgsForCall[i].ctx, fake.relatedArgsForCall[i].word
+}
+
+func (fake *FakeWordCounter) RelatedReturns(result1 []topk.Item, result2 error) {
+	fake.RelatedStub = nil
+	fake.relatedReturns = struct {
+		result1 []topk.Item
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) Candidates(ctx context.Context) ([]discovery.Candidate, error) {
+	fake.candidatesMutex.Lock()
+	fake.candidatesArgsForCall = append(fake.candidatesArgsForCall, struct {
+		ctx context.Context
+	}{ctx})
+	fake.candidatesMutex.Unlock()
+	if fake.CandidatesStub != nil {
+		return fake.CandidatesStub(ctx)
+	} else {
+		return fake.candidatesReturns.result1, fake.candidatesReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) CandidatesCallCount() int {
+	fake.candidatesMutex.RLock()
+	defer fake.candidatesMutex.RUnlock()
+	return len(fake.candidatesArgsForCall)
+}
+
+func (fake *FakeWordCounter) CandidatesArgsForCall(i int) context.Context {
+	fake.candidatesMutex.RLock()
+	defer fake.candidatesMutex.RUnlock()
+	return fake.candidatesArgsForCall[i].ctx
+}
+
+func (fake *FakeWordCounter) CandidatesReturns(result1 []discovery.Candidate, result2 error) {
+	fake.CandidatesStub = nil
+	fake.candidatesReturns = struct {
+		result1 []discovery.Candidate
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) Promote(ctx context.Context, phrase string) error {
+	fake.promoteMutex.Lock()
+	fake.promoteArgsForCall = append(fake.promoteArgsForCall, struct {
+		ctx    context.Context
+		phrase string
+	}{ctx, phrase})
+	fake.promoteMutex.Unlock()
+	if fake.PromoteStub != nil {
+		return fake.PromoteStub(ctx, phrase)
+	} else {
+		return fake.promoteReturns.result1
+	}
+}
+
+func (fake *FakeWordCounter) PromoteCallCount() int {
+	fake.promoteMutex.RLock()
+	defer fake.promoteMutex.RUnlock()
+	return len(fake.promoteArgsForCall)
+}
+
+func (fake *FakeWordCounter) PromoteArgsForCall(i int) (context.Context, string) {
+	fake.promoteMutex.RLock()
+	defer fake.promoteMutex.RUnlock()
+	return fake.promoteArgsForCall[i].ctx, fake.promoteArgsForCall[i].phrase
+}
+
+func (fake *FakeWordCounter) PromoteReturns(result1 error) {
+	fake.PromoteStub = nil
+	fake.promoteReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeWordCounter) Promoted(ctx context.Context) ([]string, error) {
+	fake.promotedMutex.Lock()
+	fake.promotedArgsForCall = append(fake.promotedArgsForCall, struct {
+		ctx context.Context
+	}{ctx})
+	fake.promotedMutex.Unlock()
+	if fake.PromotedStub != nil {
+		return fake.PromotedStub(ctx)
+	} else {
+		return fake.promotedReturns.result1, fake.promotedReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) PromotedCallCount() int {
+	fake.promotedMutex.RLock()
+	defer fake.promotedMutex.RUnlock()
+	return len(fake.promotedArgsForCall)
+}
+
+func (fake *FakeWordCounter) PromotedArgsForCall(i int) context.Context {
+	fake.promotedMutex.RLock()
+	defer fake.promotedMutex.RUnlock()
+	return fake.promotedArgsForCall[i].ctx
+}
+
+func (fake *FakeWordCounter) PromotedReturns(result1 []string, result2 error) {
+	fake.PromotedStub = nil
+	fake.promotedReturns = struct {
+		result1 []string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeWordCounter) Ping(ctx context.Context) error {
+	fake.pingMutex.Lock()
+	fake.pingArgsForCall = append(fake.pingArgsForCall, struct {
+		ctx context.Context
+	}{ctx})
+	fake.pingMutex.Unlock()
+	if fake.PingStub != nil {
+		return fake.PingStub(ctx)
+	} else {
+		return fake.pingReturns.result1
+	}
+}
+
+func (fake *FakeWordCounter) PingCallCount() int {
+	fake.pingMutex.RLock()
+	defer fake.pingMutex.RUnlock()
+	return len(fake.pingArgsForCall)
+}
+
+func (fake *FakeWordCounter) PingArgsForCall(i int) context.Context {
+	fake.pingMutex.RLock()
+	defer fake.pingMutex.RUnlock()
+	return fake.pingArgsForCall[i].ctx
+}
+
+func (fake *FakeWordCounter) PingReturns(result1 error) {
+	fake.PingStub = nil
+	fake.pingReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeWordCounter) Streams(ctx context.Context) ([]health.Stream, error) {
+	fake.streamsMutex.Lock()
+	fake.streamsArgsForCall = append(fake.streamsArgsForCall, struct {
+		ctx context.Context
+	}{ctx})
+	fake.streamsMutex.Unlock()
+	if fake.StreamsStub != nil {
+		return fake.StreamsStub(ctx)
+	} else {
+		return fake.streamsReturns.result1, fake.streamsReturns.result2
+	}
+}
+
+func (fake *FakeWordCounter) StreamsCallCount() int {
+	fake.streamsMutex.RLock()
+	defer fake.streamsMutex.RUnlock()
+	return len(fake.streamsArgsForCall)
+}
+
+func (fake *FakeWordCounter) StreamsArgsForCall(i int) context.Context {
+	fake.streamsMutex.RLock()
+	defer fake.streamsMutex.RUnlock()
+	return fake.streamsArgsForCall[i].ctx
+}
+
+func (fake *FakeWordCounter) StreamsReturns(result1 []health.Stream, result2 error) {
+	fake.StreamsStub = nil
+	fake.streamsReturns = struct {
+		result1 []health.Stream
+		result2 error
+	}{result1, result2}
+}
+
 var _ web.WordCounter = new(FakeWordCounter)
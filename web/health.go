@@ -0,0 +1,103 @@
+package web
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/health"
+
+	"github.com/gorilla/mux"
+)
+
+// HealthChecker reports on the services bovine depends on.
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+	Streams(ctx context.Context) ([]health.Stream, error)
+}
+
+// Spool reports how many counts a gatherer is holding on disk until Redis
+// recovers.
+type Spool interface {
+	Depth() int
+}
+
+// CircuitBreaker is implemented by health checkers that make their calls to
+// Redis through a circuit breaker, whose state /readyz reports.
+type CircuitBreaker interface {
+	BreakerStats() breaker.Stats
+}
+
+type readiness struct {
+	Redis   string          `json:"redis"`
+	Streams []health.Stream `json:"streams"`
+	Spool   *int            `json:"spool,omitempty"`
+	Breaker *breaker.Stats  `json:"breaker,omitempty"`
+}
+
+// NewHealth serves only /healthz and /readyz, for processes that do not serve
+// the API. If requiredSource is set, the process is not ready unless the
+// stream from that source is connected. If spool is not nil, /readyz reports
+// its depth.
+func NewHealth(checker HealthChecker, requiredSource string, spool Spool) *mux.Router {
+	r := mux.NewRouter()
+	addHealthRoutes(r, checker, requiredSource, spool)
+	return r
+}
+
+func addHealthRoutes(r *mux.Router, checker HealthChecker, requiredSource string, spool Spool) {
+	r.HandleFunc("/healthz", handleHealthz).
+		Methods("GET")
+	r.HandleFunc("/readyz", readyz(checker, requiredSource, spool)).
+		Methods("GET")
+	r.Handle("/debug/vars", expvar.Handler()).
+		Methods("GET")
+}
+
+// handleHealthz reports that the process is alive, regardless of whether its
+// dependencies are available.
+func handleHealthz(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func readyz(checker HealthChecker, requiredSource string, spool Spool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		status := readiness{Redis: "ok", Streams: []health.Stream{}}
+		if spool != nil {
+			depth := spool.Depth()
+			status.Spool = &depth
+		}
+		if b, ok := checker.(CircuitBreaker); ok {
+			stats := b.BreakerStats()
+			status.Breaker = &stats
+		}
+		err := checker.Ping(req.Context())
+		if err == nil {
+			var streams []health.Stream
+			if streams, err = checker.Streams(req.Context()); len(streams) > 0 {
+				status.Streams = streams
+			}
+		}
+		if err != nil {
+			status.Redis = err.Error()
+			setRetryAfter(w, err)
+			writeJSONStatus(w, http.StatusServiceUnavailable, status)
+			return
+		}
+		if requiredSource != "" && !connected(status.Streams, requiredSource) {
+			writeJSONStatus(w, http.StatusServiceUnavailable, status)
+			return
+		}
+		writeJSON(w, status)
+	}
+}
+
+func connected(streams []health.Stream, source string) bool {
+	for _, stream := range streams {
+		if stream.Source == source {
+			return stream.Connected
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package web_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/craigfurman/bovine/breaker"
+	"github.com/craigfurman/bovine/health"
+	indexerFakes "github.com/craigfurman/bovine/indexer/fakes"
+	"github.com/craigfurman/bovine/web"
+	"github.com/craigfurman/bovine/web/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type spoolDepth int
+
+type guardedCounter struct {
+	*fakes.FakeWordCounter
+	stats breaker.Stats
+}
+
+func (g guardedCounter) BreakerStats() breaker.Stats {
+	return g.stats
+}
+
+func (d spoolDepth) Depth() int {
+	return int(d)
+}
+
+var _ = Describe("Health checks", func() {
+
+	var (
+		server *httptest.Server
+
+		wordCounter *fakes.FakeWordCounter
+	)
+
+	get := func(path string) (int, map[string]interface{}) {
+		response, err := http.Get(fmt.Sprintf("%s%s", server.URL, path))
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.Header["Content-Type"]).To(ConsistOf("application/json"))
+		body := make(map[string]interface{})
+		Expect(json.NewDecoder(response.Body).Decode(&body)).To(Succeed())
+		return response.StatusCode, body
+	}
+
+	BeforeEach(func() {
+		wordCounter = new(fakes.FakeWordCounter)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("in the API", func() {
+
+		BeforeEach(func() {
+			clock := new(indexerFakes.FakeClock)
+			clock.NowReturns(time.Now())
+			server = httptest.NewServer(web.New(wordCounter, []string{"bacon"}, clock, 0, ""))
+		})
+
+		Describe("GET /healthz", func() {
+
+			It("reports the process as alive even if redis is not", func() {
+				wordCounter.PingReturns(errors.New("connection refused"))
+				status, body := get("/healthz")
+				Expect(status).To(Equal(http.StatusOK))
+				Expect(body).To(Equal(map[string]interface{}{"status": "ok"}))
+			})
+		})
+
+		Describe("GET /readyz", func() {
+
+			It("is ready when redis is reachable, whether or not the stream is connected", func() {
+				status, body := get("/readyz")
+				Expect(status).To(Equal(http.StatusOK))
+				Expect(body["redis"]).To(Equal("ok"))
+				Expect(body["streams"]).To(BeEmpty())
+			})
+
+			It("is not ready when redis is unreachable", func() {
+				wordCounter.PingReturns(errors.New("connection refused"))
+				status, body := get("/readyz")
+				Expect(status).To(Equal(http.StatusServiceUnavailable))
+				Expect(body["redis"]).To(Equal("connection refused"))
+			})
+
+			It("does not report a circuit breaker around redis calls made without one", func() {
+				_, body := get("/readyz")
+				Expect(body).NotTo(HaveKey("breaker"))
+			})
+		})
+
+		Describe("GET /debug/vars", func() {
+
+			It("serves the process's metrics", func() {
+				response, err := http.Get(server.URL + "/debug/vars")
+				Expect(err).NotTo(HaveOccurred())
+				defer response.Body.Close()
+				Expect(response.StatusCode).To(Equal(http.StatusOK))
+				vars := make(map[string]interface{})
+				Expect(json.NewDecoder(response.Body).Decode(&vars)).To(Succeed())
+				Expect(vars).To(HaveKey("memstats"))
+			})
+		})
+	})
+
+	Context("with a circuit breaker around redis", func() {
+
+		var guarded guardedCounter
+
+		BeforeEach(func() {
+			guarded = guardedCounter{FakeWordCounter: wordCounter, stats: breaker.Stats{State: breaker.Closed, Calls: 10}}
+		})
+
+		JustBeforeEach(func() {
+			server = httptest.NewServer(web.NewHealth(guarded, "", nil))
+		})
+
+		It("reports the state of the breaker", func() {
+			status, body := get("/readyz")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body["breaker"]).To(HaveKeyWithValue("state", "closed"))
+			Expect(body["breaker"]).To(HaveKeyWithValue("calls", BeNumerically("==", 10)))
+		})
+
+		Context("while it is open", func() {
+
+			BeforeEach(func() {
+				guarded.stats.State = breaker.Open
+				wordCounter.PingReturns(&breaker.OpenError{RetryAfter: 3 * time.Second})
+			})
+
+			It("is not ready, saying when to retry", func() {
+				response, err := http.Get(server.URL + "/readyz")
+				Expect(err).NotTo(HaveOccurred())
+				defer response.Body.Close()
+				Expect(response.StatusCode).To(Equal(http.StatusServiceUnavailable))
+				Expect(response.Header.Get("Retry-After")).To(Equal("3"))
+				body := make(map[string]interface{})
+				Expect(json.NewDecoder(response.Body).Decode(&body)).To(Succeed())
+				Expect(body["breaker"]).To(HaveKeyWithValue("state", "open"))
+			})
+		})
+	})
+
+	Context("in a process that requires a stream", func() {
+
+		BeforeEach(func() {
+			server = httptest.NewServer(web.NewHealth(wordCounter, "twitter", nil))
+		})
+
+		It("is ready while the stream from that source is connected", func() {
+			wordCounter.StreamsReturns([]health.Stream{
+				{Source: "mastodon", Connected: false},
+				{Source: "twitter", Connected: true},
+			}, nil)
+			status, body := get("/readyz")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body["streams"]).To(HaveLen(2))
+		})
+
+		It("is not ready while the stream from that source is disconnected", func() {
+			wordCounter.StreamsReturns([]health.Stream{
+				{Source: "mastodon", Connected: true},
+				{Source: "twitter", Connected: false},
+			}, nil)
+			status, _ := get("/readyz")
+			Expect(status).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("is not ready before the source has reported", func() {
+			status, _ := get("/readyz")
+			Expect(status).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("does not report a spool", func() {
+			_, body := get("/readyz")
+			Expect(body).NotTo(HaveKey("spool"))
+		})
+	})
+
+	Context("in a gatherer spooling counts", func() {
+
+		BeforeEach(func() {
+			server = httptest.NewServer(web.NewHealth(wordCounter, "", spoolDepth(42)))
+		})
+
+		It("reports the number of counts waiting to be replayed", func() {
+			wordCounter.PingReturns(errors.New("connection refused"))
+			status, body := get("/readyz")
+			Expect(status).To(Equal(http.StatusServiceUnavailable))
+			Expect(body["spool"]).To(BeNumerically("==", 42))
+		})
+	})
+})
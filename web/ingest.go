@@ -0,0 +1,138 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/craigfurman/bovine/tweet"
+
+	"github.com/gorilla/mux"
+)
+
+// MaxIngestBytes is the largest request body POST /ingest accepts.
+const MaxIngestBytes = 10 << 20
+
+//go:generate counterfeiter . Ingester
+type Ingester interface {
+	Ingest(ctx context.Context, posts []tweet.Tweet) (hits uint, err error)
+}
+
+type post struct {
+	ID        string    `json:"id"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	Lang      string    `json:"lang"`
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type ingestResult struct {
+	Posts int  `json:"posts"`
+	Hits  uint `json:"hits"`
+}
+
+// AddIngest serves POST /ingest, counting the keyword hits in posts pushed by
+// clients presenting apiKey as a bearer token. The body is a single post, a
+// JSON array of posts or newline delimited posts.
+func AddIngest(r *mux.Router, ingester Ingester, apiKey string) {
+	r.HandleFunc("/ingest", ingest(ingester, apiKey)).
+		Methods("POST")
+}
+
+func ingest(ingester Ingester, apiKey string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !authorized(req, apiKey) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bovine"`)
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		posts, err := readPosts(http.MaxBytesReader(w, req.Body, MaxIngestBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hits, err := ingester.Ingest(req.Context(), posts)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, ingestResult{Posts: len(posts), Hits: hits})
+	}
+}
+
+func authorized(req *http.Request, apiKey string) bool {
+	const prefix = "Bearer "
+	header := req.Header.Get("Authorization")
+	if apiKey == "" || !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(apiKey)) == 1
+}
+
+// readPosts reads a JSON array of posts, or one or more posts one after
+// another, which covers both a single post and newline delimited JSON. Posts
+// without a timestamp are counted now.
+func readPosts(body io.Reader) ([]tweet.Tweet, error) {
+	reader := bufio.NewReader(body)
+	decoder := json.NewDecoder(reader)
+	var posts []post
+	first, err := firstByte(reader)
+	if err != nil {
+		return nil, err
+	}
+	if first == '[' {
+		if err := decoder.Decode(&posts); err != nil {
+			return nil, err
+		}
+	} else {
+		for {
+			var p post
+			if err := decoder.Decode(&p); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("post %d: %s", len(posts)+1, err)
+			}
+			posts = append(posts, p)
+		}
+	}
+	if len(posts) == 0 {
+		return nil, errors.New("no posts")
+	}
+	tweets := make([]tweet.Tweet, len(posts))
+	for i, p := range posts {
+		if p.Text == "" {
+			return nil, fmt.Errorf("post %d has no text", i+1)
+		}
+		if p.Timestamp.IsZero() {
+			p.Timestamp = time.Now()
+		}
+		tweets[i] = tweet.Tweet{ID: p.ID, AuthorID: p.Author, Text: p.Text, Lang: p.Lang, Source: p.Source, CreatedAt: p.Timestamp}
+	}
+	return tweets, nil
+}
+
+// firstByte returns the first non-whitespace byte of a body without
+// consuming it.
+func firstByte(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return 0, errors.New("no posts")
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			return b[0], nil
+		}
+		reader.ReadByte()
+	}
+}
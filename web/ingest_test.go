@@ -0,0 +1,142 @@
+package web_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/craigfurman/bovine/web"
+	"github.com/craigfurman/bovine/web/fakes"
+
+	"github.com/gorilla/mux"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ingesting posts", func() {
+
+	var (
+		server   *httptest.Server
+		ingester *fakes.FakeIngester
+		apiKey   string
+	)
+
+	BeforeEach(func() {
+		ingester = new(fakes.FakeIngester)
+		ingester.IngestReturns(3, nil)
+		apiKey = "s3cret"
+	})
+
+	JustBeforeEach(func() {
+		r := mux.NewRouter()
+		web.AddIngest(r, ingester, "s3cret")
+		server = httptest.NewServer(r)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	post := func(contentType, body string) (*http.Response, string) {
+		req, err := http.NewRequest("POST", server.URL+"/ingest", strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Content-Type", contentType)
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		response, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		bodyBytes, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return response, string(bodyBytes)
+	}
+
+	It("counts the keywords in a single post", func() {
+		response, body := post("application/json", `{"id": "1", "author": "alice", "text": "bacon sandwich", "source": "crm", "timestamp": "2024-05-01T12:00:00Z"}`)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		var result map[string]int
+		Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+		Expect(result).To(Equal(map[string]int{"posts": 1, "hits": 3}))
+
+		Expect(ingester.IngestCallCount()).To(Equal(1))
+		_, posts := ingester.IngestArgsForCall(0)
+		Expect(posts).To(HaveLen(1))
+		Expect(posts[0].ID).To(Equal("1"))
+		Expect(posts[0].AuthorID).To(Equal("alice"))
+		Expect(posts[0].Text).To(Equal("bacon sandwich"))
+		Expect(posts[0].Source).To(Equal("crm"))
+		Expect(posts[0].CreatedAt).To(BeTemporally("==", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)))
+	})
+
+	It("counts a JSON array of posts", func() {
+		response, _ := post("application/json", ` [{"text": "bacon"}, {"text": "eggs"}]`)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		_, posts := ingester.IngestArgsForCall(0)
+		Expect(posts).To(HaveLen(2))
+		Expect(posts[1].Text).To(Equal("eggs"))
+	})
+
+	It("counts newline delimited posts", func() {
+		response, _ := post("application/x-ndjson", "{\"text\": \"bacon\"}\n{\"text\": \"eggs\"}\n")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		_, posts := ingester.IngestArgsForCall(0)
+		Expect(posts).To(HaveLen(2))
+		Expect(posts[0].Text).To(Equal("bacon"))
+	})
+
+	It("counts posts without a timestamp now", func() {
+		post("application/json", `{"text": "bacon"}`)
+		_, posts := ingester.IngestArgsForCall(0)
+		Expect(posts[0].CreatedAt).To(BeTemporally("~", time.Now(), time.Second))
+	})
+
+	It("rejects posts without text", func() {
+		response, body := post("application/x-ndjson", "{\"text\": \"bacon\"}\n{\"id\": \"2\"}\n")
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(body).To(ContainSubstring("post 2 has no text"))
+		Expect(ingester.IngestCallCount()).To(BeZero())
+	})
+
+	It("rejects malformed JSON", func() {
+		response, _ := post("application/json", `{"text": `)
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("rejects an empty body", func() {
+		response, _ := post("application/json", "  ")
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	Context("without the API key", func() {
+
+		BeforeEach(func() {
+			apiKey = "guess"
+		})
+
+		It("refuses the request", func() {
+			response, _ := post("application/json", `{"text": "bacon"}`)
+			Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(response.Header.Get("WWW-Authenticate")).To(ContainSubstring("Bearer"))
+			Expect(ingester.IngestCallCount()).To(BeZero())
+		})
+	})
+
+	Context("when indexing fails", func() {
+
+		BeforeEach(func() {
+			ingester.IngestReturns(0, errors.New("o no!"))
+		})
+
+		It("returns the error over HTTP", func() {
+			response, body := post("application/json", `{"text": "bacon"}`)
+			Expect(response.StatusCode).To(Equal(500))
+			Expect(body).To(Equal("o no!"))
+		})
+	})
+})